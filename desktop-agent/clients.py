@@ -100,14 +100,20 @@ def call_dashscope(model_name: str, system_prompt: str, question: str) -> str:
     return ""
 
 
+def relay_headers() -> dict:
+    if not config.API_TOKEN:
+        return {}
+    return {"Authorization": f"Bearer {config.API_TOKEN}"}
+
+
 def post_feedback(payload: dict) -> None:
     url = f"{config.SERVER_URL.rstrip('/')}/api/feedback"
-    res = http_session.post(url, json=payload, timeout=10)
+    res = http_session.post(url, json=payload, headers=relay_headers(), timeout=10)
     res.raise_for_status()
 
 
 def post_control(action: str, delta: int) -> None:
     url = f"{config.SERVER_URL.rstrip('/')}/api/control"
     payload = {"action": action, "delta": delta}
-    res = http_session.post(url, json=payload, timeout=5)
+    res = http_session.post(url, json=payload, headers=relay_headers(), timeout=5)
     res.raise_for_status()
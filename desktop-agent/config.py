@@ -26,6 +26,7 @@ def env_float(key: str, default: float) -> float:
 
 
 SERVER_URL = os.getenv("SERVER_URL", "http://localhost:4000")
+API_TOKEN = os.getenv("API_TOKEN", "")
 OPENAI_API_KEY = os.getenv("OPENAI_API_KEY")
 
 BASE_PROMPT = "Solve the problem shown in this image. Show your work."
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAckViewers caps how many viewer labels are remembered per control.
+const maxAckViewers = 32
+
+// ackTracker remembers which control messages viewers have applied. Entries
+// live for ttl after the control was sent, which is plenty for a sender
+// polling to confirm a scroll landed.
+type ackTracker struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*ackStatus
+}
+
+type ackStatus struct {
+	ID        string     `json:"id"`
+	Action    string     `json:"action"`
+	SentAt    time.Time  `json:"sentAt"`
+	Acks      int        `json:"acks"`
+	Viewers   []string   `json:"viewers,omitempty"`
+	LastAckAt *time.Time `json:"lastAckAt"`
+}
+
+type ackRequest struct {
+	ID     string `json:"id"`
+	Viewer string `json:"viewer"`
+}
+
+func newAckTracker(ttl time.Duration) *ackTracker {
+	return &ackTracker{ttl: ttl, entries: make(map[string]*ackStatus)}
+}
+
+// track registers a freshly broadcast control. Expired entries are pruned
+// here, so the map never outgrows the controls sent within one ttl.
+func (t *ackTracker) track(id, action string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, entry := range t.entries {
+		if now.Sub(entry.SentAt) > t.ttl {
+			delete(t.entries, key)
+		}
+	}
+	t.entries[id] = &ackStatus{ID: id, Action: action, SentAt: now}
+}
+
+// ack records one viewer applying the control. It reports false when the id
+// is unknown or has expired.
+func (t *ackTracker) ack(id, viewer string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[id]
+	if !ok || now.Sub(entry.SentAt) > t.ttl {
+		return false
+	}
+	entry.Acks++
+	entry.LastAckAt = &now
+	if viewer != "" && len(entry.Viewers) < maxAckViewers {
+		entry.Viewers = append(entry.Viewers, viewer)
+	}
+	return true
+}
+
+func (t *ackTracker) lookup(id string, now time.Time) (ackStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[id]
+	if !ok || now.Sub(entry.SentAt) > t.ttl {
+		return ackStatus{}, false
+	}
+	status := *entry
+	status.Viewers = append([]string(nil), entry.Viewers...)
+	return status, true
+}
+
+func handleControlAck(acks *ackTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body ackRequest
+		if err := decodeJSON(r.Body, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", invalidJSONMessage(err))
+			return
+		}
+		if body.ID == "" {
+			writeJSONError(w, http.StatusBadRequest, "id_required", "id is required")
+			return
+		}
+		viewer, err := ackViewer(body.Viewer)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_viewer", err.Error())
+			return
+		}
+		if !acks.ack(body.ID, viewer, time.Now().UTC()) {
+			writeJSONError(w, http.StatusNotFound, "unknown_control", "unknown or expired control id")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleControlAcks(acks *ackTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			writeJSONError(w, http.StatusBadRequest, "id_required", "id is required")
+			return
+		}
+		status, ok := acks.lookup(id, time.Now().UTC())
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "unknown_control", "unknown or expired control id")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("failed to write acks response: %v", err)
+		}
+	}
+}
+
+func ackViewer(viewer string) (string, error) {
+	viewer = strings.TrimSpace(viewer)
+	if len(viewer) > 64 {
+		return "", errors.New("viewer must be at most 64 characters")
+	}
+	return viewer, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type uploadInfo struct {
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	ModifiedAt string `json:"modifiedAt"`
+}
+
+// handleListUploads lists the files in a room's upload directory, as held
+// by the configured BlobStore.
+func handleListUploads(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		entries, err := rooms.blobs.List(room.uploadDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			writeJSONError(w, http.StatusInternalServerError, "storage_failed", "could not read uploads")
+			return
+		}
+		uploads := make([]uploadInfo, 0, len(entries))
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			uploads = append(uploads, uploadInfo{
+				Name:       entry.Name(),
+				URL:        blobURL(rooms.blobs, room.uploadID(entry.Name())),
+				SizeBytes:  info.Size(),
+				ModifiedAt: info.ModTime().UTC().Format(time.RFC3339),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"uploads": uploads}); err != nil {
+			log.Printf("failed to encode uploads: %v", err)
+		}
+	}
+}
+
+// handleDeleteUpload removes one upload, and its thumbnail, on demand. If
+// the room's latest payload shows it, viewers are told to clear.
+func handleDeleteUpload(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		name := chi.URLParam(r, "name")
+		if !validUploadName(name) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_name", "name must be a plain file name")
+			return
+		}
+		info, err := statBlob(rooms.blobs, filepath.Join(room.uploadDir, name))
+		if err != nil || info.IsDir() {
+			writeJSONError(w, http.StatusNotFound, "upload_not_found", "no such upload")
+			return
+		}
+
+		id := room.uploadID(name)
+		ids := []string{id}
+		if _, isThumb := thumbnailSource(name); !isThumb {
+			ids = append(ids, room.uploadID(thumbnailName(name)))
+		}
+		if room.state.clearLatestIf(func(p *feedbackPayload) bool {
+			return slices.Contains(p.uploadIDs(), id)
+		}) {
+			room.broker.broadcast(message{kind: "clear", data: []byte(`{"type":"clear"}`)})
+		}
+		for _, id := range ids {
+			rooms.removeUpload(id)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validUploadName accepts a bare file name: no separators, no "..", and no
+// hidden files such as in-progress .upload-* temporaries.
+func validUploadName(name string) bool {
+	return name != "" &&
+		!strings.ContainsAny(name, `/\`) &&
+		!strings.Contains(name, "..") &&
+		!strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const amendBodyLimit = 64 << 10
+
+// amendRequest is the body of PATCH /api/feedback/{id}. Omitted fields are
+// left as they were; "tags": [] clears the tags.
+type amendRequest struct {
+	Feedback *string   `json:"feedback"`
+	Tags     *[]string `json:"tags"`
+}
+
+// handleAmendFeedback rewrites the text and tags of a feedback event in the
+// room's history, or in DB_PATH once the history buffer has dropped it, and
+// re-broadcasts it as an update, so viewers fix what they show in place.
+// Screenshots, audio and meta are left alone.
+func handleAmendFeedback(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, amendBodyLimit)
+		var body amendRequest
+		if err := decodeJSON(r.Body, &body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeTooLarge(w, tooLarge.Limit)
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", invalidJSONMessage(err))
+			return
+		}
+		if body.Feedback == nil && body.Tags == nil {
+			writeJSONError(w, http.StatusBadRequest, "nothing_to_update", "feedback or tags is required")
+			return
+		}
+
+		var feedback string
+		if body.Feedback != nil {
+			if strings.TrimSpace(*body.Feedback) == "" {
+				writeJSONError(w, http.StatusBadRequest, "feedback_required", "feedback is required")
+				return
+			}
+			if feedback, err = rooms.text.clean(*body.Feedback); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "feedback_too_long", err.Error())
+				return
+			}
+		}
+		var tags []string
+		if body.Tags != nil {
+			if tags, err = normalizeTags(*body.Tags); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+				return
+			}
+		}
+
+		id := chi.URLParam(r, "id")
+		edit := func(p *feedbackPayload) {
+			if body.Feedback != nil {
+				p.Feedback = feedback
+			}
+			if body.Tags != nil {
+				p.Tags = tags
+			}
+		}
+		payload, seq, ok := room.state.amend(id, edit)
+		if !ok && rooms.db != nil {
+			// Older than the history buffer, but DB_PATH still has it.
+			seq = room.state.nextSeq()
+			if payload, err = rooms.db.amend(room.name, id, seq, edit); err != nil {
+				log.Printf("failed to amend feedback %s in room %q: %v", id, room.name, err)
+				writeJSONError(w, http.StatusInternalServerError, "storage_failed", "could not update the feedback")
+				return
+			}
+			ok = payload != nil
+		}
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "feedback_not_found", "no feedback with that id in the room's history")
+			return
+		}
+
+		if !payload.silent() {
+			room.broker.broadcast(updateMessage(seq, payload))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			log.Printf("failed to encode amended payload: %v", err)
+		}
+	}
+}
+
+// amendedPayload is a copy of p with edit applied, stamped as one more
+// revision.
+func amendedPayload(p *feedbackPayload, edit func(*feedbackPayload)) *feedbackPayload {
+	updated := *p
+	edit(&updated)
+	updated.EditedAt = time.Now().UTC().Format(time.RFC3339)
+	updated.Revision++
+	return &updated
+}
+
+// updateMessage is the {"type":"update"} broadcast for an edit, carrying the
+// edit's sequence number so reconnecting viewers can replay it.
+func updateMessage(seq uint64, p *feedbackPayload) message {
+	data, _ := json.Marshal(map[string]interface{}{"type": "update", "payload": p})
+	return message{id: seq, kind: "update", silent: p.silent(), data: data}
+}
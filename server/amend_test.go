@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// patchFeedback sends PATCH /api/feedback/{id} with body to reg.
+func patchFeedback(reg *roomRegistry, id, body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Patch("/api/feedback/{id}", handleAmendFeedback(reg))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/api/feedback/"+id, strings.NewReader(body)))
+	return rec
+}
+
+func TestAmendFeedback(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	room.state.setLatest(&feedbackPayload{ID: "a", Feedback: "tpyo", ScreenshotID: "shot.png"})
+	viewer := newClient(4, false)
+	room.broker.addClient(viewer)
+
+	rec := patchFeedback(reg, "a", `{"feedback":"typo","tags":["Fixed"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var got feedbackPayload
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Feedback != "typo" || len(got.Tags) != 1 || got.Tags[0] != "fixed" || got.Revision != 1 || got.EditedAt == "" {
+		t.Errorf("amended payload = %+v", got)
+	}
+	if got.ScreenshotID != "shot.png" {
+		t.Errorf("screenshot = %q, want it untouched", got.ScreenshotID)
+	}
+	if latest, _ := room.state.getLatest(); latest.Feedback != "typo" {
+		t.Errorf("latest still says %q", latest.Feedback)
+	}
+
+	msg := <-viewer.ch
+	if msg.kind != "update" || msg.id != 2 {
+		t.Errorf("broadcast %s with id %d, want an update with id 2", msg.kind, msg.id)
+	}
+	var update struct {
+		Type    string
+		Payload feedbackPayload
+	}
+	if err := json.Unmarshal(msg.data, &update); err != nil || update.Type != "update" || update.Payload.Feedback != "typo" {
+		t.Errorf("update event = %s", msg.data)
+	}
+}
+
+func TestAmendUnknownFeedback(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 1, false)
+	room, _ := reg.get("")
+	room.state.setLatest(&feedbackPayload{ID: "old"})
+	room.state.setLatest(&feedbackPayload{ID: "new"})
+
+	for _, id := range []string{"missing", "old"} {
+		if rec := patchFeedback(reg, id, `{"feedback":"x"}`); rec.Code != http.StatusNotFound {
+			t.Errorf("PATCH %s = %d, want 404", id, rec.Code)
+		}
+	}
+}
+
+func TestAmendReplaysAfterReconnect(t *testing.T) {
+	s := newState(10)
+	s.setLatest(&feedbackPayload{ID: "a", Feedback: "one"})
+	s.setLatest(&feedbackPayload{ID: "b", Feedback: "two"})
+	if _, seq, ok := s.amend("a", func(p *feedbackPayload) { p.Feedback = "uno" }); !ok || seq != 3 {
+		t.Fatalf("amend = seq %d, %v; want seq 3", seq, ok)
+	}
+
+	missed, _ := s.since(2)
+	if len(missed) != 1 || missed[0].kind != "update" || missed[0].id != 3 {
+		t.Fatalf("since(2) = %+v, want the update as id 3", missed)
+	}
+	if !strings.Contains(string(missed[0].data), `"uno"`) {
+		t.Errorf("replayed update = %s", missed[0].data)
+	}
+
+	all, _ := s.since(0)
+	if len(all) != 2 || all[0].kind != "feedback" || all[0].id != 1 || !strings.Contains(string(all[0].data), `"uno"`) {
+		t.Errorf("since(0) = %+v, want both payloads, a already edited", all)
+	}
+}
+
+func TestAmendEvictedFeedbackInDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.db")
+	reg := newDBRegistry(t, path)
+	reg.historySize = 1
+	room, _ := reg.get("")
+	room.state.setLatest(&feedbackPayload{ID: "a", Feedback: "one"})
+	room.state.setLatest(&feedbackPayload{ID: "b", Feedback: "two"})
+
+	rec := patchFeedback(reg, "a", `{"feedback":"uno"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH of an evicted id = %d %s, want 200 from the database", rec.Code, rec.Body)
+	}
+	items, _, err := reg.db.queryHistory("", historyQuery{limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[1].ID != "a" || items[1].Feedback != "uno" || items[1].Revision != 1 {
+		t.Errorf("stored history = %+v, want a edited", items)
+	}
+
+	// The edit's sequence survives a restart, so it is never handed out again.
+	restarted := newDBRegistry(t, path)
+	room, _ = restarted.get("")
+	if msg := room.state.setLatest(&feedbackPayload{ID: "c"}); msg.id != 4 {
+		t.Errorf("next payload after restart got seq %d, want 4", msg.id)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	maxAnnotations       = 50
+	maxAnnotationLabel   = 200
+	annotateBodyLimit    = 64 << 10
+	annotationLineWidth  = 3
+	annotationLabelInset = 3
+)
+
+var (
+	annotationColor = color.RGBA{R: 255, G: 59, B: 48, A: 255}
+	annotationText  = image.NewUniform(color.White)
+)
+
+// annotation is one highlight to burn into a screenshot. Coordinates are
+// screenshot pixels, like the highlight control action.
+type annotation struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Label  string `json:"label"`
+}
+
+type annotateRequest struct {
+	ScreenshotID string                 `json:"screenshotId"`
+	Annotations  []annotation           `json:"annotations"`
+	Broadcast    bool                   `json:"broadcast"`
+	Feedback     string                 `json:"feedback"`
+	Meta         map[string]interface{} `json:"meta"`
+}
+
+type annotateResponse struct {
+	ScreenshotID string `json:"screenshotId"`
+	Screenshot   string `json:"screenshotUrl"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// handleAnnotate draws rectangles and labels onto a stored screenshot and
+// saves the result as a new upload. With "broadcast":true the annotated
+// image is published like regular feedback; otherwise only its URL is
+// returned.
+func handleAnnotate(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, annotateBodyLimit)
+		var body annotateRequest
+		if err := decodeJSON(r.Body, &body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeTooLarge(w, tooLarge.Limit)
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", invalidJSONMessage(err))
+			return
+		}
+
+		// The id must name a screenshot in this room, not a thumbnail or a
+		// file in some other room's directory.
+		name := path.Base(body.ScreenshotID)
+		if !validUploadName(name) || room.uploadID(name) != body.ScreenshotID {
+			writeJSONError(w, http.StatusBadRequest, "invalid_screenshot", "screenshotId must name a screenshot in this room")
+			return
+		}
+		if _, isThumb := thumbnailSource(name); isThumb {
+			writeJSONError(w, http.StatusBadRequest, "invalid_screenshot", "screenshotId must not be a thumbnail")
+			return
+		}
+		if room.state.expiredUpload(body.ScreenshotID) {
+			writeJSONError(w, http.StatusGone, "screenshot_expired", "screenshot has expired")
+			return
+		}
+		// Decoding, drawing and re-encoding are all upload-sized work.
+		release, err := rooms.uploadSlots.acquire(r.Context())
+		if err != nil {
+			writeUploadsBusy(w)
+			return
+		}
+		defer release()
+		data, err := readBlob(rooms.blobs, filepath.Join(room.uploadDir, name))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "screenshot_not_found", "no such screenshot")
+			return
+		}
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "invalid_image", "screenshot is not a decodable image")
+			return
+		}
+		if err := validateAnnotations(body.Annotations, src.Bounds()); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_annotation", err.Error())
+			return
+		}
+
+		var meta map[string]interface{}
+		if body.Broadcast {
+			if strings.TrimSpace(body.Feedback) == "" {
+				writeJSONError(w, http.StatusBadRequest, "feedback_required", "feedback is required to broadcast")
+				return
+			}
+			if body.Feedback, err = rooms.text.clean(body.Feedback); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "feedback_too_long", err.Error())
+				return
+			}
+			if meta, err = rooms.meta.sanitize(body.Meta); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_meta", err.Error())
+				return
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, drawAnnotations(src, body.Annotations)); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "encode_failed", "failed to encode annotated image")
+			return
+		}
+		upload, err := storeScreenshot(rooms.blobs, room.uploadDir, "png", buf.Bytes(), rooms.uploads, rooms.screenshots)
+		if err != nil {
+			writeUploadError(w, err, "invalid_image", "invalid image")
+			return
+		}
+
+		if body.Broadcast {
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["annotatedFrom"] = body.ScreenshotID
+			payload := newFeedbackPayload(room, rooms.blobs, body.Feedback, time.Now().UTC().Format(time.RFC3339), meta, upload, "")
+			publishFeedback(w, r, room, payload, rooms.webhook)
+			return
+		}
+
+		id := room.uploadID(upload.filename)
+		resp := annotateResponse{
+			ScreenshotID: id,
+			Screenshot:   blobURL(rooms.blobs, id),
+			Width:        upload.width,
+			Height:       upload.height,
+		}
+		if upload.thumbnail != "" {
+			resp.ThumbnailURL = blobURL(rooms.blobs, room.uploadID(upload.thumbnail))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("failed to encode annotate response: %v", err)
+		}
+	}
+}
+
+func validateAnnotations(annotations []annotation, bounds image.Rectangle) error {
+	if len(annotations) == 0 {
+		return errors.New("at least one annotation is required")
+	}
+	if len(annotations) > maxAnnotations {
+		return fmt.Errorf("at most %d annotations are allowed", maxAnnotations)
+	}
+	for i, a := range annotations {
+		if a.Width <= 0 || a.Height <= 0 {
+			return fmt.Errorf("annotation %d: width and height must be positive", i)
+		}
+		if a.X < 0 || a.Y < 0 || a.X+a.Width > bounds.Dx() || a.Y+a.Height > bounds.Dy() {
+			return fmt.Errorf("annotation %d: rectangle must lie within the %dx%d screenshot", i, bounds.Dx(), bounds.Dy())
+		}
+		if len(a.Label) > maxAnnotationLabel {
+			return fmt.Errorf("annotation %d: label exceeds %d bytes", i, maxAnnotationLabel)
+		}
+	}
+	return nil
+}
+
+// drawAnnotations returns a copy of src with each rectangle outlined and its
+// label, if any, printed on a filled tab just above it (or inside it when
+// the rectangle touches the top edge).
+func drawAnnotations(src image.Image, annotations []annotation) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+
+	stroke := image.NewUniform(annotationColor)
+	face := basicfont.Face7x13
+	for _, a := range annotations {
+		rect := image.Rect(a.X, a.Y, a.X+a.Width, a.Y+a.Height)
+		lw := min(annotationLineWidth, a.Width, a.Height)
+		for _, edge := range []image.Rectangle{
+			image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+lw),
+			image.Rect(rect.Min.X, rect.Max.Y-lw, rect.Max.X, rect.Max.Y),
+			image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+lw, rect.Max.Y),
+			image.Rect(rect.Max.X-lw, rect.Min.Y, rect.Max.X, rect.Max.Y),
+		} {
+			draw.Draw(dst, edge, stroke, image.Point{}, draw.Src)
+		}
+
+		if a.Label == "" {
+			continue
+		}
+		d := &font.Drawer{Dst: dst, Src: annotationText, Face: face}
+		textWidth := d.MeasureString(a.Label).Ceil()
+		tabHeight := face.Height + 2*annotationLabelInset
+		tab := image.Rect(rect.Min.X, rect.Min.Y-tabHeight, rect.Min.X+textWidth+2*annotationLabelInset, rect.Min.Y)
+		if tab.Min.Y < 0 {
+			tab = tab.Add(image.Pt(0, tabHeight))
+		}
+		tab = tab.Intersect(dst.Bounds())
+		draw.Draw(dst, tab, stroke, image.Point{}, draw.Src)
+		d.Dot = fixed.P(tab.Min.X+annotationLabelInset, tab.Min.Y+annotationLabelInset+face.Ascent)
+		d.DrawString(a.Label)
+	}
+	return dst
+}
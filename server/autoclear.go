@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// autoClear blanks the latest payload in every room that has had no new
+// feedback for idle, broadcasting a clear to its viewers, and returns how
+// many rooms it cleared.
+func (reg *roomRegistry) autoClear(idle time.Duration, now time.Time) int {
+	reg.mu.Lock()
+	rooms := make([]*roomState, 0, len(reg.rooms))
+	for _, rm := range reg.rooms {
+		rooms = append(rooms, rm)
+	}
+	reg.mu.Unlock()
+
+	cleared := 0
+	for _, rm := range rooms {
+		if rm.state.clearLatestIdle(idle, now) {
+			rm.broker.broadcast(message{kind: "clear", data: []byte(`{"type":"clear"}`)})
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// runAutoClear enforces AUTO_CLEAR_AFTER. Rooms are checked several times
+// per idle window, and at least once a second, so a clear lands shortly
+// after the window elapses rather than exactly on it.
+func runAutoClear(ctx context.Context, reg *roomRegistry, idle time.Duration) {
+	ticker := time.NewTicker(max(min(idle/4, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if cleared := reg.autoClear(idle, time.Now()); cleared > 0 {
+			log.Printf("auto-cleared latest feedback in %d idle room(s)", cleared)
+		}
+	}
+}
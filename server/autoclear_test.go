@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoClearAfterIdle(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	viewer := newClient(4, false)
+	room.broker.addClient(viewer)
+	room.state.setLatest(&feedbackPayload{ID: "a"})
+	now := time.Now()
+
+	if n := reg.autoClear(time.Minute, now.Add(30*time.Second)); n != 0 {
+		t.Errorf("cleared %d rooms inside the idle window", n)
+	}
+	if n := reg.autoClear(time.Minute, now.Add(2*time.Minute)); n != 1 {
+		t.Fatalf("cleared %d rooms after the idle window, want 1", n)
+	}
+	if msg := <-viewer.ch; msg.kind != "clear" {
+		t.Errorf("viewer got %q, want clear", msg.kind)
+	}
+	if latest, _ := room.state.getLatest(); latest != nil {
+		t.Error("latest survived the auto-clear")
+	}
+	if n := reg.autoClear(time.Minute, now.Add(4*time.Minute)); n != 0 {
+		t.Errorf("cleared an already clear room %d times", n)
+	}
+}
+
+func TestRestoredLatestKeepsItsAge(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name  string
+		age   time.Duration
+		clear bool
+	}{
+		{"stale", time.Hour, true},
+		{"fresh", time.Minute, false},
+		{"future", -time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := newRoomRegistry(t.TempDir(), 10, false)
+			room, _ := reg.get("")
+			room.state.restore(roomSnapshot{
+				Seq:       1,
+				LatestSeq: 1,
+				History: []snapshotEntry{{Seq: 1, Payload: &feedbackPayload{
+					ID:        "a",
+					Timestamp: now.Add(-tc.age).UTC().Format(time.RFC3339),
+				}}},
+			})
+			if cleared := reg.autoClear(30*time.Minute, now) == 1; cleared != tc.clear {
+				t.Errorf("auto-cleared = %v, want %v", cleared, tc.clear)
+			}
+		})
+	}
+}
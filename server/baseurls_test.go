@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// withInterfaceIPs makes interfaceIPs report addrs for the rest of the test.
+func withInterfaceIPs(t *testing.T, addrs ...string) {
+	t.Helper()
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	saved := interfaceIPs
+	// localBaseURLs filters the slice in place, so hand out a fresh copy.
+	interfaceIPs = func() []net.IP { return slices.Clone(ips) }
+	t.Cleanup(func() { interfaceIPs = saved })
+}
+
+// ipURLs drops the hostname and localhost entries from localBaseURLs.
+func ipURLs(urls []string) []string {
+	return slices.DeleteFunc(urls, func(u string) bool {
+		host := strings.TrimPrefix(u, "http://")
+		return !strings.HasPrefix(host, "[") && net.ParseIP(strings.Split(host, ":")[0]) == nil
+	})
+}
+
+func TestLocalBaseURLsIPv6(t *testing.T) {
+	withInterfaceIPs(t, "2001:db8::1", "fe80::1", "203.0.113.7", "::1", "192.168.1.20", "fd00::5")
+
+	for _, tc := range []struct {
+		ipv6 bool
+		want []string
+	}{
+		{false, []string{"http://192.168.1.20:4000", "http://203.0.113.7:4000"}},
+		{true, []string{"http://192.168.1.20:4000", "http://203.0.113.7:4000", "http://[2001:db8::1]:4000", "http://[fd00::5]:4000"}},
+	} {
+		includeIPv6 = tc.ipv6
+		got := ipURLs(localBaseURLs("http", "4000"))
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("INCLUDE_IPV6=%v: urls = %q, want %q", tc.ipv6, got, tc.want)
+		}
+	}
+	includeIPv6 = false
+}
+
+func TestLocalBaseURLsIPv6Only(t *testing.T) {
+	withInterfaceIPs(t, "fe80::1", "2001:db8::42")
+	includeIPv6 = true
+	defer func() { includeIPv6 = false }()
+
+	urls := localBaseURLs("https", "8443")
+	if len(urls) == 0 || urls[0] != "https://[2001:db8::42]:8443" {
+		t.Errorf("urls = %q, want the global IPv6 address first", urls)
+	}
+	for _, u := range urls {
+		if strings.Contains(u, "fe80") {
+			t.Errorf("link-local address advertised: %s", u)
+		}
+	}
+}
+
+func TestLocalBaseURLsOrder(t *testing.T) {
+	withInterfaceIPs(t, "203.0.113.7", "169.254.3.3", "10.0.0.9", "127.0.0.1", "192.168.1.20")
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		t.Skip("no hostname")
+	}
+
+	want := []string{
+		"http://10.0.0.9:4000",
+		"http://192.168.1.20:4000",
+		"http://203.0.113.7:4000",
+		"http://" + hostname + ".local:4000",
+		"http://" + hostname + ":4000",
+		"http://localhost:4000",
+	}
+	if got := localBaseURLs("http", "4000"); !slices.Equal(got, want) {
+		t.Errorf("urls = %q, want %q", got, want)
+	}
+	if got := qrDefaultTarget("http", "4000", ""); got != want[0] {
+		t.Errorf("QR default = %q, want the first private LAN address", got)
+	}
+	if got := qrDefaultTarget("http", "4000", "https://example.com/view"); got != "https://example.com/view" {
+		t.Errorf("QR default with an override = %q", got)
+	}
+}
+
+func TestLocalBaseURLsBindAddr(t *testing.T) {
+	withInterfaceIPs(t, "192.168.1.20")
+	defer func(saved net.IP) { bindAddr = saved }(bindAddr)
+
+	bindAddr = net.ParseIP("127.0.0.1")
+	if got := localBaseURLs("http", "4000"); !slices.Equal(got, []string{"http://localhost:4000"}) {
+		t.Errorf("loopback bind: urls = %q", got)
+	}
+	bindAddr = net.ParseIP("192.168.1.5")
+	if got := localBaseURLs("http", "4000"); !slices.Equal(got, []string{"http://192.168.1.5:4000"}) {
+		t.Errorf("specific bind: urls = %q", got)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseBasicAuth splits BASIC_AUTH ("user:pass"). The password may itself
+// contain colons.
+func parseBasicAuth(raw string) (user, pass string, err error) {
+	user, pass, ok := strings.Cut(raw, ":")
+	if !ok || user == "" || pass == "" {
+		return "", "", fmt.Errorf("BASIC_AUTH must be user:pass")
+	}
+	return user, pass, nil
+}
+
+// basicAuth gates everything behind HTTP Basic credentials (BASIC_AUTH).
+// Programs already holding a bearer token, such as the capture agent with
+// API_TOKEN, cannot send Basic credentials in the same Authorization
+// header, so a bearer matching one of tokens is accepted instead.
+func basicAuth(user, pass string, tokens ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if gotUser, gotPass, ok := r.BasicAuth(); ok {
+				// Compare both halves every time so timing reveals neither.
+				userOK := subtle.ConstantTimeCompare([]byte(gotUser), []byte(user))
+				passOK := subtle.ConstantTimeCompare([]byte(gotPass), []byte(pass))
+				if userOK&passOK == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			} else if bearer := requestToken(r, false); bearer != "" {
+				for _, token := range tokens {
+					if token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="interview-relay", charset="UTF-8"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "unauthorized")
+		})
+	}
+}
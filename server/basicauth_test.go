@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseBasicAuth(t *testing.T) {
+	if user, pass, err := parseBasicAuth("admin:pa:ss"); err != nil || user != "admin" || pass != "pa:ss" {
+		t.Errorf("parseBasicAuth = %q, %q, %v; want admin, pa:ss", user, pass, err)
+	}
+	for _, raw := range []string{"admin", "admin:", ":pass"} {
+		if _, _, err := parseBasicAuth(raw); err == nil {
+			t.Errorf("parseBasicAuth(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := skipPaths(basicAuth("admin", "s3cret", "api-token"), "/api/healthz")(ok)
+
+	for _, tc := range []struct {
+		name  string
+		path  string
+		setup func(*http.Request)
+		want  int
+	}{
+		{"no credentials", "/", func(*http.Request) {}, http.StatusUnauthorized},
+		{"uploads without credentials", "/uploads/shot.png", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", "/", func(r *http.Request) { r.SetBasicAuth("admin", "nope") }, http.StatusUnauthorized},
+		{"wrong user", "/", func(r *http.Request) { r.SetBasicAuth("root", "s3cret") }, http.StatusUnauthorized},
+		{"credentials", "/", func(r *http.Request) { r.SetBasicAuth("admin", "s3cret") }, http.StatusOK},
+		{"api with credentials", "/api/latest", func(r *http.Request) { r.SetBasicAuth("admin", "s3cret") }, http.StatusOK},
+		{"bearer token", "/api/feedback", func(r *http.Request) { r.Header.Set("Authorization", "Bearer api-token") }, http.StatusOK},
+		{"wrong bearer", "/api/feedback", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusUnauthorized},
+		{"healthz", "/api/healthz", func(*http.Request) {}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		tc.setup(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: GET %s = %d, want %d", tc.name, tc.path, rec.Code, tc.want)
+		}
+		if challenge := rec.Header().Get("WWW-Authenticate"); (rec.Code == http.StatusUnauthorized) != (challenge != "") {
+			t.Errorf("%s: WWW-Authenticate = %q with status %d", tc.name, challenge, rec.Code)
+		}
+	}
+}
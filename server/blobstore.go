@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore holds upload bytes. Names are paths under the uploads directory,
+// spelled as the rest of the package spells them (filepath.Join(dir,
+// filename)); a store maps them to its own keys and to the URL viewers fetch.
+type BlobStore interface {
+	// Put stores data under name, replacing any existing blob, and returns
+	// the URL it is served from.
+	Put(name string, data []byte) (url string, err error)
+	// Open returns the blob for reading and serving; a missing name is
+	// reported with an error matching fs.ErrNotExist.
+	Open(name string) (http.File, error)
+	// Delete removes the blob. Deleting a missing name is not an error.
+	Delete(name string) error
+	// List returns the blobs directly in dir, and its subdirectories, for
+	// the UPLOAD_TTL/UPLOAD_MAX_BYTES cleanup.
+	List(dir string) ([]fs.DirEntry, error)
+}
+
+// blobMover is implemented by stores that can take a file already written
+// to local disk without it being read into memory, which the streaming
+// upload path uses. The temporary file is gone once Move succeeds.
+type blobMover interface {
+	Move(name, tmpPath string) error
+}
+
+// blobURLer is implemented by stores whose blobs viewers fetch from
+// somewhere other than the relay's /uploads/ path.
+type blobURLer interface {
+	URL(id string) string
+}
+
+// blobURL is the URL payloads carry for the upload id held in store.
+func blobURL(store BlobStore, id string) string {
+	if u, ok := store.(blobURLer); ok {
+		return u.URL(id)
+	}
+	return uploadURL(id)
+}
+
+// blobStatter is implemented by stores that can describe a blob more cheaply
+// than opening it.
+type blobStatter interface {
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// blobID is the upload id, as used in /uploads/ URLs, for a name under root.
+func blobID(root, name string) (string, error) {
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", &storageError{op: "name", err: fmt.Errorf("%s is outside %s", name, root)}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// fsBlobStore keeps uploads as files under root, the default.
+type fsBlobStore struct {
+	root string
+}
+
+func newFSBlobStore(root string) *fsBlobStore {
+	return &fsBlobStore{root: root}
+}
+
+func (s *fsBlobStore) Put(name string, data []byte) (string, error) {
+	id, err := blobID(s.root, name)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", &storageError{op: "mkdir", err: err}
+	}
+	if err := ensureSpace(dir, int64(len(data))); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		// Don't leave a truncated file behind when the disk filled up.
+		_ = os.Remove(name)
+		return "", &storageError{op: "write", err: err}
+	}
+	return uploadURL(id), nil
+}
+
+func (s *fsBlobStore) Move(name, tmpPath string) error {
+	if err := os.Rename(tmpPath, name); err != nil {
+		return &storageError{op: "rename", err: err}
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Open(name string) (http.File, error) {
+	return os.Open(name)
+}
+
+func (s *fsBlobStore) Delete(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) List(dir string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+// memBlobStore keeps uploads in memory. Nothing survives a restart, so it
+// suits tests and throwaway relays.
+type memBlobStore struct {
+	root string
+
+	mu    sync.Mutex
+	blobs map[string]memBlob
+}
+
+type memBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemBlobStore(root string) *memBlobStore {
+	return &memBlobStore{root: root, blobs: make(map[string]memBlob)}
+}
+
+func (s *memBlobStore) Put(name string, data []byte) (string, error) {
+	id, err := blobID(s.root, name)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[filepath.Clean(name)] = memBlob{data: bytes.Clone(data), modTime: time.Now()}
+	return uploadURL(id), nil
+}
+
+func (s *memBlobStore) Open(name string) (http.File, error) {
+	s.mu.Lock()
+	blob, ok := s.blobs[filepath.Clean(name)]
+	s.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return newMemFile(filepath.Base(name), blob.data, blob.modTime), nil
+}
+
+func (s *memBlobStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, filepath.Clean(name))
+	return nil
+}
+
+func (s *memBlobStore) List(dir string) ([]fs.DirEntry, error) {
+	dir = filepath.Clean(dir)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []fs.DirEntry
+	subdirs := make(map[string]bool)
+	for name, blob := range s.blobs {
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if first, _, nested := strings.Cut(rel, string(filepath.Separator)); nested {
+			subdirs[first] = true
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(blobInfo{name: rel, size: int64(len(blob.data)), modTime: blob.modTime}))
+	}
+	for name := range subdirs {
+		entries = append(entries, fs.FileInfoToDirEntry(blobInfo{name: name, dir: true}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// memFile adapts bytes held in memory to http.File so http.FileServer can
+// serve them, Range requests included.
+type memFile struct {
+	*bytes.Reader
+	info blobInfo
+}
+
+func newMemFile(name string, data []byte, modTime time.Time) *memFile {
+	return &memFile{Reader: bytes.NewReader(data), info: blobInfo{name: name, size: int64(len(data)), modTime: modTime}}
+}
+
+func (f *memFile) Close() error                       { return nil }
+func (f *memFile) Stat() (fs.FileInfo, error)         { return f.info, nil }
+func (f *memFile) Readdir(int) ([]fs.FileInfo, error) { return nil, errors.New("not a directory") }
+
+// blobInfo describes a blob, or a directory of them, for stores that are not
+// backed by files.
+type blobInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i blobInfo) Name() string       { return i.name }
+func (i blobInfo) Size() int64        { return i.size }
+func (i blobInfo) ModTime() time.Time { return i.modTime }
+func (i blobInfo) IsDir() bool        { return i.dir }
+func (i blobInfo) Sys() any           { return nil }
+
+func (i blobInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// blobFileSystem serves a store's uploads to http.FileServer, mapping the
+// request path (an upload id) back to a name under root.
+type blobFileSystem struct {
+	store BlobStore
+	root  string
+}
+
+func (b blobFileSystem) Open(name string) (http.File, error) {
+	return b.store.Open(filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+name))))
+}
+
+// statBlob reports a blob's size and modification time without reading it.
+func statBlob(store BlobStore, name string) (fs.FileInfo, error) {
+	if statter, ok := store.(blobStatter); ok {
+		return statter.Stat(name)
+	}
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// readBlob returns a blob's contents.
+func readBlob(store BlobStore, name string) ([]byte, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pngDataURL(img []byte) string {
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(img)
+}
+
+func TestPersistScreenshotMemStore(t *testing.T) {
+	root := t.TempDir()
+	store := newMemBlobStore(root)
+	dir := filepath.Join(root, "team")
+	index := newUploadIndex()
+	img := testPNG(t, 40, 30)
+
+	upload, err := persistScreenshot(store, dir, pngDataURL(img), index, screenshotOptions{thumbnailSize: 16})
+	if err != nil {
+		t.Fatalf("persistScreenshot: %v", err)
+	}
+	if upload.width != 40 || upload.height != 30 {
+		t.Errorf("dimensions = %dx%d, want 40x30", upload.width, upload.height)
+	}
+	data, err := readBlob(store, filepath.Join(dir, upload.filename))
+	if err != nil || string(data) != string(img) {
+		t.Fatalf("stored blob = %d bytes, %v; want the uploaded image", len(data), err)
+	}
+	if upload.thumbnail == "" {
+		t.Error("no thumbnail was written")
+	} else if _, err := statBlob(store, filepath.Join(dir, upload.thumbnail)); err != nil {
+		t.Errorf("thumbnail: %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("memory store wrote %d entries to disk", len(entries))
+	}
+
+	again, err := persistScreenshot(store, dir, pngDataURL(img), index, screenshotOptions{thumbnailSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.filename != upload.filename {
+		t.Errorf("duplicate stored as %s, want reuse of %s", again.filename, upload.filename)
+	}
+
+	if err := store.Delete(filepath.Join(dir, upload.filename)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(filepath.Join(dir, upload.filename)); !os.IsNotExist(err) {
+		t.Errorf("Open after Delete = %v, want not exist", err)
+	}
+}
+
+func TestUploadsServedFromBlobStore(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.blobs = newMemBlobStore(reg.uploadDir)
+	rm, _ := reg.get("team")
+	img := testPNG(t, 8, 8)
+	upload, err := persistScreenshot(reg.blobs, rm.uploadDir, pngDataURL(img), reg.uploads, screenshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleListUploads(reg)(rec, httptest.NewRequest(http.MethodGet, "/api/uploads?room=team", nil))
+	var listed struct{ Uploads []uploadInfo }
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Uploads) != 1 || listed.Uploads[0].Name != upload.filename || listed.Uploads[0].SizeBytes != int64(len(img)) {
+		t.Errorf("listed %+v, want just %s (%d bytes)", listed.Uploads, upload.filename, len(img))
+	}
+
+	files := http.StripPrefix("/uploads/", http.FileServer(blobFileSystem{reg.blobs, reg.uploadDir}))
+	rec = httptest.NewRecorder()
+	files.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/"+rm.uploadID(upload.filename), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != string(img) {
+		t.Errorf("GET upload = %d with %d bytes, want 200 with the image", rec.Code, rec.Body.Len())
+	}
+}
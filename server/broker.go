@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message is a single broadcast. Stored feedback carries its sequence number
+// as id; transient messages such as controls leave it zero. kind is the
+// message type viewers may filter on (see messageTypes).
+type message struct {
+	id     uint64
+	kind   string
+	silent bool // stored payload that must not reach viewers
+	data   []byte
+}
+
+// messageTypes are the kinds a viewer can ask for with ?types=.
+var messageTypes = map[string]bool{
+	"feedback":  true,
+	"audio":     true,
+	"control":   true,
+	"clear":     true,
+	"presence":  true,
+	"update":    true,
+	"uploading": true,
+}
+
+// typeFilter is the set of message kinds a client wants; nil means all.
+type typeFilter map[string]bool
+
+// parseTypeFilter reads ?types=feedback,clear. Unknown names are logged and
+// ignored; a list with no known names delivers nothing rather than everything.
+func parseTypeFilter(r *http.Request) typeFilter {
+	raw := r.URL.Query().Get("types")
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	filter := make(typeFilter)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !messageTypes[name] {
+			log.Printf("ignoring unknown stream type %q", name)
+			continue
+		}
+		filter[name] = true
+	}
+	return filter
+}
+
+// allows reports whether msg should be delivered. Silent payloads never
+// are, whatever the filter, so replays and backfills skip them too.
+func (f typeFilter) allows(msg message) bool {
+	return !msg.silent && (f == nil || f[msg.kind])
+}
+
+// presenceOnly reports whether the filter selects nothing but presence
+// updates, as a capture client watching for viewers does.
+func (f typeFilter) presenceOnly() bool {
+	return len(f) == 1 && f["presence"]
+}
+
+// maxReliablePending bounds the messages queued for a reliable client whose
+// buffer is full; one that falls further behind is disconnected.
+const maxReliablePending = 1024
+
+// client is one subscriber. Lossy clients (the default) drop messages when
+// their buffer is full. Reliable clients queue them instead, and their own
+// pump goroutine waits up to the broker's reliableWait for each one,
+// disconnecting the client if it still cannot keep up; the broadcaster never
+// waits on them.
+type client struct {
+	id       string // request id, for logs
+	ch       chan message
+	reliable bool
+	observer bool // not counted as a viewer in presence updates
+
+	// done is closed as soon as the client is removed, cutting short a
+	// reliable send that is waiting on it.
+	done chan struct{}
+
+	// mu serialises sends on ch with closing it, so a fan-out running
+	// outside the broker's lock never sends on a closed channel.
+	mu     sync.Mutex
+	closed bool
+	drops  int // consecutive messages dropped
+
+	// queueMu guards a reliable client's backlog. It is taken before mu,
+	// never while holding it.
+	queueMu sync.Mutex
+	pending []message
+	pumping bool // a pump goroutine is draining pending
+}
+
+func newClient(buffer int, reliable bool) *client {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &client{ch: make(chan message, buffer), done: make(chan struct{}), reliable: reliable}
+}
+
+// close closes done and then ch; later sends become no-ops. The broker calls
+// it exactly once, after unregistering the client.
+func (c *client) close() {
+	close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	close(c.ch)
+}
+
+type broker struct {
+	mu           sync.Mutex
+	clients      map[*client]struct{}
+	sendMu       sync.Mutex // serialises fan-outs so every client sees messages in order
+	reliableWait time.Duration
+	maxClients   int // 0 means unlimited
+	maxDrops     int // evict a lossy client after this many consecutive drops; 0 never does
+
+	// presenceDelay debounces {"type":"presence"} broadcasts: viewer count
+	// changes are announced once things have been quiet that long. Zero
+	// disables presence updates.
+	presenceDelay time.Duration
+	presenceTimer *time.Timer
+	announced     int
+}
+
+func newBroker() *broker {
+	return &broker{
+		clients:      make(map[*client]struct{}),
+		reliableWait: 2 * time.Second,
+	}
+}
+
+// addClient registers c, reporting false without registering it when the
+// broker already holds maxClients subscribers.
+func (b *broker) addClient(c *client) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxClients > 0 && len(b.clients) >= b.maxClients {
+		rejectedClients.Inc()
+		return false
+	}
+	b.clients[c] = struct{}{}
+	sseClients.Inc()
+	b.presenceChangedLocked()
+	return true
+}
+
+// removeClient unregisters c and closes its channel. It is safe to call for a
+// client the broker already dropped, and concurrently with a broadcast: the
+// channel is closed outside mu, once any send in progress has given up.
+func (b *broker) removeClient(c *client) {
+	b.mu.Lock()
+	_, ok := b.clients[c]
+	if ok {
+		delete(b.clients, c)
+		sseClients.Dec()
+		b.presenceChangedLocked()
+	}
+	b.mu.Unlock()
+	if ok {
+		c.close()
+	}
+}
+
+func (b *broker) clientCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.clients)
+}
+
+// viewerCount is the number of connected viewers, not counting observers.
+func (b *broker) viewerCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.viewerCountLocked()
+}
+
+// viewerCountLocked counts clients that are watching, leaving out observers.
+func (b *broker) viewerCountLocked() int {
+	n := 0
+	for c := range b.clients {
+		if !c.observer {
+			n++
+		}
+	}
+	return n
+}
+
+// presenceChangedLocked (re)starts the debounce timer, so a burst of
+// connects and disconnects yields a single presence update.
+func (b *broker) presenceChangedLocked() {
+	if b.presenceDelay <= 0 {
+		return
+	}
+	if b.presenceTimer != nil {
+		b.presenceTimer.Reset(b.presenceDelay)
+		return
+	}
+	b.presenceTimer = time.AfterFunc(b.presenceDelay, b.announcePresence)
+}
+
+func (b *broker) announcePresence() {
+	b.mu.Lock()
+	b.presenceTimer = nil
+	viewers := b.viewerCountLocked()
+	if viewers == b.announced {
+		b.mu.Unlock()
+		return
+	}
+	b.announced = viewers
+	b.mu.Unlock()
+	b.broadcast(message{kind: "presence", data: []byte(fmt.Sprintf(`{"type":"presence","viewers":%d}`, viewers))})
+}
+
+// broadcast delivers msg to every client. The client set is copied under
+// mu and the sends happen outside it, so subscribers can connect or leave
+// meanwhile; a client removed after the copy is skipped by deliver. No send
+// blocks, so callers such as feedback posts return promptly however slow a
+// viewer is.
+func (b *broker) broadcast(msg message) {
+	b.mu.Lock()
+	targets := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		targets = append(targets, c)
+	}
+	b.mu.Unlock()
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+	for _, c := range targets {
+		if !b.deliver(c, msg) {
+			b.removeClient(c)
+		}
+	}
+}
+
+// deliver sends msg to c, or queues it for a reliable client, reporting
+// false when c should be disconnected. It never blocks.
+func (b *broker) deliver(c *client, msg message) bool {
+	if c.reliable {
+		return b.enqueue(c, msg)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	select {
+	case c.ch <- msg:
+		c.drops = 0
+		return true
+	default:
+	}
+
+	// drop instead of blocking slow clients
+	droppedMessages.Inc()
+	c.drops++
+	if b.maxDrops > 0 && c.drops > b.maxDrops {
+		// A client that never drains only holds a slot; closing it
+		// makes a live one reconnect and replay what it missed.
+		evictedClients.Inc()
+		log.Printf("stream client %s dropped %d messages in a row; evicting", c.id, c.drops)
+		return false
+	}
+	log.Printf("dropped message for slow stream client %s (buffer %d)", c.id, cap(c.ch))
+	return true
+}
+
+// enqueue hands msg to a reliable client: straight into its buffer when
+// nothing is queued ahead of it, otherwise onto its backlog, starting a
+// pump to drain it.
+func (b *broker) enqueue(c *client, msg message) bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if !c.pumping {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return true
+		}
+		select {
+		case c.ch <- msg:
+			c.mu.Unlock()
+			return true
+		default:
+		}
+		c.mu.Unlock()
+	}
+	if len(c.pending) >= maxReliablePending {
+		droppedMessages.Inc()
+		log.Printf("reliable stream client %s has %d messages queued; disconnecting", c.id, len(c.pending))
+		return false
+	}
+	c.pending = append(c.pending, msg)
+	if !c.pumping {
+		c.pumping = true
+		go b.pump(c)
+	}
+	return true
+}
+
+// pump feeds a reliable client's backlog into its buffer in order, waiting
+// up to reliableWait for each message, and exits once the backlog is empty.
+func (b *broker) pump(c *client) {
+	for {
+		c.queueMu.Lock()
+		if len(c.pending) == 0 {
+			c.pending = nil
+			c.pumping = false
+			c.queueMu.Unlock()
+			return
+		}
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		c.queueMu.Unlock()
+
+		if !b.sendReliable(c, msg) {
+			b.removeClient(c)
+		}
+	}
+}
+
+// sendReliable waits for room in c's buffer, reporting false when c fell
+// reliableWait behind. A closed client takes, and discards, anything.
+func (b *broker) sendReliable(c *client, msg message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	timer := time.NewTimer(b.reliableWait)
+	defer timer.Stop()
+	select {
+	case c.ch <- msg:
+		return true
+	case <-c.done:
+		return true
+	case <-timer.C:
+		droppedMessages.Inc()
+		log.Printf("reliable stream client %s fell %s behind; disconnecting", c.id, b.reliableWait)
+		return false
+	}
+}
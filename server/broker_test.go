@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain reads c until it is closed, returning what it received.
+func drain(c *client) <-chan []message {
+	out := make(chan []message, 1)
+	go func() {
+		var got []message
+		for msg := range c.ch {
+			got = append(got, msg)
+		}
+		out <- got
+	}()
+	return out
+}
+
+func TestBroadcastNotHeldUpByStuckClient(t *testing.T) {
+	const viewers, messages = 50, 20
+	b := newBroker()
+	b.reliableWait = 2 * time.Second
+
+	stuck := newClient(1, true)
+	b.addClient(stuck)
+	var received []<-chan []message
+	var live []*client
+	for i := 0; i < viewers; i++ {
+		c := newClient(messages, i%2 == 0)
+		b.addClient(c)
+		live = append(live, c)
+		received = append(received, drain(c))
+	}
+
+	start := time.Now()
+	for i := 1; i <= messages; i++ {
+		b.broadcast(message{id: uint64(i), kind: "feedback", data: []byte(fmt.Sprint(i))})
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("%d broadcasts took %s with a stuck client connected", messages, elapsed)
+	}
+
+	for _, c := range live {
+		b.removeClient(c)
+	}
+	for i, ch := range received {
+		got := <-ch
+		if len(got) != messages {
+			t.Errorf("viewer %d got %d messages, want %d", i, len(got), messages)
+			continue
+		}
+		for j, msg := range got {
+			if msg.id != uint64(j+1) {
+				t.Errorf("viewer %d got message %d at position %d", i, msg.id, j+1)
+				break
+			}
+		}
+	}
+	b.removeClient(stuck)
+}
+
+func TestStuckReliableClientIsDisconnected(t *testing.T) {
+	b := newBroker()
+	b.reliableWait = 20 * time.Millisecond
+	stuck := newClient(1, true)
+	b.addClient(stuck)
+
+	for i := 1; i <= 3; i++ {
+		b.broadcast(message{id: uint64(i), kind: "feedback"})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.clientCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stuck reliable client was never disconnected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if msg := <-stuck.ch; msg.id != 1 {
+		t.Errorf("buffered message = %d, want 1", msg.id)
+	}
+	if _, open := <-stuck.ch; open {
+		t.Error("stuck client's channel is still open")
+	}
+}
+
+func TestReliableClientGetsBacklogInOrder(t *testing.T) {
+	const messages = 200
+	b := newBroker()
+	slow := newClient(1, true)
+	b.addClient(slow)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var got []uint64
+	go func() {
+		defer wg.Done()
+		for msg := range slow.ch {
+			got = append(got, msg.id)
+			time.Sleep(100 * time.Microsecond)
+			if len(got) == messages {
+				return
+			}
+		}
+	}()
+	for i := 1; i <= messages; i++ {
+		b.broadcast(message{id: uint64(i), kind: "feedback"})
+	}
+	wg.Wait()
+	b.removeClient(slow)
+	for i, id := range got {
+		if id != uint64(i+1) {
+			t.Fatalf("message %d arrived at position %d", id, i+1)
+		}
+	}
+}
+
+func TestBrokerEvictsNeverDrainingClient(t *testing.T) {
+	b := newBroker()
+	b.maxDrops = 3
+
+	stuck := newClient(1, false)
+	b.addClient(stuck)
+	// slow drains a message before every other broadcast, so its buffer is
+	// full half the time and it never drops twice in a row.
+	slow := newClient(1, false)
+	b.addClient(slow)
+
+	for i := 1; i <= 10; i++ {
+		if i > 1 && i%2 == 1 {
+			<-slow.ch
+		}
+		b.broadcast(message{id: uint64(i), kind: "feedback", data: []byte(fmt.Sprint(i))})
+		evicted := false
+		select {
+		case <-stuck.done:
+			evicted = true
+		default:
+		}
+		// The first message fills the buffer; eviction comes on the drop
+		// after maxDrops consecutive ones.
+		if want := i > 1+b.maxDrops; evicted != want {
+			t.Fatalf("after message %d: stuck client evicted = %v, want %v", i, evicted, want)
+		}
+	}
+
+	select {
+	case <-slow.done:
+		t.Error("a client that keeps draining was evicted")
+	default:
+	}
+	if got := b.viewerCount(); got != 1 {
+		t.Errorf("viewerCount = %d after eviction, want 1", got)
+	}
+	// The evicted client's stream ends once it reads what it had buffered.
+	if got := <-drain(stuck); len(got) != 1 || got[0].id != 1 {
+		t.Errorf("evicted client received %v, want just message 1", got)
+	}
+}
+
+// TestBrokerConcurrentChurn is meant for go test -race: clients connect and
+// leave while several goroutines broadcast, which must neither race nor send
+// on a closed channel.
+func TestBrokerConcurrentChurn(t *testing.T) {
+	b := newBroker()
+	b.maxDrops = 2
+	b.reliableWait = 10 * time.Millisecond
+	b.presenceDelay = time.Millisecond
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var seq sync.Mutex
+	next := uint64(0)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Take the id and broadcast together so ids go out in order.
+				seq.Lock()
+				next++
+				b.broadcast(message{id: next, kind: "feedback", data: []byte("x")})
+				seq.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c := newClient(2, (i+j)%2 == 0)
+				b.addClient(c)
+				got := drain(c)
+				time.Sleep(time.Duration(j%3) * time.Millisecond)
+				b.removeClient(c)
+				b.removeClient(c) // removing twice is harmless
+				var last uint64
+				for _, msg := range <-got {
+					if msg.kind == "feedback" && msg.id <= last {
+						t.Errorf("client saw id %d after %d", msg.id, last)
+					}
+					if msg.kind == "feedback" {
+						last = msg.id
+					}
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if n := b.clientCount(); n != 0 {
+		t.Errorf("%d clients left registered", n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uploadCachePolicy picks the Cache-Control max-age for a file under
+// /uploads/ by extension. Upload names are generated and never reused, so
+// every response is also marked immutable.
+type uploadCachePolicy struct {
+	defaultMaxAge int
+	byExt         map[string]int // extension without the dot
+}
+
+// uploadTypeGroups lets UPLOAD_CACHE_MAX_AGES name whole kinds of upload.
+var uploadTypeGroups = map[string][]string{
+	"image": {"png", "jpg", "jpeg"},
+	"audio": {"webm", "mp3", "wav"},
+}
+
+// parseUploadCachePolicy reads entries like "image=31536000,audio=600,wav=60".
+// Keys are extensions or the groups in uploadTypeGroups; an extension entry
+// wins over its group whatever the order.
+func parseUploadCachePolicy(raw string, defaultMaxAge int) (uploadCachePolicy, error) {
+	policy := uploadCachePolicy{defaultMaxAge: defaultMaxAge, byExt: make(map[string]int)}
+	explicit := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || seconds < 0 {
+			return uploadCachePolicy{}, fmt.Errorf("invalid UPLOAD_CACHE_MAX_AGES entry %q: want name=seconds", entry)
+		}
+		key = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(key), "."))
+		if exts, isGroup := uploadTypeGroups[key]; isGroup {
+			for _, ext := range exts {
+				if !explicit[ext] {
+					policy.byExt[ext] = seconds
+				}
+			}
+			continue
+		}
+		policy.byExt[key] = seconds
+		explicit[key] = true
+	}
+	return policy, nil
+}
+
+func (p uploadCachePolicy) header(name string) string {
+	maxAge, ok := p.byExt[strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))]
+	if !ok {
+		maxAge = p.defaultMaxAge
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d, immutable", maxAge)
+}
+
+// cacheControlFileServer serves uploads from fsys with the policy's
+// Cache-Control.
+// It only adds a header and leaves the request to http.FileServer, which
+// answers HEAD with the real Content-Length and honours Range/If-Range with
+// 206 Partial Content so audio players can seek. Keep it that way: do not
+// buffer or rewrite the body here, and keep uploads out of compression.
+func cacheControlFileServer(fsys http.FileSystem, policy uploadCachePolicy) http.Handler {
+	fs := http.FileServer(filesOnly{fsys})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy.header(r.URL.Path))
+		fs.ServeHTTP(w, r)
+	})
+}
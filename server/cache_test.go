@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestUploadsHideDirectories(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "team"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	img := testPNG(t, 4, 4)
+	for _, name := range []string{"shot.png", "team/shot.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), img, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy, _ := parseUploadCachePolicy("", 3600)
+	handler := http.StripPrefix("/uploads/", cacheControlFileServer(http.Dir(dir), policy))
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/uploads/", http.StatusNotFound},
+		{"/uploads/team/", http.StatusNotFound},
+		{"/uploads/team", http.StatusNotFound},
+		{"/uploads/shot.png", http.StatusOK},
+		{"/uploads/team/shot.png", http.StatusOK},
+		{"/uploads/missing.png", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.path, rec.Code, tc.want)
+		}
+		if tc.want == http.StatusNotFound && rec.Body.Len() > 0 && string(rec.Body.Bytes()) != "404 page not found\n" {
+			t.Errorf("GET %s body = %q, want no listing", tc.path, rec.Body)
+		}
+	}
+}
+
+func TestUploadsRangeAndHead(t *testing.T) {
+	registerUploadTypes()
+	clip := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	s3, _ := newFakeS3Store(t)
+	dir := t.TempDir()
+	for _, store := range []BlobStore{newFSBlobStore(dir), newMemBlobStore(dir), s3} {
+		root := dir
+		if s3store, ok := store.(*s3BlobStore); ok {
+			root = s3store.root
+		}
+		t.Run(fmt.Sprintf("%T", store), func(t *testing.T) {
+			if _, err := store.Put(filepath.Join(root, "team", "clip.webm"), clip); err != nil {
+				t.Fatal(err)
+			}
+			policy, _ := parseUploadCachePolicy("", 3600)
+			handler := http.StripPrefix("/uploads/", cacheControlFileServer(blobFileSystem{store, root}, policy))
+
+			req := httptest.NewRequest(http.MethodGet, "/uploads/team/clip.webm", nil)
+			req.Header.Set("Range", "bytes=10-15")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusPartialContent || rec.Body.String() != "abcdef" {
+				t.Errorf("Range 10-15 = %d %q, want 206 abcdef", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Range"); got != fmt.Sprintf("bytes 10-15/%d", len(clip)) {
+				t.Errorf("Content-Range = %q", got)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "audio/webm" {
+				t.Errorf("Content-Type = %q, want audio/webm", got)
+			}
+
+			req = httptest.NewRequest(http.MethodHead, "/uploads/team/clip.webm", nil)
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+				t.Errorf("HEAD = %d with %d body bytes, want an empty 200", rec.Code, rec.Body.Len())
+			}
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(clip)) {
+				t.Errorf("HEAD Content-Length = %q, want %d", got, len(clip))
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("HEAD Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+}
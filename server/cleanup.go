@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runUploadCleanup deletes uploads (screenshots and audio) older than ttl,
+// then trims the oldest until the directory holds at most maxBytes, every
+// interval. A zero ttl or maxBytes skips that step. It never returns; start
+// it in its own goroutine.
+func runUploadCleanup(ctx context.Context, dir string, ttl time.Duration, maxBytes int64, interval time.Duration, rooms *roomRegistry) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if ttl > 0 {
+			removed := cleanupUploads(dir, ttl, rooms, now)
+			if removed > 0 {
+				log.Printf("upload cleanup removed %d file(s) older than %s", removed, ttl)
+			}
+		}
+		if maxBytes > 0 {
+			enforceUploadCap(dir, maxBytes, rooms)
+		}
+	}
+}
+
+// capCandidate is an upload that may be evicted to honour the size cap,
+// together with its thumbnail, which always goes with it.
+type capCandidate struct {
+	path     string
+	thumb    string
+	size     int64
+	lastUsed time.Time
+}
+
+// enforceUploadCap deletes the least recently used uploads across every room
+// until the total size is at most maxBytes. Files a room currently shows are
+// never removed, so the cap can be exceeded when they alone are too large.
+func enforceUploadCap(dir string, maxBytes int64, rooms *roomRegistry) int {
+	var candidates []capCandidate
+	var total int64
+
+	collect := func(roomDir, name string) {
+		entries, err := rooms.blobs.List(roomDir)
+		if err != nil {
+			return
+		}
+		keep := latestUploads(rooms, name)
+		sizes := make(map[string]int64, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && !entry.IsDir() {
+				sizes[entry.Name()] = info.Size()
+				total += info.Size()
+			}
+		}
+		for _, entry := range entries {
+			filename := entry.Name()
+			if _, ok := sizes[filename]; !ok || strings.HasPrefix(filename, ".") {
+				continue
+			}
+			if source, ok := thumbnailSource(filename); ok && sizes[source] > 0 {
+				continue
+			}
+			if _, ok := keep[filename]; ok {
+				continue
+			}
+			path := filepath.Join(roomDir, filename)
+			c := capCandidate{path: path, size: sizes[filename]}
+			if thumbSize, ok := sizes[thumbnailName(filename)]; ok {
+				c.thumb = filepath.Join(roomDir, thumbnailName(filename))
+				c.size += thumbSize
+			}
+			c.lastUsed, _ = uploadCreatedAt(entry)
+			if used, ok := rooms.uploads.lastUse(path); ok && used.After(c.lastUsed) {
+				c.lastUsed = used
+			}
+			candidates = append(candidates, c)
+		}
+	}
+
+	collect(dir, defaultRoom)
+	if entries, err := rooms.blobs.List(dir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() && roomNamePattern.MatchString(entry.Name()) {
+				collect(filepath.Join(dir, entry.Name()), entry.Name())
+			}
+		}
+	}
+	if total <= maxBytes {
+		return 0
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+	removed := 0
+	for _, c := range candidates {
+		if total <= maxBytes {
+			break
+		}
+		if err := rooms.blobs.Delete(c.path); err != nil {
+			log.Printf("upload cap: remove %s: %v", c.path, err)
+			continue
+		}
+		if c.thumb != "" {
+			_ = rooms.blobs.Delete(c.thumb)
+		}
+		rooms.uploads.forget(c.path)
+		total -= c.size
+		removed++
+		log.Printf("upload cap: evicted %s (%d bytes) to stay under %d bytes", c.path, c.size, maxBytes)
+	}
+	return removed
+}
+
+// cleanupUploads sweeps the default room's files in dir and every room
+// subdirectory below it, keeping whatever each room currently shows.
+func cleanupUploads(dir string, ttl time.Duration, rooms *roomRegistry, now time.Time) int {
+	removed := sweepUploadDir(rooms.blobs, dir, ttl, latestUploads(rooms, defaultRoom), rooms.uploads, now)
+
+	entries, err := rooms.blobs.List(dir)
+	if err != nil {
+		return removed
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !roomNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		name := entry.Name()
+		roomDir := filepath.Join(dir, name)
+		removed += sweepUploadDir(rooms.blobs, roomDir, ttl, latestUploads(rooms, name), rooms.uploads, now)
+		if rooms.lookup(name) == nil {
+			// Fails harmlessly while the directory still has files in it,
+			// and is a no-op for stores without real directories.
+			_ = rooms.blobs.Delete(roomDir)
+		}
+	}
+	return removed
+}
+
+// latestUploads returns the filenames, relative to the room's directory, that
+// the room's latest payload still references.
+func latestUploads(rooms *roomRegistry, name string) map[string]struct{} {
+	keep := make(map[string]struct{})
+	rm := rooms.lookup(name)
+	if rm == nil {
+		return keep
+	}
+	if latest, _ := rm.state.getLatest(); latest != nil {
+		for _, id := range latest.uploadIDs() {
+			keep[path.Base(id)] = struct{}{}
+		}
+	}
+	return keep
+}
+
+// sweepUploadDir removes expired files from dir. A deduplicated screenshot is
+// aged by its most recent reuse, not by when it was first written. Thumbnails
+// go together with their source; only orphaned ones are aged on their own.
+func sweepUploadDir(store BlobStore, dir string, ttl time.Duration, keep map[string]struct{}, index *uploadIndex, now time.Time) int {
+	entries, err := store.List(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("upload cleanup: read %s: %v", dir, err)
+		}
+		return 0
+	}
+
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.Name()] = true
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if _, ok := keep[entry.Name()]; ok || entry.IsDir() {
+			continue
+		}
+		if source, ok := thumbnailSource(entry.Name()); ok && present[source] {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		created, ok := uploadCreatedAt(entry)
+		if !ok || now.Sub(created) < ttl || index.usedSince(path, now.Add(-ttl)) {
+			continue
+		}
+		if err := store.Delete(path); err != nil {
+			log.Printf("upload cleanup: remove %s: %v", entry.Name(), err)
+			continue
+		}
+		index.forget(path)
+		removed++
+		if present[thumbnailName(entry.Name())] {
+			if err := store.Delete(filepath.Join(dir, thumbnailName(entry.Name()))); err == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// uploadCreatedAt prefers the unix-milli prefix persistScreenshot puts in
+// every filename and falls back to the file's modification time.
+func uploadCreatedAt(entry os.DirEntry) (time.Time, bool) {
+	if prefix, _, found := strings.Cut(entry.Name(), "-"); found {
+		if ms, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			return time.UnixMilli(ms), true
+		}
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestControlPayload(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    string
+		wantErr string // empty means the request is accepted
+		want    map[string]float64
+	}{
+		{"scroll", `{"action":"scroll","delta":120}`, "", map[string]float64{"delta": 120}},
+		{"scroll clamped up", `{"action":"scroll","delta":99999}`, "", map[string]float64{"delta": 2000}},
+		{"scroll clamped down", `{"action":"scroll","delta":-99999}`, "", map[string]float64{"delta": -2000}},
+		{"scroll without delta", `{"action":"scroll"}`, "delta is required", nil},
+
+		{"highlight", `{"action":"highlight","x":10,"y":20,"width":300,"height":40}`, "", map[string]float64{"x": 10, "y": 20, "width": 300, "height": 40}},
+		{"highlight at bounds", `{"action":"highlight","x":0,"y":0,"width":10000,"height":10000}`, "", map[string]float64{"x": 0, "y": 0, "width": 10000, "height": 10000}},
+		{"highlight without height", `{"action":"highlight","x":10,"y":20,"width":300}`, "height is required", nil},
+		{"highlight negative", `{"action":"highlight","x":-1,"y":20,"width":300,"height":40}`, "x must be between 0 and 10000", nil},
+		{"highlight too wide", `{"action":"highlight","x":1,"y":20,"width":10001,"height":40}`, "width must be between 0 and 10000", nil},
+
+		{"cursor", `{"action":"cursor","x":5,"y":6}`, "", map[string]float64{"x": 5, "y": 6}},
+		{"cursor ignores size", `{"action":"cursor","x":5,"y":6,"width":99999}`, "", map[string]float64{"x": 5, "y": 6}},
+		{"cursor without y", `{"action":"cursor","x":5}`, "y is required", nil},
+		{"cursor out of range", `{"action":"cursor","x":5,"y":10001}`, "y must be between 0 and 10000", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var body controlRequest
+			if err := json.Unmarshal([]byte(tc.body), &body); err != nil {
+				t.Fatal(err)
+			}
+			payload, err := controlPayload(body)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("err = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("controlPayload: %v", err)
+			}
+			if payload["type"] != "control" || payload["action"] != body.Action || payload["timestamp"] == nil {
+				t.Errorf("payload = %v, want type, action and timestamp", payload)
+			}
+			for _, key := range []string{"delta", "x", "y", "width", "height"} {
+				want, wanted := tc.want[key]
+				got, present := payload[key]
+				if wanted != present {
+					t.Errorf("%s present = %v, want %v", key, present, wanted)
+				} else if wanted && float64(got.(int)) != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestControlPayloadUnknownAction(t *testing.T) {
+	for _, action := range []string{"", "zoom", "Scroll"} {
+		if _, err := controlPayload(controlRequest{Action: action, Delta: 1}); !errors.Is(err, errUnsupportedAction) {
+			t.Errorf("action %q: err = %v, want errUnsupportedAction", action, err)
+		}
+	}
+}
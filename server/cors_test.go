@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	t.Setenv("CLIENT_ORIGIN", "https://viewer.example")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	preflight := func(maxAge int, requested string) http.Header {
+		req := httptest.NewRequest(http.MethodOptions, "/api/feedback", nil)
+		req.Header.Set("Origin", "https://viewer.example")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		if requested != "" {
+			req.Header.Set("Access-Control-Request-Headers", requested)
+		}
+		rec := httptest.NewRecorder()
+		corsMiddleware(maxAge)(ok).ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("preflight = %d, want 204", rec.Code)
+		}
+		return rec.Header()
+	}
+
+	h := preflight(600, "content-type, x-capture-id")
+	if got := h.Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want 600", got)
+	}
+	if got := h.Get("Access-Control-Allow-Headers"); got != "content-type, x-capture-id" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want the requested headers", got)
+	}
+	if got := h.Values("Vary"); len(got) != 2 || got[0] != "Origin" || got[1] != "Access-Control-Request-Headers" {
+		t.Errorf("Vary = %q", got)
+	}
+
+	h = preflight(0, "")
+	if got := h.Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("Access-Control-Max-Age = %q with CORS_MAX_AGE=0, want none", got)
+	}
+	if got := h.Get("Access-Control-Allow-Headers"); got != "Content-Type, Authorization" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want the default list", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/latest", nil)
+	req.Header.Set("Origin", "https://viewer.example")
+	rec := httptest.NewRecorder()
+	corsMiddleware(600)(ok).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("simple request got Access-Control-Max-Age %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://viewer.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+}
+
+func TestMatchOrigin(t *testing.T) {
+	allowed := parseOrigins(" https://desk.example/, https://phone.example ,,")
+	for _, tc := range []struct {
+		origin string
+		want   string
+		ok     bool
+	}{
+		{"https://desk.example", "https://desk.example", true},
+		{"https://phone.example", "https://phone.example", true},
+		{"HTTPS://Phone.Example", "HTTPS://Phone.Example", true},
+		{"https://evil.example", "", false},
+		{"https://desk.example.evil", "", false},
+		{"", "", false},
+	} {
+		got, ok := matchOrigin(allowed, tc.origin)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("matchOrigin(%q) = %q, %v; want %q, %v", tc.origin, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	for _, raw := range []string{"", "*", " , "} {
+		if got, ok := matchOrigin(parseOrigins(raw), "https://any.example"); got != "*" || !ok {
+			t.Errorf("CLIENT_ORIGIN=%q: matchOrigin = %q, %v; want *, true", raw, got, ok)
+		}
+	}
+}
+
+func TestCORSAllowlistHeaders(t *testing.T) {
+	t.Setenv("CLIENT_ORIGIN", "https://desk.example,https://phone.example")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	get := func(origin string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/api/latest", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		corsMiddleware(0)(ok).ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	h := get("https://phone.example")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "https://phone.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the phone origin", got)
+	}
+	if got := h.Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := h.Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+
+	h = get("https://evil.example")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+	if got := h.Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q for a disallowed origin, want Origin", got)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver; pure Go, no cgo
+)
+
+// feedbackDB mirrors every room's history into SQLite (DB_PATH), so history
+// outlives restarts and the in-memory ring, and /api/history can filter and
+// page in SQL.
+type feedbackDB struct {
+	db *sql.DB
+}
+
+// feedbackMigrations are applied in order on open; PRAGMA user_version
+// records how many have run. Append new steps, never edit old ones.
+var feedbackMigrations = []string{
+	`CREATE TABLE feedback (
+		room      TEXT    NOT NULL,
+		seq       INTEGER NOT NULL,
+		id        TEXT    NOT NULL,
+		timestamp TEXT    NOT NULL,
+		ts_ns     INTEGER,           -- parsed timestamp; NULL when it does not parse
+		mode      TEXT    NOT NULL DEFAULT '',
+		payload   TEXT    NOT NULL,  -- the payload JSON as broadcast
+		PRIMARY KEY (room, seq)
+	);
+	CREATE INDEX feedback_room_ts ON feedback (room, ts_ns);`,
+	`CREATE TABLE rooms (
+		room       TEXT    PRIMARY KEY,
+		code       TEXT    NOT NULL DEFAULT '', -- viewer join code; '' is open
+		latest_seq INTEGER NOT NULL DEFAULT 0   -- 0 when latest was cleared
+	);
+	INSERT INTO rooms (room, latest_seq) SELECT room, MAX(seq) FROM feedback GROUP BY room;`,
+	`ALTER TABLE feedback ADD COLUMN edit_seq INTEGER NOT NULL DEFAULT 0; -- sequence of the latest edit`,
+}
+
+func openFeedbackDB(path string) (*feedbackDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection serialises writers, which SQLite would otherwise
+	// answer with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	d := &feedbackDB{db: db}
+	if err := d.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *feedbackDB) migrate() error {
+	var version int
+	if err := d.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(feedbackMigrations) {
+		return fmt.Errorf("database schema version %d is newer than this relay understands (%d)", version, len(feedbackMigrations))
+	}
+	for i := version; i < len(feedbackMigrations); i++ {
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(feedbackMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA takes no bind parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (d *feedbackDB) close() error {
+	return d.db.Close()
+}
+
+// store inserts entries for room, replacing any already stored under the
+// same sequence (a payload edited, or rewritten when its screenshot
+// expired).
+func (d *feedbackDB) store(room string, entries []historyEntry) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after Commit
+	for _, e := range entries {
+		var tsNS sql.NullInt64
+		if ts, err := time.Parse(time.RFC3339, e.payload.Timestamp); err == nil {
+			tsNS = sql.NullInt64{Int64: ts.UnixNano(), Valid: true}
+		}
+		_, err := tx.Exec(`INSERT INTO feedback (room, seq, id, timestamp, ts_ns, mode, payload, edit_seq)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (room, seq) DO UPDATE SET
+				id = excluded.id, timestamp = excluded.timestamp, ts_ns = excluded.ts_ns,
+				mode = excluded.mode, payload = excluded.payload, edit_seq = excluded.edit_seq`,
+			room, e.seq, e.payload.ID, e.payload.Timestamp, tsNS, historyMode(e.payload), string(e.bytes), e.editSeq)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveCode records room's join code, so a protected room stays protected
+// after a restart or after reapIdle drops it.
+func (d *feedbackDB) saveCode(room, code string) error {
+	_, err := d.db.Exec(`INSERT INTO rooms (room, code) VALUES (?, ?)
+		ON CONFLICT (room) DO UPDATE SET code = excluded.code`, room, code)
+	return err
+}
+
+// saveLatest records which sequence is room's latest payload; 0 means it
+// was cleared.
+func (d *feedbackDB) saveLatest(room string, seq uint64) error {
+	_, err := d.db.Exec(`INSERT INTO rooms (room, latest_seq) VALUES (?, ?)
+		ON CONFLICT (room) DO UPDATE SET latest_seq = excluded.latest_seq`, room, seq)
+	return err
+}
+
+// roomCode returns room's saved join code, or "" for an open or unknown
+// room.
+func (d *feedbackDB) roomCode(room string) (string, error) {
+	var code string
+	err := d.db.QueryRow(`SELECT code FROM rooms WHERE room = ?`, room).Scan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return code, err
+}
+
+// snapshot returns room's newest n entries, join code and latest sequence in
+// the form state.restore takes, so a room picks up where it left off.
+func (d *feedbackDB) snapshot(room string, n int) (roomSnapshot, error) {
+	// The pool has one connection, so this must finish before rows opens.
+	var snap roomSnapshot
+	err := d.db.QueryRow(`SELECT code, latest_seq FROM rooms WHERE room = ?`, room).Scan(&snap.Code, &snap.LatestSeq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return roomSnapshot{}, err
+	}
+	// Edits take sequence numbers too, and may be newer than any payload.
+	err = d.db.QueryRow(`SELECT COALESCE(MAX(MAX(seq, edit_seq)), 0) FROM feedback WHERE room = ?`, room).Scan(&snap.Seq)
+	if err != nil {
+		return roomSnapshot{}, err
+	}
+
+	rows, err := d.db.Query(`SELECT seq, edit_seq, payload FROM feedback WHERE room = ? ORDER BY seq DESC LIMIT ?`, room, n)
+	if err != nil {
+		return roomSnapshot{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry snapshotEntry
+		var raw string
+		if err := rows.Scan(&entry.Seq, &entry.EditSeq, &raw); err != nil {
+			return roomSnapshot{}, err
+		}
+		if err := json.Unmarshal([]byte(raw), &entry.Payload); err != nil {
+			return roomSnapshot{}, fmt.Errorf("seq %d: %w", entry.Seq, err)
+		}
+		snap.History = append(snap.History, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return roomSnapshot{}, err
+	}
+	slices.Reverse(snap.History) // restore wants oldest first
+	return snap, nil
+}
+
+// amend applies edit to the newest payload stored for room under id, as
+// state.amend does for the history buffer, recording editSeq as the edit's
+// sequence. It returns nil when there is no such payload.
+func (d *feedbackDB) amend(room, id string, editSeq uint64, edit func(*feedbackPayload)) (*feedbackPayload, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var seq uint64
+	var raw string
+	err = tx.QueryRow(`SELECT seq, payload FROM feedback WHERE room = ? AND id = ? ORDER BY seq DESC LIMIT 1`, room, id).Scan(&seq, &raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored feedbackPayload
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		return nil, fmt.Errorf("seq %d: %w", seq, err)
+	}
+	payload := amendedPayload(&stored, edit)
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE feedback SET payload = ?, edit_seq = ? WHERE room = ? AND seq = ?`, string(data), editSeq, room, seq); err != nil {
+		return nil, err
+	}
+	return payload, tx.Commit()
+}
+
+// queryHistory is state.queryHistory over everything stored for room.
+func (d *feedbackDB) queryHistory(room string, q historyQuery) ([]*feedbackPayload, int, error) {
+	where := []string{"room = ?"}
+	args := []interface{}{room}
+	if q.mode != "" {
+		where = append(where, "mode = ?")
+		args = append(args, q.mode)
+	}
+	if q.tag != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM json_each(feedback.payload, '$.tags') WHERE json_each.value = ?)")
+		args = append(args, q.tag)
+	}
+	if !q.since.IsZero() {
+		where = append(where, "ts_ns >= ?")
+		args = append(args, q.since.UnixNano())
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM feedback WHERE "+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := d.db.Query("SELECT payload FROM feedback WHERE "+cond+" ORDER BY seq DESC LIMIT ? OFFSET ?",
+		append(args, q.limit, q.offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	items := []*feedbackPayload{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, 0, err
+		}
+		var p feedbackPayload
+		if err := json.Unmarshal([]byte(raw), &p); err != nil {
+			return nil, 0, err
+		}
+		items = append(items, &p)
+	}
+	return items, total, rows.Err()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T, path string) *feedbackDB {
+	t.Helper()
+	db, err := openFeedbackDB(path)
+	if err != nil {
+		t.Fatalf("openFeedbackDB: %v", err)
+	}
+	t.Cleanup(func() { db.close() })
+	return db
+}
+
+// newDBRegistry is a fresh registry over the database at path, standing in
+// for a restarted relay.
+func newDBRegistry(t *testing.T, path string) *roomRegistry {
+	t.Helper()
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.db = openTestDB(t, path)
+	return reg
+}
+
+func TestDBRestoresRoomCode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.db")
+
+	reg := newDBRegistry(t, path)
+	rm, err := reg.get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.claimCode("s3cret"); err != nil {
+		t.Fatalf("claimCode: %v", err)
+	}
+	rm.state.setLatest(&feedbackPayload{ID: "a", Feedback: "hello"})
+
+	restarted := newDBRegistry(t, path)
+	rm, err = restarted.get("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm.admits("") {
+		t.Error("restored room admits viewers without its code")
+	}
+	if !rm.admits("s3cret") {
+		t.Error("restored room refuses its own code")
+	}
+	if err := rm.claimCode("other"); err == nil {
+		t.Error("restored room let a sender replace its code")
+	}
+	if latest, _ := rm.state.getLatest(); latest == nil || latest.ID != "a" {
+		t.Errorf("latest = %+v, want payload a", latest)
+	}
+}
+
+func TestDBKeepsClearedLatestCleared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.db")
+
+	reg := newDBRegistry(t, path)
+	rm, _ := reg.get("")
+	rm.state.setLatest(&feedbackPayload{ID: "a"})
+	rm.state.setLatest(&feedbackPayload{ID: "b"})
+	rm.state.clearLatest()
+
+	restarted := newDBRegistry(t, path)
+	rm, _ = restarted.get("")
+	if latest, _ := rm.state.getLatest(); latest != nil {
+		t.Errorf("latest = %q after restart, want it to stay cleared", latest.ID)
+	}
+	if got := len(rm.state.getHistory(10)); got != 2 {
+		t.Errorf("history has %d entries, want 2", got)
+	}
+}
+
+func TestDBRestoresLatestAfterNewerFeedback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.db")
+
+	reg := newDBRegistry(t, path)
+	rm, _ := reg.get("")
+	rm.state.setLatest(&feedbackPayload{ID: "a"})
+	rm.state.clearLatest()
+	rm.state.setLatest(&feedbackPayload{ID: "b"})
+
+	restarted := newDBRegistry(t, path)
+	rm, _ = restarted.get("")
+	if latest, _ := rm.state.getLatest(); latest == nil || latest.ID != "b" {
+		t.Errorf("latest = %+v, want payload b", latest)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// apiError is the body of every error response:
+// {"error":{"code":"feedback_required","message":"feedback is required"}}.
+// Codes are stable and meant for programs; messages are for people.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]apiError{"error": {Code: code, Message: message}}); err != nil {
+		log.Printf("failed to write error response: %v", err)
+	}
+}
+
+// strictJSON makes decodeJSON reject unknown fields and trailing data
+// (STRICT_JSON, on by default) so client typos such as "feedbck" fail
+// loudly instead of being dropped.
+var strictJSON = true
+
+var errTrailingJSON = errors.New("unexpected data after the JSON object")
+
+// decodeJSON decodes one JSON value from r into v, applying strictJSON.
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	if strictJSON {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if !strictJSON {
+		return nil
+	}
+	_, err := dec.Token()
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, io.EOF):
+		return nil
+	case errors.As(err, &tooLarge):
+		return err
+	}
+	return errTrailingJSON
+}
+
+// invalidJSONMessage describes a decodeJSON failure for an invalid_json
+// response: an empty or truncated body, the byte offset of a syntax error,
+// the field and expected type of a type mismatch, or an unknown field.
+func invalidJSONMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "request body ends before the JSON value is complete"
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("invalid JSON at byte %d: %s", syntaxErr.Offset, syntaxErr)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Sprintf("request body must be a JSON object, not %s", typeErr.Value)
+		}
+		return fmt.Sprintf("field %q must be %s, not %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case errors.Is(err, errTrailingJSON):
+		return err.Error()
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return "unknown field " + field
+	}
+	return "invalid JSON payload"
+}
+
+// jsonTypeName names a Go type the way a JSON client would think of it.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return t.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeJSONStrict(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		strict  string // invalidJSONMessage in strict mode; empty means accepted
+		lenient bool   // accepted with STRICT_JSON=0
+	}{
+		{`{"feedback":"hi"}`, "", true},
+		{`{"feedback":"hi"}` + "\n  ", "", true},
+		{`{"feedbck":"hi"}`, `unknown field "feedbck"`, true},
+		{`{"feedback":"hi","extra":1}`, `unknown field "extra"`, true},
+		{`{"feedback":"hi"} {"feedback":"again"}`, "unexpected data after the JSON object", true},
+		{`{"feedback":"hi"}garbage`, "unexpected data after the JSON object", true},
+		{`{"feedback":3}`, `field "feedback" must be a string, not number`, false},
+		{``, "request body is empty", false},
+	} {
+		for _, strict := range []bool{true, false} {
+			strictJSON = strict
+			var body feedbackRequest
+			err := decodeJSON(strings.NewReader(tc.body), &body)
+			switch {
+			case strict && tc.strict == "" && err != nil:
+				t.Errorf("strict %s: %v", tc.body, err)
+			case strict && tc.strict != "" && (err == nil || invalidJSONMessage(err) != tc.strict):
+				t.Errorf("strict %s: err = %v, want %q", tc.body, err, tc.strict)
+			case !strict && tc.lenient != (err == nil):
+				t.Errorf("lenient %s: err = %v, want accepted = %v", tc.body, err, tc.lenient)
+			}
+		}
+	}
+	strictJSON = true
+}
+
+func TestStrictJSONHandlers(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedbck": "hi", "image": pngDataURL(testPNG(t, 8, 8))})
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "invalid_json" || !strings.Contains(rec.Body.String(), `unknown field \"feedbck\"`) {
+		t.Errorf("misspelled feedback field = %d %s, want 400 naming the field", rec.Code, rec.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/control", bytes.NewReader([]byte(`{"action":"scroll","delta":10,"speed":2}`)))
+	rec = httptest.NewRecorder()
+	handleControl(reg, newAckTracker(time.Minute))(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `unknown field \"speed\"`) {
+		t.Errorf("control with an extra field = %d %s, want 400 naming the field", rec.Code, rec.Body)
+	}
+}
+
+func TestInvalidJSONMessages(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	acks := newAckTracker(time.Minute)
+	handlers := map[string]http.HandlerFunc{
+		"/api/feedback": handleFeedback(1<<20, reg),
+		"/api/control":  handleControl(reg, acks),
+	}
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{``, "request body is empty"},
+		{`{"feedback":"hi"`, "request body ends before the JSON value is complete"},
+		{`{"feedback" "hi"}`, `invalid JSON at byte 13: invalid character '"' after object key`},
+		{`[1,2]`, "request body must be a JSON object, not array"},
+		{`"hello"`, "request body must be a JSON object, not string"},
+	} {
+		for target, handler := range handlers {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(tc.body)))
+			var body struct {
+				Error apiError `json:"error"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &body)
+			if rec.Code != http.StatusBadRequest || body.Error.Code != "invalid_json" || body.Error.Message != tc.want {
+				t.Errorf("POST %s %q = %d %+v, want 400 invalid_json %q", target, tc.body, rec.Code, body.Error, tc.want)
+			}
+		}
+	}
+
+	for target, tc := range map[string]struct{ body, want string }{
+		"/api/feedback": {`{"feedback":["a"]}`, `field "feedback" must be a string, not array`},
+		"/api/control":  {`{"action":"scroll","delta":"10"}`, `field "delta" must be a number, not string`},
+	} {
+		rec := httptest.NewRecorder()
+		handlers[target](rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(tc.body)))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), strings.ReplaceAll(tc.want, `"`, `\"`)) {
+			t.Errorf("POST %s %s = %d %s, want %q", target, tc.body, rec.Code, rec.Body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// handleExport streams the room's history, from DB_PATH when set, and every
+// upload it references as a ZIP archive. Entries are written straight to the response, so memory use
+// does not grow with the session.
+func handleExport(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		history := room.state.getHistory(0)
+		if rooms.db != nil {
+			// DB_PATH keeps the whole session, not just HISTORY_SIZE entries;
+			// SQLite reads LIMIT -1 as no limit.
+			if history, _, err = rooms.db.queryHistory(room.name, historyQuery{limit: -1}); err != nil {
+				log.Printf("export query for room %q failed: %v", room.name, err)
+				writeJSONError(w, http.StatusInternalServerError, "history_failed", "failed to read history")
+				return
+			}
+		}
+		name := fmt.Sprintf("session-%s.zip", time.Now().UTC().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+
+		zw := zip.NewWriter(w)
+		if err := writeExport(zw, rooms.blobs, rooms.uploadDir, history); err != nil {
+			// Headers are already sent; all we can do is cut the archive short.
+			log.Printf("export failed: %v", err)
+			return
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("export failed: %v", err)
+		}
+	}
+}
+
+func writeExport(zw *zip.Writer, store BlobStore, uploadDir string, history []*feedbackPayload) error {
+	f, err := zw.Create("feedback.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	public := make([]*feedbackPayload, len(history))
+	for i, p := range history {
+		public[i] = p.withPublicURLs()
+	}
+	if err := enc.Encode(public); err != nil {
+		return err
+	}
+
+	written := make(map[string]struct{})
+	for _, p := range history {
+		for _, id := range p.uploadIDs() {
+			if _, ok := written[id]; ok {
+				continue
+			}
+			written[id] = struct{}{}
+			if err := addExportFile(zw, store, filepath.Join(uploadDir, filepath.FromSlash(id)), "uploads/"+id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addExportFile copies one upload into the archive, skipping files that have
+// already been cleaned up.
+func addExportFile(zw *zip.Writer, store BlobStore, path, name string) error {
+	src, err := store.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// Screenshots and audio are already compressed.
+	header.Method = zip.Store
+
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
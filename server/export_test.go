@@ -0,0 +1,46 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportReadsTheDatabase(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 2, false)
+	reg.db = openTestDB(t, filepath.Join(t.TempDir(), "feedback.db"))
+	room, _ := reg.get("")
+	for _, id := range []string{"a", "b", "c"} {
+		room.state.setLatest(&feedbackPayload{ID: id, Feedback: id})
+	}
+
+	rec := httptest.NewRecorder()
+	handleExport(reg)(rec, httptest.NewRequest(http.MethodGet, "/api/export", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export = %d, want 200", rec.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("feedback.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var history []*feedbackPayload
+	if err := json.NewDecoder(f).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range history {
+		ids = append(ids, p.ID)
+	}
+	if len(ids) != 3 || ids[0] != "c" || ids[2] != "a" {
+		t.Errorf("exported %v, want c, b, a including the entry past HISTORY_SIZE", ids)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// postFeedback sends body, JSON-encoded, to POST target on reg.
+func postFeedback(t *testing.T, reg *roomRegistry, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleFeedback(10<<20, reg)(rec, req)
+	return rec
+}
+
+// errorCode returns the code of the JSON error in rec.
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", rec.Body, err)
+	}
+	return body.Error.Code
+}
+
+func TestValidateHasNoSideEffects(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	body := map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8))}
+
+	rec := postFeedback(t, reg, "/api/feedback?validate=1&room=team&code=s3cret", body)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"valid\":true}\n" {
+		t.Fatalf("validate = %d %s, want 200 {\"valid\":true}", rec.Code, rec.Body)
+	}
+	if reg.lookup("team") != nil {
+		t.Error("validate created the room")
+	}
+	if files := storedFiles(t, reg.uploadDir); len(files) != 0 {
+		t.Errorf("validate stored %v", files)
+	}
+
+	rec = postFeedback(t, reg, "/api/feedback?validate=1", map[string]interface{}{"feedback": "hi", "image": "data:image/gif;base64,R0lG"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("validate of a GIF = %d, want 400", rec.Code)
+	}
+}
+
+func TestValidateChecksRoomCode(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	body := map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8))}
+	if rec := postFeedback(t, reg, "/api/feedback?room=team&code=s3cret", body); rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"room=team&code=s3cret", http.StatusOK},
+		{"room=team&code=wrong1", http.StatusForbidden},
+		{"room=team", http.StatusForbidden},
+		{"room=team&code=no!", http.StatusBadRequest},
+		{"room=other&code=any1", http.StatusOK},
+	} {
+		if rec := postFeedback(t, reg, "/api/feedback?validate=1&"+tc.query, body); rec.Code != tc.want {
+			t.Errorf("validate ?%s = %d %s, want %d", tc.query, rec.Code, rec.Body, tc.want)
+		}
+	}
+	if reg.lookup("other") != nil {
+		t.Error("validate created a room")
+	}
+}
+
+func TestValidateChecksSavedRoomCode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feedback.db")
+	rm, _ := newDBRegistry(t, path).get("team")
+	if err := rm.claimCode("s3cret"); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newDBRegistry(t, path)
+	body := map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8))}
+	if rec := postFeedback(t, restarted, "/api/feedback?validate=1&room=team&code=wrong1", body); rec.Code != http.StatusForbidden {
+		t.Errorf("validate with the wrong code = %d, want 403", rec.Code)
+	}
+	if restarted.lookup("team") != nil {
+		t.Error("validate loaded the room")
+	}
+}
+
+func TestFeedbackBodyLimit(t *testing.T) {
+	data, err := json.Marshal(map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const limit = 4096
+	// sized pads the body with insignificant whitespace to exactly n bytes.
+	sized := func(n int) []byte {
+		body := append([]byte("{"), bytes.Repeat([]byte(" "), n-len(data))...)
+		return append(body, data[1:]...)
+	}
+
+	for _, tc := range []struct {
+		size int
+		want int
+	}{
+		{limit - 1, http.StatusCreated},
+		{limit, http.StatusCreated},
+		{limit + 1, http.StatusRequestEntityTooLarge},
+	} {
+		reg := newRoomRegistry(t.TempDir(), 10, false)
+		req := httptest.NewRequest(http.MethodPost, "/api/feedback", bytes.NewReader(sized(tc.size)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleFeedback(limit, reg)(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%d-byte body = %d %s, want %d", tc.size, rec.Code, rec.Body, tc.want)
+			continue
+		}
+		if tc.want == http.StatusRequestEntityTooLarge && !bytes.Contains(rec.Body.Bytes(), []byte(`"payload_too_large"`)) {
+			t.Errorf("oversized body error = %s, want payload_too_large", rec.Body)
+		}
+	}
+}
+
+func TestNormalizeTimestamp(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	for _, tc := range []struct {
+		raw  string
+		want string // empty means the value is rejected
+	}{
+		{``, "2024-05-01T10:00:00Z"},
+		{`null`, "2024-05-01T10:00:00Z"},
+		{`""`, "2024-05-01T10:00:00Z"},
+		{`"2024-03-09T08:07:06Z"`, "2024-03-09T08:07:06Z"},
+		{`"2024-03-09T10:07:06+02:00"`, "2024-03-09T08:07:06Z"},
+		{`"2024-03-09T08:07:06.123456789Z"`, "2024-03-09T08:07:06Z"},
+		{`1709971626000`, "2024-03-09T08:07:06Z"},
+		{` 1709971626000 `, "2024-03-09T08:07:06Z"},
+		{`"yesterday"`, ""},
+		{`"2024-03-09"`, ""},
+		{`"2024-03-09 08:07:06"`, ""},
+		{`"1709971626000"`, ""},
+		{`0`, ""},
+		{`-5`, ""},
+		{`1.5`, ""},
+		{`true`, ""},
+		{`{}`, ""},
+	} {
+		got, err := normalizeTimestamp(json.RawMessage(tc.raw), now)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("normalizeTimestamp(%s) = %q, want an error", tc.raw, got)
+		case tc.want != "" && (err != nil || got != tc.want):
+			t.Errorf("normalizeTimestamp(%s) = %q, %v; want %q", tc.raw, got, err, tc.want)
+		}
+	}
+}
+
+func TestFeedbackRejectsBadTimestamp(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8)), "timestamp": "soon"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("post with a bad timestamp = %d %s, want 400", rec.Code, rec.Body)
+	}
+}
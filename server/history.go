@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHistoryLimit = 50
+
+// historyQuery filters and pages /api/history. Zero values match everything.
+type historyQuery struct {
+	since  time.Time
+	mode   string
+	tag    string
+	limit  int
+	offset int
+}
+
+type historyPage struct {
+	Items   []*feedbackPayload `json:"items"`
+	Total   int                `json:"total"`
+	HasMore bool               `json:"hasMore"`
+}
+
+func parseHistoryQuery(r *http.Request) (historyQuery, error) {
+	values := r.URL.Query()
+	q := historyQuery{
+		limit: defaultHistoryLimit,
+		mode:  values.Get("mode"),
+		tag:   strings.ToLower(strings.TrimSpace(values.Get("tag"))),
+	}
+
+	if raw := values.Get("since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, fmt.Errorf("since must be an RFC 3339 timestamp such as 2024-01-02T15:04:05Z")
+		}
+		q.since = since
+	}
+	if raw := values.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("limit must be a positive integer")
+		}
+		q.limit = n
+	}
+	if raw := values.Get("offset"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.offset = n
+	}
+	return q, nil
+}
+
+func (q historyQuery) matches(p *feedbackPayload) bool {
+	if q.mode != "" {
+		if historyMode(p) != q.mode {
+			return false
+		}
+	}
+	if q.tag != "" && !slices.Contains(p.Tags, q.tag) {
+		return false
+	}
+	if !q.since.IsZero() {
+		ts, err := time.Parse(time.RFC3339, p.Timestamp)
+		if err != nil || ts.Before(q.since) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryHistory returns one page of matching payloads, newest first, along
+// with the total number of matches.
+func (s *state) queryHistory(q historyQuery) ([]*feedbackPayload, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []*feedbackPayload{}
+	total := 0
+	for i := 1; i <= s.size; i++ {
+		p := s.entryAt(i).payload
+		if !q.matches(p) {
+			continue
+		}
+		if total >= q.offset && len(items) < q.limit {
+			items = append(items, p)
+		}
+		total++
+	}
+	return items, total
+}
+
+func handleHistory(rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		q, err := parseHistoryQuery(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_query", err.Error())
+			return
+		}
+
+		var items []*feedbackPayload
+		var total int
+		if rooms.db != nil {
+			if items, total, err = rooms.db.queryHistory(room.name, q); err != nil {
+				log.Printf("history query for room %q failed: %v", room.name, err)
+				writeJSONError(w, http.StatusInternalServerError, "history_failed", "failed to read history")
+				return
+			}
+		} else {
+			items, total = room.state.queryHistory(q)
+		}
+		page := historyPage{
+			Items:   items,
+			Total:   total,
+			HasMore: q.offset+len(items) < total,
+		}
+
+		w.Header().Set("Vary", "Accept")
+		switch historyFormat(r) {
+		case "text/csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			err = writeHistoryCSV(w, items)
+		case "text/plain":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			err = writeHistoryText(w, items)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(page)
+		}
+		if err != nil {
+			log.Printf("failed to encode history payload: %v", err)
+		}
+	}
+}
+
+// historyFormat picks the first media type in the Accept header that
+// /api/history can produce. Anything else, including no header, gets JSON.
+func historyFormat(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/csv", "text/plain":
+			return mediaType
+		case "application/json", "*/*":
+			return "application/json"
+		}
+	}
+	return "application/json"
+}
+
+var historyColumns = []string{"id", "timestamp", "feedback", "screenshotUrl", "mode"}
+
+func historyMode(p *feedbackPayload) string {
+	mode, _ := p.Meta["mode"].(string)
+	return mode
+}
+
+// writeHistoryCSV writes items as RFC 4180 CSV with a header row; quotes,
+// commas and newlines in feedback are quoted by encoding/csv.
+func writeHistoryCSV(w http.ResponseWriter, items []*feedbackPayload) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(historyColumns); err != nil {
+		return err
+	}
+	for _, p := range items {
+		if err := cw.Write([]string{p.ID, p.Timestamp, p.Feedback, p.Screenshot, historyMode(p)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// historyLineEscaper keeps each entry on one line so awk and cut see one
+// record per payload.
+var historyLineEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+
+// writeHistoryText writes one tab-separated line per entry in the CSV column
+// order. Backslashes, tabs and newlines in feedback are escaped as \\, \t
+// and \n.
+func writeHistoryText(w http.ResponseWriter, items []*feedbackPayload) error {
+	for _, p := range items {
+		fields := []string{p.ID, p.Timestamp, historyLineEscaper.Replace(p.Feedback), p.Screenshot, historyMode(p)}
+		if _, err := fmt.Fprintln(w, strings.Join(fields, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
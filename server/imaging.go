@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// conversionError is a screenshot that could not be re-encoded to the
+// canonical format, as opposed to one that could not be stored.
+type conversionError struct {
+	err error
+}
+
+func (e *conversionError) Error() string { return "convert: " + e.err.Error() }
+func (e *conversionError) Unwrap() error { return e.err }
+
+// convertImage decodes data and re-encodes it as target ("png" or "jpg").
+func convertImage(data []byte, target string, quality int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if target == "jpg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// optimizePNG re-encodes a PNG at the highest zlib compression. The pixels
+// are unchanged, but ancillary chunks are not carried over; the caller keeps
+// whichever of the two files is smaller.
+func optimizePNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// minFitQuality is the lowest JPEG quality fitJPEG will try.
+const minFitQuality = 30
+
+// fitJPEG re-encodes data as a JPEG of at most maxBytes, binary-searching for
+// the highest quality between minFitQuality and maxQuality that fits. When
+// even minFitQuality is too large, that smallest encoding is returned
+// anyway: the cap is a target, not a reason to reject the screenshot.
+func fitJPEG(data []byte, maxBytes, maxQuality int) ([]byte, int, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	encode := func(quality int) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	lo, hi := minFitQuality, max(maxQuality, minFitQuality)
+	var best []byte
+	bestQuality := 0
+	for lo <= hi {
+		quality := (lo + hi) / 2
+		out, err := encode(quality)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(out) <= maxBytes {
+			best, bestQuality = out, quality
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+	}
+	if best == nil {
+		out, err := encode(minFitQuality)
+		return out, minFitQuality, err
+	}
+	return best, bestQuality, nil
+}
+
+// thumbnailName returns the companion thumbnail filename for an upload,
+// e.g. 123-abc.png -> 123-abc-thumb.png.
+func thumbnailName(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-thumb" + ext
+}
+
+// thumbnailSource returns the upload a thumbnail was made from, and false
+// when filename is not a thumbnail.
+func thumbnailSource(filename string) (string, bool) {
+	ext := filepath.Ext(filename)
+	base, found := strings.CutSuffix(strings.TrimSuffix(filename, ext), "-thumb")
+	if !found {
+		return "", false
+	}
+	return base + ext, true
+}
+
+// writeThumbnail scales the image at dir/filename down so its long edge is
+// at most maxEdge and stores it next to the source. It returns "" when the
+// image is already small enough to serve as its own thumbnail.
+func writeThumbnail(store BlobStore, dir, filename, ext string, maxEdge, quality int) (string, error) {
+	name := thumbnailName(filename)
+	if _, err := statBlob(store, filepath.Join(dir, name)); err == nil {
+		return name, nil // a deduplicated upload already has one
+	}
+
+	f, err := store.Open(filepath.Join(dir, filename))
+	if err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxEdge && h <= maxEdge {
+		return "", nil
+	}
+	if w >= h {
+		w, h = maxEdge, max(1, h*maxEdge/w)
+	} else {
+		w, h = max(1, w*maxEdge/h), maxEdge
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if ext == "jpg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := store.Put(filepath.Join(dir, name), buf.Bytes()); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// stripMetadata removes EXIF and other embedded metadata from an upload.
+// JPEGs are decoded and re-encoded at quality, which drops every APPn and
+// comment segment; PNGs keep their pixels byte-for-byte and only lose
+// ancillary text, EXIF, and timestamp chunks.
+func stripMetadata(ext string, data []byte, quality int) ([]byte, error) {
+	switch ext {
+	case "jpg":
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "png":
+		return stripPNGChunks(data)
+	}
+	return data, nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are dropped by stripPNGChunks.
+var pngMetadataChunks = map[string]struct{}{
+	"tEXt": {},
+	"zTXt": {},
+	"iTXt": {},
+	"eXIf": {},
+	"tIME": {},
+}
+
+func stripPNGChunks(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	rest := data[len(pngSignature):]
+	for len(rest) > 0 {
+		// length(4) + type(4) + data(length) + crc(4)
+		if len(rest) < 12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		if length < 0 || len(rest) < 12+length {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunk := rest[:12+length]
+		if _, drop := pngMetadataChunks[string(chunk[4:8])]; !drop {
+			out.Write(chunk)
+		}
+		rest = rest[12+length:]
+	}
+	return out.Bytes(), nil
+}
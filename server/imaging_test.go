@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+// exifMarker is planted in test images; it must not survive stripping.
+const exifMarker = "GPSLatitude=51.5074N"
+
+// withEXIF inserts an APP1 Exif segment carrying exifMarker right after a
+// JPEG's SOI marker.
+func withEXIF(jpg []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), exifMarker...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+// withTextChunk inserts a tEXt chunk carrying exifMarker right after a PNG's
+// IHDR chunk.
+func withTextChunk(img []byte) []byte {
+	data := append([]byte("Comment\x00"), exifMarker...)
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	out := append([]byte{}, img[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, img[ihdrEnd:]...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	jpg := withEXIF(testJPEG(t, 16, 16))
+	pngWithText := withTextChunk(testPNG(t, 16, 16))
+	if _, err := png.DecodeConfig(bytes.NewReader(pngWithText)); err != nil {
+		t.Fatalf("test PNG with tEXt does not decode: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		dataURL string
+	}{
+		{"jpeg", "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(jpg)},
+		{"png", pngDataURL(pngWithText)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, strip := range []bool{false, true} {
+				dir := t.TempDir()
+				store := newFSBlobStore(dir)
+				upload, err := persistScreenshot(store, dir, tc.dataURL, newUploadIndex(), screenshotOptions{stripMetadata: strip, jpegQuality: 90})
+				if err != nil {
+					t.Fatalf("persistScreenshot: %v", err)
+				}
+				stored, err := readBlob(store, filepath.Join(dir, upload.filename))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if leaked := bytes.Contains(stored, []byte(exifMarker)); leaked == strip {
+					t.Errorf("STRIP_METADATA=%v: metadata present = %v", strip, leaked)
+				}
+				if strip && bytes.Contains(stored, []byte("Exif\x00")) {
+					t.Error("stripped image still has an Exif segment")
+				}
+				if upload.width != 16 || upload.height != 16 {
+					t.Errorf("dimensions = %dx%d, want 16x16", upload.width, upload.height)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxScreenshotBytes(t *testing.T) {
+	const maxBytes = 200 << 10
+	large := noisyPNG(t)
+	if len(large) <= maxBytes {
+		t.Fatalf("synthetic image is only %d bytes", len(large))
+	}
+	opts := screenshotOptions{maxBytes: maxBytes, jpegQuality: 90}
+	dir := t.TempDir()
+	store := newFSBlobStore(dir)
+	index := newUploadIndex()
+
+	upload, err := persistScreenshot(store, dir, pngDataURL(large), index, opts)
+	if err != nil {
+		t.Fatalf("persistScreenshot: %v", err)
+	}
+	stored, err := readBlob(store, filepath.Join(dir, upload.filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) > maxBytes || upload.sizeBytes != len(stored) {
+		t.Errorf("stored %d bytes (reported %d), want at most %d", len(stored), upload.sizeBytes, maxBytes)
+	}
+	if filepath.Ext(upload.filename) != ".jpg" || upload.contentType != "image/jpeg" || upload.originalFormat != "png" {
+		t.Errorf("stored as %s (%s from %s), want a JPEG re-encoded from png", upload.filename, upload.contentType, upload.originalFormat)
+	}
+	if upload.jpegQuality < minFitQuality || upload.jpegQuality > 90 {
+		t.Errorf("jpegQuality = %d, want %d..90", upload.jpegQuality, minFitQuality)
+	}
+	if upload.width != 400 || upload.height != 400 {
+		t.Errorf("dimensions = %dx%d, want 400x400", upload.width, upload.height)
+	}
+
+	// A repeat capture reuses the file and still reports its quality.
+	again, err := persistScreenshot(store, dir, pngDataURL(large), index, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.filename != upload.filename || again.jpegQuality != upload.jpegQuality {
+		t.Errorf("repeat = %s at quality %d, want %s at %d", again.filename, again.jpegQuality, upload.filename, upload.jpegQuality)
+	}
+
+	small := testPNG(t, 16, 16)
+	upload, err = persistScreenshot(store, dir, pngDataURL(small), index, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = readBlob(store, filepath.Join(dir, upload.filename))
+	if !bytes.Equal(stored, small) || upload.jpegQuality != 0 {
+		t.Errorf("small image stored as %s at quality %d, want it untouched", upload.filename, upload.jpegQuality)
+	}
+}
+
+func TestFitJPEGFloor(t *testing.T) {
+	// A cap no encoding can meet still yields the smallest one.
+	out, quality, err := fitJPEG(noisyPNG(t), 1, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quality != minFitQuality || len(out) == 0 {
+		t.Errorf("fitJPEG = %d bytes at quality %d, want the quality %d encoding", len(out), quality, minFitQuality)
+	}
+}
+
+// encodePNG encodes a w×h gradient PNG at the given compression level.
+func encodePNG(t *testing.T, w, h int, level png.CompressionLevel) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: level}
+	if err := enc.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOptimizePNG(t *testing.T) {
+	opts := screenshotOptions{optimizePNG: true}
+	persist := func(img []byte) []byte {
+		t.Helper()
+		dir := t.TempDir()
+		store := newFSBlobStore(dir)
+		upload, err := persistScreenshot(store, dir, pngDataURL(img), newUploadIndex(), opts)
+		if err != nil {
+			t.Fatalf("persistScreenshot: %v", err)
+		}
+		stored, err := readBlob(store, filepath.Join(dir, upload.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload.sizeBytes != len(stored) {
+			t.Errorf("sizeBytes = %d, stored %d", upload.sizeBytes, len(stored))
+		}
+		return stored
+	}
+
+	raw := encodePNG(t, 256, 256, png.NoCompression)
+	stored := persist(raw)
+	if len(stored) >= len(raw) {
+		t.Errorf("optimized PNG is %d bytes, not smaller than the %d-byte upload", len(stored), len(raw))
+	}
+	before, _ := png.Decode(bytes.NewReader(raw))
+	after, err := png.Decode(bytes.NewReader(stored))
+	if err != nil {
+		t.Fatalf("optimized PNG does not decode: %v", err)
+	}
+	if !bytes.Equal(before.(*image.RGBA).Pix, toRGBA(after).Pix) {
+		t.Error("optimizing changed the pixels")
+	}
+
+	// An upload that is already as small as it gets is kept byte for byte.
+	best := encodePNG(t, 256, 256, png.BestCompression)
+	if stored := persist(best); !bytes.Equal(stored, best) {
+		t.Errorf("already-optimal PNG was rewritten: %d -> %d bytes", len(best), len(stored))
+	}
+}
+
+// toRGBA converts img to *image.RGBA for pixel comparison.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
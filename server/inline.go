@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"path"
+	"path/filepath"
+)
+
+// inlinePayload is a feedback payload with its screenshots embedded as data
+// URLs, for /api/stream?inline=1.
+type inlinePayload struct {
+	*feedbackPayload
+	ScreenshotData string      `json:"screenshotData,omitempty"`
+	Screenshots    []inlineRef `json:"screenshots,omitempty"` // shadows the URL-only list
+}
+
+type inlineRef struct {
+	screenshotRef
+	Data string `json:"data,omitempty"`
+}
+
+// inlineScreenshots returns msg with the screenshots of its payload read
+// from the rooms' blob store and embedded, so a viewer needs no second request to show
+// them. Messages without screenshots, expired screenshots and files that
+// have gone missing are passed through unchanged.
+func inlineScreenshots(rooms *roomRegistry, msg message) message {
+	if msg.kind != "feedback" && msg.kind != "audio" {
+		return msg
+	}
+	var p feedbackPayload
+	if err := json.Unmarshal(msg.data, &p); err != nil || p.ScreenshotID == "" || p.ScreenshotExpired {
+		return msg
+	}
+
+	encoded := make(map[string]string)
+	dataURL := func(id string) string {
+		if url, ok := encoded[id]; ok {
+			return url
+		}
+		url := ""
+		if data, err := readBlob(rooms.blobs, filepath.Join(rooms.uploadDir, filepath.FromSlash(id))); err == nil {
+			url = "data:" + mime.TypeByExtension(path.Ext(id)) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		}
+		encoded[id] = url
+		return url
+	}
+
+	out := inlinePayload{feedbackPayload: &p, ScreenshotData: dataURL(p.ScreenshotID)}
+	for _, ref := range p.Screenshots {
+		out.Screenshots = append(out.Screenshots, inlineRef{screenshotRef: ref, Data: dataURL(ref.ID)})
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return msg
+	}
+	msg.data = data
+	return msg
+}
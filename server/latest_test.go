@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// getLatest requests /api/latest with an optional If-None-Match.
+func getLatest(reg *roomRegistry, ifNoneMatch string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/latest", nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rec := httptest.NewRecorder()
+	handleLatest(reg)(rec, req)
+	return rec
+}
+
+func TestLatestETag(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	room.state.setLatest(&feedbackPayload{ID: "a", Feedback: "first"})
+
+	first := getLatest(reg, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first GET = %d with ETag %q, want 200 and an ETag", first.Code, etag)
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		rec := getLatest(reg, header)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s = %d with %d body bytes, want an empty 304", header, rec.Code, rec.Body.Len())
+		}
+	}
+
+	room.state.setLatest(&feedbackPayload{ID: "b", Feedback: "second"})
+	rec := getLatest(reg, etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET after new feedback = %d, want 200", rec.Code)
+	}
+	if next := rec.Header().Get("ETag"); next == etag {
+		t.Errorf("ETag %s did not change after setLatest", next)
+	}
+}
+
+func TestLatestImageNegotiation(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	img := testPNG(t, 12, 9)
+	if rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL(img)}); rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handleLatest(reg)(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		target, accept string
+		image          bool
+	}{
+		{"/api/latest", "", false},
+		{"/api/latest", "application/json", false},
+		{"/api/latest", "*/*", false},
+		{"/api/latest?format=image", "", true},
+		{"/api/latest", "image/*", true},
+		{"/api/latest", "image/avif,image/webp,*/*;q=0.8", true},
+		{"/api/latest", "application/json;q=0.9,image/png", true},
+		{"/api/latest", "image/png;q=0.5,application/json", false},
+		{"/api/latest?format=json", "image/*", false},
+	} {
+		rec := get(tc.target, tc.accept)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s Accept %q = %d %s", tc.target, tc.accept, rec.Code, rec.Body)
+			continue
+		}
+		gotImage := bytes.Equal(rec.Body.Bytes(), img)
+		if gotImage != tc.image {
+			t.Errorf("GET %s Accept %q: image = %v, want %v", tc.target, tc.accept, gotImage, tc.image)
+		}
+		wantType := "application/json"
+		if tc.image {
+			wantType = "image/png"
+		}
+		if got := rec.Header().Get("Content-Type"); got != wantType {
+			t.Errorf("GET %s Accept %q: Content-Type = %q, want %s", tc.target, tc.accept, got, wantType)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("GET %s: Vary = %q, want Accept", tc.target, got)
+		}
+	}
+
+	// The image's ETag names the stored file, so it revalidates as well.
+	etag := get("/api/latest?format=image", "").Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/api/latest?format=image", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	handleLatest(reg)(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("image revalidation = %d, want 304", rec.Code)
+	}
+}
+
+func TestLatestImageWithoutScreenshot(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "listen", "meta": map[string]interface{}{"mode": "audio"}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handleLatest(reg)(rec, httptest.NewRequest(http.MethodGet, "/api/latest?format=image", nil))
+	if rec.Code != http.StatusNotFound || errorCode(t, rec) != "no_screenshot" {
+		t.Errorf("image of audio feedback = %d %s, want 404 no_screenshot", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handleLatest(reg)(rec, httptest.NewRequest(http.MethodGet, "/api/latest", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("JSON of audio feedback = %d, want 200", rec.Code)
+	}
+}
+
+func TestClearLatestPurgeKeepsSharedScreenshots(t *testing.T) {
+	dir := t.TempDir()
+	reg := newRoomRegistry(dir, 10, false)
+	room, _ := reg.get("")
+	for _, name := range []string{"shared.png", "own.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("png"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deduplication hands the same file to both entries.
+	room.state.setLatest(&feedbackPayload{ID: "a", ScreenshotID: "shared.png"})
+	room.state.setLatest(&feedbackPayload{ID: "b", ScreenshotID: "shared.png", ThumbnailID: "own.png"})
+
+	rec := httptest.NewRecorder()
+	handleClearLatest(reg)(rec, httptest.NewRequest(http.MethodDelete, "/api/latest?purge=1", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want 204", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared.png")); err != nil {
+		t.Errorf("screenshot still in history was purged: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "own.png")); !os.IsNotExist(err) {
+		t.Errorf("unshared file survived the purge: %v", err)
+	}
+}
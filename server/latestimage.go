@@ -0,0 +1,75 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// wantsLatestImage reports whether a GET /api/latest asked for the
+// screenshot itself rather than the JSON payload: ?format=image does, and
+// so does an Accept header whose most preferred type is an image, as sent
+// by an <img> tag. ?format=json forces JSON whatever Accept says.
+func wantsLatestImage(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "image":
+		return true
+	case "json":
+		return false
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType == "*/*" {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return strings.HasPrefix(best, "image/")
+}
+
+// serveLatestImage answers GET /api/latest with the latest screenshot's
+// stored bytes. Its ETag names the stored file, so edits to the feedback
+// text don't invalidate a cached image.
+func serveLatestImage(w http.ResponseWriter, r *http.Request, rooms *roomRegistry, payload *feedbackPayload) {
+	if payload.ScreenshotID == "" {
+		writeJSONError(w, http.StatusNotFound, "no_screenshot", "the latest feedback has no screenshot")
+		return
+	}
+	if payload.ScreenshotExpired {
+		writeJSONError(w, http.StatusGone, "screenshot_expired", "screenshot has expired")
+		return
+	}
+	f, err := rooms.blobs.Open(filepath.Join(rooms.uploadDir, filepath.FromSlash(payload.ScreenshotID)))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "screenshot_not_found", "no such screenshot")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "screenshot_not_found", "no such screenshot")
+		return
+	}
+
+	contentType := payload.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(payload.ScreenshotID))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+payload.ScreenshotID+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	// ServeContent answers If-None-Match and Range from the headers above.
+	http.ServeContent(w, r, path.Base(payload.ScreenshotID), info.ModTime(), f)
+}
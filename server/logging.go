@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// setupLogging configures the process-wide logger from LOG_FORMAT and
+// LOG_LEVEL and returns the matching request-logging middleware. With
+// LOG_FORMAT=json every line, including log.Printf output, is a JSON object.
+func setupLogging() func(http.Handler) http.Handler {
+	level := parseLogLevel(os.Getenv("LOG_LEVEL"))
+
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))) {
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		slog.SetDefault(logger)
+		return jsonRequestLogger(logger)
+	case "", "text":
+		slog.SetLogLoggerLevel(level)
+		return middleware.Logger
+	default:
+		log.Printf("unknown LOG_FORMAT %q, using text", os.Getenv("LOG_FORMAT"))
+		slog.SetLogLoggerLevel(level)
+		return middleware.Logger
+	}
+}
+
+func parseLogLevel(raw string) slog.Level {
+	var level slog.Level
+	if raw == "" {
+		return slog.LevelInfo
+	}
+	if err := level.UnmarshalText([]byte(raw)); err != nil {
+		log.Printf("unknown LOG_LEVEL %q, using info", raw)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// jsonRequestLogger emits one structured record per request.
+func jsonRequestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				level := slog.LevelInfo
+				if status >= http.StatusInternalServerError {
+					level = slog.LevelError
+				}
+				logger.LogAttrs(r.Context(), level, "request",
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.Int("status", status),
+					slog.Duration("duration", time.Since(start)),
+					slog.Int("bytes", ww.BytesWritten()),
+					slog.String("requestId", middleware.GetReqID(r.Context())),
+					slog.String("remoteIp", clientIP(r)),
+				)
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
@@ -1,61 +1,306 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"image"
+	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	"github.com/skip2/go-qrcode"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type feedbackRequest struct {
 	Feedback  string                 `json:"feedback"`
 	Image     string                 `json:"image"`
-	Timestamp string                 `json:"timestamp"`
+	Audio     string                 `json:"audio"`
+	Images    []string               `json:"images"`
+	Timestamp json.RawMessage        `json:"timestamp"`
+	Tags      []string               `json:"tags"`
 	Meta      map[string]interface{} `json:"meta"`
 }
 
 type feedbackPayload struct {
-	ID           string                 `json:"id"`
-	Timestamp    string                 `json:"timestamp"`
-	Feedback     string                 `json:"feedback"`
-	ScreenshotID string                 `json:"screenshotId"`
-	Screenshot   string                 `json:"screenshotUrl"`
-	Meta         map[string]interface{} `json:"meta"`
+	ID                string                 `json:"id"`
+	Timestamp         string                 `json:"timestamp"`
+	Feedback          string                 `json:"feedback"`
+	ScreenshotID      string                 `json:"screenshotId"`
+	Screenshot        string                 `json:"screenshotUrl"`
+	Width             int                    `json:"width,omitempty"`
+	Height            int                    `json:"height,omitempty"`
+	SizeBytes         int                    `json:"sizeBytes,omitempty"`
+	SHA256            string                 `json:"sha256,omitempty"`
+	ThumbnailID       string                 `json:"thumbnailId,omitempty"`
+	ThumbnailURL      string                 `json:"thumbnailUrl,omitempty"`
+	ContentType       string                 `json:"contentType,omitempty"`
+	OriginalFormat    string                 `json:"originalFormat,omitempty"`
+	JPEGQuality       int                    `json:"jpegQuality,omitempty"`       // quality MAX_SCREENSHOT_BYTES re-encoded at
+	Screenshots       []screenshotRef        `json:"screenshots,omitempty"`       // every image, the first mirrored above
+	ScreenshotExpired bool                   `json:"screenshotExpired,omitempty"` // file deleted under SCREENSHOT_KEEP
+	AudioID           string                 `json:"audioId,omitempty"`
+	AudioURL          string                 `json:"audioUrl,omitempty"`
+	Tags              []string               `json:"tags,omitempty"`
+	RequestID         string                 `json:"requestId,omitempty"` // ingesting request, unless HIDE_REQUEST_ID
+	EditedAt          string                 `json:"editedAt,omitempty"`  // last PATCH /api/feedback/{id}
+	Revision          int                    `json:"revision,omitempty"`  // number of edits
+	Meta              map[string]interface{} `json:"meta"`
+}
+
+// screenshotRef is one image of a feedback event that sent several.
+type screenshotRef struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailID  string `json:"thumbnailId,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+// uploadIDs lists every file in uploads/ this payload references.
+func (p *feedbackPayload) uploadIDs() []string {
+	ids := p.screenshotIDs()
+	if p.AudioID != "" {
+		ids = append(ids, p.AudioID)
+	}
+	return ids
+}
+
+// screenshotIDs lists the payload's screenshots and their thumbnails.
+// Payloads saved before multiple images existed only have the single
+// screenshot fields.
+func (p *feedbackPayload) screenshotIDs() []string {
+	var ids []string
+	add := func(id string) {
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	add(p.ScreenshotID)
+	add(p.ThumbnailID)
+	for _, ref := range p.Screenshots {
+		add(ref.ID)
+		add(ref.ThumbnailID)
+	}
+	return ids
+}
+
+// silent reports whether the sender asked, via meta.silent, for the payload
+// to be recorded without being shown to viewers.
+func (p *feedbackPayload) silent() bool {
+	silent, _ := p.Meta["silent"].(bool)
+	return silent
+}
+
+func payloadMessage(seq uint64, p *feedbackPayload, data []byte) message {
+	return message{id: seq, kind: p.messageType(), silent: p.silent(), data: data}
+}
+
+// messageType tags the payload for ?types= filtering: feedback carrying
+// audio is "audio", everything else "feedback".
+func (p *feedbackPayload) messageType() string {
+	if p.AudioID != "" || isAudioMode(p.Meta) {
+		return "audio"
+	}
+	return "feedback"
 }
 
 type controlRequest struct {
 	Action string `json:"action"`
 	Delta  int    `json:"delta"`
+	X      *int   `json:"x"`
+	Y      *int   `json:"y"`
+	Width  *int   `json:"width"`
+	Height *int   `json:"height"`
 }
 
+// maxImagesPerFeedback bounds the images one feedback event may carry.
+const maxImagesPerFeedback = 8
+
+// maxControlCoordinate bounds highlight and cursor coordinates, which are in
+// screenshot pixels.
+const maxControlCoordinate = 10000
+
 type state struct {
 	mu          sync.RWMutex
 	latest      *feedbackPayload
 	latestBytes []byte
+	latestSeq   uint64
+	latestAt    time.Time // when latest was stored, for AUTO_CLEAR_AFTER
+
+	// seq numbers every stored payload, every edit to one and every clear;
+	// evictedSeq is the highest sequence that has fallen out of the history
+	// buffer and clearSeq that of the last clear.
+	seq        uint64
+	evictedSeq uint64
+	clearSeq   uint64
+
+	// history is a fixed-size ring buffer; next is the slot the following
+	// payload will be written to and size is how many slots are filled.
+	history []historyEntry
+	next    int
+	size    int
+
+	// onEvict, when set, is called outside the lock with every payload that
+	// falls off the end of the history buffer.
+	onEvict func(*feedbackPayload)
+
+	// screenshotKeep, when positive, limits how many distinct screenshots
+	// the history keeps on disk. Older entries stay but are marked
+	// screenshotExpired, and onExpire is called outside the lock with the
+	// upload ids to delete.
+	screenshotKeep int
+	onExpire       func(ids []string)
+
+	// onStore, when set, is called outside the lock with every entry
+	// setLatest or amend added or rewrote, newest first, so DB_PATH can
+	// mirror them.
+	onStore func(entries []historyEntry)
+
+	// onLatest, when set, is called outside the lock with the sequence of
+	// the new latest payload, or 0 when latest is cleared, so DB_PATH can
+	// restore exactly what was showing.
+	onLatest func(seq uint64)
 }
 
-func (s *state) setLatest(payload *feedbackPayload) {
+type historyEntry struct {
+	seq     uint64
+	editSeq uint64 // sequence of the latest edit; 0 if never edited
+	payload *feedbackPayload
+	bytes   []byte
+}
+
+func newState(historySize int) *state {
+	if historySize < 1 {
+		historySize = 1
+	}
+	return &state{
+		history: make([]historyEntry, historySize),
+	}
+}
+
+// setLatest stores payload as the latest feedback and appends it to the
+// history, returning the message to broadcast for it.
+func (s *state) setLatest(payload *feedbackPayload) message {
+	bytes, _ := json.Marshal(payload)
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.seq++
 	s.latest = payload
-	bytes, _ := json.Marshal(payload)
 	s.latestBytes = bytes
+	s.latestSeq = s.seq
+	s.latestAt = time.Now()
+
+	evicted := s.history[s.next]
+	s.history[s.next] = historyEntry{seq: s.seq, payload: payload, bytes: bytes}
+	s.next = (s.next + 1) % len(s.history)
+	if s.size < len(s.history) {
+		s.size++
+	}
+	if evicted.payload != nil {
+		s.evictedSeq = evicted.seq
+	}
+	msg := payloadMessage(s.seq, payload, bytes)
+	onEvict := s.onEvict
+	expired, rewritten := s.expireScreenshotsLocked()
+	onExpire := s.onExpire
+	onStore := s.onStore
+	onLatest := s.onLatest
+	s.mu.Unlock()
+
+	if evicted.payload != nil && onEvict != nil {
+		onEvict(evicted.payload)
+	}
+	if len(expired) > 0 && onExpire != nil {
+		onExpire(expired)
+	}
+	if onStore != nil {
+		onStore(append([]historyEntry{{seq: msg.id, payload: payload, bytes: bytes}}, rewritten...))
+	}
+	if onLatest != nil {
+		onLatest(msg.id)
+	}
+	return msg
+}
+
+// expireScreenshotsLocked marks history entries beyond the newest
+// screenshotKeep screenshots as expired and returns the upload ids they no
+// longer need along with the rewritten entries. Entries are replaced rather
+// than mutated, since readers may still hold the old payload.
+func (s *state) expireScreenshotsLocked() ([]string, []historyEntry) {
+	if s.screenshotKeep <= 0 {
+		return nil, nil
+	}
+	// kept counts distinct primary screenshots; keptFiles holds every image
+	// a kept entry still shows, since deduplicated files may be shared.
+	kept := make(map[string]bool)
+	keptFiles := make(map[string]bool)
+	var ids []string
+	var rewritten []historyEntry
+	for i := 1; i <= s.size; i++ {
+		entry := s.entryAt(i)
+		p := entry.payload
+		if p.ScreenshotID == "" || p.ScreenshotExpired {
+			continue
+		}
+		if kept[p.ScreenshotID] || len(kept) < s.screenshotKeep {
+			kept[p.ScreenshotID] = true
+			for _, id := range p.screenshotIDs() {
+				keptFiles[id] = true
+			}
+			continue
+		}
+
+		expired := *p
+		expired.ScreenshotExpired = true
+		entry.payload = &expired
+		entry.bytes, _ = json.Marshal(&expired)
+		s.history[(s.next-i+len(s.history))%len(s.history)] = entry
+		if s.latest == p {
+			s.latest, s.latestBytes = entry.payload, entry.bytes
+		}
+		ids = append(ids, p.screenshotIDs()...)
+		rewritten = append(rewritten, entry)
+	}
+	return slices.DeleteFunc(ids, func(id string) bool { return keptFiles[id] }), rewritten
+}
+
+// expiredUpload reports whether id is a screenshot some history entry
+// marks as expired.
+func (s *state) expiredUpload(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 1; i <= s.size; i++ {
+		if p := s.entryAt(i).payload; p.ScreenshotExpired && slices.Contains(p.screenshotIDs(), id) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *state) getLatest() (*feedbackPayload, []byte) {
@@ -67,162 +312,851 @@ func (s *state) getLatest() (*feedbackPayload, []byte) {
 	return s.latest, append([]byte(nil), s.latestBytes...)
 }
 
-type broker struct {
-	mu      sync.Mutex
-	clients map[chan []byte]struct{}
+// latestVisible is getLatest for viewers: when the latest payload is silent
+// it returns the newest earlier one that is not.
+func (s *state) latestVisible() *feedbackPayload {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.latest == nil || !s.latest.silent() {
+		return s.latest
+	}
+	for i := 1; i <= s.size; i++ {
+		if entry := s.entryAt(i); entry.seq < s.latestSeq && !entry.payload.silent() {
+			return entry.payload
+		}
+	}
+	return nil
 }
 
-func newBroker() *broker {
-	return &broker{
-		clients: make(map[chan []byte]struct{}),
+// clearLatest forgets the latest payload, leaving history untouched, and
+// returns what was cleared.
+func (s *state) clearLatest() *feedbackPayload {
+	s.mu.Lock()
+	previous := s.latest
+	onLatest := s.clearLatestLocked()
+	s.mu.Unlock()
+	if onLatest != nil {
+		onLatest(0)
 	}
+	return previous
 }
 
-func (b *broker) addClient(ch chan []byte) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	b.clients[ch] = struct{}{}
+// clearLatestIf clears the latest payload when match approves it and
+// reports whether it did.
+func (s *state) clearLatestIf(match func(*feedbackPayload) bool) bool {
+	s.mu.Lock()
+	if s.latest == nil || !match(s.latest) {
+		s.mu.Unlock()
+		return false
+	}
+	onLatest := s.clearLatestLocked()
+	s.mu.Unlock()
+	if onLatest != nil {
+		onLatest(0)
+	}
+	return true
+}
+
+// clearLatestIdle clears the latest payload if it was stored at least idle
+// before now and reports whether it did. A latest that was already cleared,
+// or replaced by newer feedback, is left alone.
+func (s *state) clearLatestIdle(idle time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	if s.latest == nil || now.Sub(s.latestAt) < idle {
+		s.mu.Unlock()
+		return false
+	}
+	onLatest := s.clearLatestLocked()
+	s.mu.Unlock()
+	if onLatest != nil {
+		onLatest(0)
+	}
+	return true
 }
 
-func (b *broker) removeClient(ch chan []byte) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	delete(b.clients, ch)
-	close(ch)
+// clearLatestLocked forgets the latest payload and returns the onLatest
+// hook for the caller to run once it has unlocked.
+func (s *state) clearLatestLocked() func(uint64) {
+	s.latest = nil
+	s.latestBytes = nil
+	s.latestSeq = 0
+	s.seq++
+	s.clearSeq = s.seq
+	return s.onLatest
 }
 
-func (b *broker) broadcast(payload []byte) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	for ch := range b.clients {
-		select {
-		case ch <- payload:
-		default:
-			// drop instead of blocking slow clients
+// lastClear is the sequence number of the most recent clear, or zero, for
+// /api/poll, which has no stream to deliver an unsequenced clear on.
+func (s *state) lastClear() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clearSeq
+}
+
+// amend applies edit to a copy of the history entry whose payload has id,
+// stamps it as edited and stores it in place. The entry keeps its sequence
+// number and the edit gets a new one, returned with the new payload so the
+// update can be broadcast and replayed under it. It reports false when id
+// is unknown or evicted.
+func (s *state) amend(id string, edit func(*feedbackPayload)) (*feedbackPayload, uint64, bool) {
+	s.mu.Lock()
+	var entry historyEntry
+	found := false
+	for i := 1; i <= s.size; i++ {
+		old := s.entryAt(i)
+		if old.payload.ID != id {
+			continue
+		}
+		s.seq++
+		entry = historyEntry{seq: old.seq, editSeq: s.seq, payload: amendedPayload(old.payload, edit)}
+		entry.bytes, _ = json.Marshal(entry.payload)
+		s.history[(s.next-i+len(s.history))%len(s.history)] = entry
+		if s.latest == old.payload {
+			s.latest, s.latestBytes = entry.payload, entry.bytes
 		}
+		found = true
+		break
 	}
+	onStore := s.onStore
+	s.mu.Unlock()
+
+	if !found {
+		return nil, 0, false
+	}
+	if onStore != nil {
+		onStore([]historyEntry{entry})
+	}
+	return entry.payload, entry.editSeq, true
 }
 
-var (
-	dataURLPattern = regexp.MustCompile(`^data:image/(png|jpeg);base64,(.+)$`)
-)
+// nextSeq reserves a sequence number, for an edit made outside the history
+// buffer.
+func (s *state) nextSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return s.seq
+}
+
+// references reports whether the latest payload or any retained history
+// entry points at the upload id.
+func (s *state) references(id string) bool {
+	return s.referencesExcept(id, nil)
+}
+
+// referencesExcept is references ignoring the payload skip, so a purge
+// keeps files that another retained entry still shows.
+func (s *state) referencesExcept(id string, skip *feedbackPayload) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.latest != nil && s.latest != skip && slices.Contains(s.latest.uploadIDs(), id) {
+		return true
+	}
+	for i := 1; i <= s.size; i++ {
+		if p := s.entryAt(i).payload; p != skip && slices.Contains(p.uploadIDs(), id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *state) latestMessage() (message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.latest == nil {
+		return message{}, false
+	}
+	return payloadMessage(s.latestSeq, s.latest, s.latestBytes), true
+}
+
+// getHistory returns up to limit payloads, newest first. A limit of zero or
+// less returns everything retained.
+func (s *state) getHistory(limit int) []*feedbackPayload {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if limit <= 0 || limit > s.size {
+		limit = s.size
+	}
+	items := make([]*feedbackPayload, 0, limit)
+	for i := 1; i <= limit; i++ {
+		items = append(items, s.entryAt(i).payload)
+	}
+	return items
+}
+
+// since returns the retained messages with a sequence above seq, oldest
+// first: payloads stored after seq, and updates for those stored before it
+// but edited since. gapped reports whether anything after seq was already
+// evicted.
+func (s *state) since(seq uint64) (msgs []message, gapped bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := s.size; i >= 1; i-- {
+		switch entry := s.entryAt(i); {
+		case entry.seq > seq:
+			msgs = append(msgs, payloadMessage(entry.seq, entry.payload, entry.bytes))
+		case entry.editSeq > seq:
+			// Seen before, edited since: replay the edit.
+			msgs = append(msgs, updateMessage(entry.editSeq, entry.payload))
+		}
+	}
+	slices.SortFunc(msgs, func(a, b message) int { return cmp.Compare(a.id, b.id) })
+	return msgs, seq < s.evictedSeq
+}
+
+// entryAt returns the i-th newest history entry, starting at 1. Callers must
+// hold s.mu.
+func (s *state) entryAt(i int) historyEntry {
+	return s.history[(s.next-i+len(s.history))%len(s.history)]
+}
+
+// recent returns up to n of the newest history entries as messages, oldest
+// first, for ?backfill=.
+func (s *state) recent(n int) []message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n = min(n, s.size)
+	msgs := make([]message, 0, n)
+	for i := n; i >= 1; i-- {
+		entry := s.entryAt(i)
+		msgs = append(msgs, payloadMessage(entry.seq, entry.payload, entry.bytes))
+	}
+	return msgs
+}
 
 func main() {
 	_ = godotenv.Load()
+	requestLogger := setupLogging()
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "4000"
 	}
+	if raw := os.Getenv("BIND_ADDR"); raw != "" {
+		ip := net.ParseIP(strings.Trim(raw, "[]"))
+		if ip == nil {
+			log.Fatalf("invalid BIND_ADDR %q: expected an IP address such as 127.0.0.1", raw)
+		}
+		bindAddr = ip
+	}
 
+	tlsConf, err := tlsFromEnv(port)
+	if err != nil {
+		log.Fatalf("invalid TLS configuration: %v", err)
+	}
+	scheme := tlsConf.scheme()
+
+	startedAt := time.Now()
+	registerUploadTypes()
+	registerAssetTypes()
+	basePath = normalizeBasePath(os.Getenv("BASE_PATH"))
+	if publicBaseURL, err = parsePublicBaseURL(os.Getenv("PUBLIC_BASE_URL")); err != nil {
+		log.Fatalf("invalid PUBLIC_BASE_URL: %v", err)
+	}
+	includeIPv6 = envBool("INCLUDE_IPV6")
+	strictJSON = os.Getenv("STRICT_JSON") != "0"
+	hideRequestID = envBool("HIDE_REQUEST_ID")
+	minFreeDiskBytes = int64(envInt("MIN_FREE_DISK_BYTES", 0))
+	if err := setUploadNaming(os.Getenv("UPLOAD_NAMING")); err != nil {
+		log.Fatal(err)
+	}
 	publicDir := filepath.Join(".", "public")
 	uploadDir := filepath.Join(".", "uploads")
+	maxUploadBytes := int64(envInt("MAX_UPLOAD_BYTES", 8<<20))
 
 	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
 		log.Fatalf("failed to create uploads directory: %v", err)
 	}
 
-	state := &state{}
-	broker := newBroker()
+	// Background workers outlive in-flight requests: they are stopped only
+	// once the HTTP server has finished shutting down.
+	workers := newWorkerGroup(context.Background())
+
+	rooms := newRoomRegistry(uploadDir, envInt("HISTORY_SIZE", 50), envBool("HISTORY_PRUNE_UPLOADS"))
+	if bucket := strings.TrimSpace(os.Getenv("S3_BUCKET")); bucket != "" {
+		store := newS3BlobStore(uploadDir, s3Config{
+			bucket:       bucket,
+			endpoint:     strings.TrimSpace(os.Getenv("S3_ENDPOINT")),
+			region:       envString("S3_REGION", "us-east-1"),
+			accessKey:    envString("S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+			secretKey:    envString("S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			prefix:       os.Getenv("S3_PREFIX"),
+			publicURL:    strings.TrimSpace(os.Getenv("S3_PUBLIC_URL")),
+			presignTTL:   envDuration("S3_PRESIGN_TTL", 24*time.Hour),
+		})
+		if err := store.check(); err != nil {
+			log.Fatalf("S3 bucket %q is not reachable: %v", bucket, err)
+		}
+		rooms.blobs = store
+		log.Printf("storing uploads in S3 bucket %q", bucket)
+	}
+	rooms.screenshots = screenshotOptions{
+		stripMetadata: envBool("STRIP_METADATA"),
+		jpegQuality:   envInt("JPEG_QUALITY", 90),
+		thumbnailSize: envInt("THUMBNAIL_SIZE", 320),
+		maxBytes:      envInt("MAX_SCREENSHOT_BYTES", 0),
+		optimizePNG:   envBool("OPTIMIZE_PNG"),
+		minDimension:  envInt("MIN_DIMENSION", 1),
+		maxDimension:  envInt("MAX_DIMENSION", 16384),
+	}
+	if rooms.screenshots.canonical, err = parseCanonicalImage(os.Getenv("CANONICAL_IMAGE")); err != nil {
+		log.Fatal(err)
+	}
+	rooms.uploadSlots = newUploadLimiter(envInt("MAX_CONCURRENT_UPLOADS", runtime.NumCPU()), envDuration("UPLOAD_QUEUE_TIMEOUT", 30*time.Second))
+	rooms.presence = envDuration("PRESENCE_DEBOUNCE", time.Second)
+	rooms.screenshotKeep = envInt("SCREENSHOT_KEEP", 0)
+	rooms.maxClients = envInt("MAX_CLIENTS", 0)
+	rooms.maxDrops = envInt("SSE_MAX_DROPS", 50)
+	if url := strings.TrimSpace(os.Getenv("WEBHOOK_URL")); url != "" {
+		rooms.webhook = newWebhook(url, os.Getenv("WEBHOOK_SECRET"), envInt("WEBHOOK_WORKERS", 2), 100, workers)
+	}
+	rooms.text = textPolicy{
+		maxBytes: envInt("FEEDBACK_MAX_BYTES", 8<<10),
+		escape:   envBool("SANITIZE_FEEDBACK"),
+	}
+	rooms.meta = metaPolicy{
+		maxBytes:    envInt("META_MAX_BYTES", 16<<10),
+		maxDepth:    envInt("META_MAX_DEPTH", 4),
+		allowedKeys: parseAllowedKeys(os.Getenv("META_ALLOWED_KEYS")),
+		modes:       parseAllowedModes(os.Getenv("ALLOWED_MODES")),
+	}
+	if dbPath := os.Getenv("DB_PATH"); dbPath != "" {
+		if rooms.db, err = openFeedbackDB(dbPath); err != nil {
+			log.Fatalf("cannot open DB_PATH %s: %v", dbPath, err)
+		}
+		log.Printf("storing feedback history in %s", dbPath)
+	}
+	stateFile := os.Getenv("STATE_FILE")
+	if stateFile != "" {
+		if restored, err := loadState(stateFile, rooms); err != nil {
+			log.Printf("ignoring %s: %v", stateFile, err)
+		} else if restored > 0 {
+			log.Printf("restored %d room(s) from %s", restored, stateFile)
+		}
+		interval := envDuration("STATE_SAVE_INTERVAL", 10*time.Second)
+		workers.start(func(ctx context.Context) { runStateSaver(ctx, stateFile, rooms, interval) })
+	}
+	acks := newAckTracker(envDuration("CONTROL_ACK_TTL", 5*time.Minute))
+	if ttl := envDuration("ROOM_IDLE_TTL", time.Hour); ttl > 0 {
+		workers.start(func(ctx context.Context) { runRoomReaper(ctx, rooms, ttl, time.Minute) })
+	}
+	if idle := envDuration("AUTO_CLEAR_AFTER", 0); idle > 0 {
+		workers.start(func(ctx context.Context) { runAutoClear(ctx, rooms, idle) })
+	}
+
+	uploadTTL := envDuration("UPLOAD_TTL", time.Hour)
+	maxDirBytes := int64(envInt("MAX_UPLOAD_DIR_BYTES", 0))
+	if uploadTTL > 0 || maxDirBytes > 0 {
+		interval := 5 * time.Minute
+		if uploadTTL > 0 && uploadTTL < interval {
+			interval = uploadTTL
+		}
+		if maxDirBytes > 0 && interval > time.Minute {
+			// A busy session can blow through the cap well within five minutes.
+			interval = time.Minute
+		}
+		workers.start(func(ctx context.Context) {
+			runUploadCleanup(ctx, uploadDir, uploadTTL, maxDirBytes, interval, rooms)
+		})
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	if raw := os.Getenv("TRUSTED_PROXIES"); raw != "" {
+		trusted, err := parseTrustedProxies(raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.Use(trustedRealIP(trusted))
+	} else {
+		r.Use(middleware.RealIP)
+	}
+	r.Use(skipPaths(requestLogger, "/api/healthz", "/api/readyz", "/metrics"))
 	r.Use(middleware.Recoverer)
-	r.Use(corsMiddleware())
+	r.Use(corsMiddleware(envInt("CORS_MAX_AGE", 600)))
+	if raw := os.Getenv("BASIC_AUTH"); raw != "" {
+		user, pass, err := parseBasicAuth(raw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Probes stay open so orchestrators need no credentials.
+		r.Use(skipPaths(basicAuth(user, pass, os.Getenv("API_TOKEN"), os.Getenv("VIEWER_TOKEN")), "/api/healthz", "/api/readyz"))
+	}
+	// Only JSON and SSE are compressed; PNG QR codes and uploads already are.
+	// The compressor flushes per event, so SSE messages are not held back.
+	if level := envInt("COMPRESS_LEVEL", 5); level > 0 {
+		r.Use(middleware.Compress(level, "application/json", "text/event-stream"))
+	}
 
-	r.Post("/api/feedback", handleFeedback(uploadDir, state, broker))
-	r.Get("/api/latest", handleLatest(state))
-	r.Get("/api/stream", handleStream(state, broker))
-	r.Post("/api/control", handleControl(broker))
-	r.Get("/api/info", handleInfo(port))
-	r.Get("/api/qr", handleQR(port))
+	r.Get("/api/healthz", handleHealthz())
+	r.Get("/api/readyz", handleReadyz(uploadDir, startedAt))
+	r.Handle("/metrics", promhttp.Handler())
 
-	r.Handle("/uploads/*", http.StripPrefix("/uploads/", cacheControlFileServer(uploadDir, 300)))
+	// One limiter covers POST /api/control and controls sent over /api/ws,
+	// so the socket is no way around it.
+	var limiter *rateLimiter
+	if rps := envFloat("RATE_LIMIT_RPS", 0); rps > 0 {
+		limiter = newRateLimiter(rps, envInt("RATE_LIMIT_BURST", 10))
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(bearerAuth(os.Getenv("API_TOKEN"), false))
+		// Read-only endpoints are exempt from RATE_LIMIT_RPS.
+		r.Get("/api/control/acks", handleControlAcks(acks))
+		r.With(requireRoomCode(rooms)).Get("/api/presence", handlePresence(rooms))
+		r.With(requireRoomCode(rooms)).Get("/api/uploads", handleListUploads(rooms))
+		r.Group(func(r chi.Router) {
+			if limiter != nil {
+				r.Use(limiter.middleware())
+			}
+			// Feedback posts claim the room's code themselves (claimRoomCode).
+			r.Post("/api/feedback", handleFeedback(maxUploadBytes, rooms))
+			r.Post("/api/feedback/multipart", handleFeedbackMultipart(maxUploadBytes, rooms))
+			r.Group(func(r chi.Router) {
+				r.Use(requireRoomCode(rooms))
+				r.Patch("/api/feedback/{id}", handleAmendFeedback(rooms))
+				r.Post("/api/annotate", handleAnnotate(rooms))
+				r.Post("/api/control", handleControl(rooms, acks))
+				r.Delete("/api/uploads/{name}", handleDeleteUpload(rooms))
+				r.Delete("/api/latest", handleClearLatest(rooms))
+			})
+		})
+	})
+
+	r.Group(func(r chi.Router) {
+		// EventSource cannot set headers, so viewers may pass ?token= instead.
+		r.Use(bearerAuth(os.Getenv("VIEWER_TOKEN"), true))
+		r.Use(requireRoomCode(rooms))
+		r.Get("/api/latest", handleLatest(rooms))
+		r.Get("/api/snapshot", handleSnapshot(scheme, port, startedAt, rooms))
+		r.Get("/api/history", handleHistory(rooms))
+		r.Get("/api/export", handleExport(rooms))
+		r.Post("/api/control/ack", handleControlAck(acks))
+		r.Get("/api/stream", handleStream(rooms, envDuration("SSE_HEARTBEAT", 15*time.Second), envInt("SSE_BUFFER", 4), envInt("SSE_RETRY_MS", 0)))
+		r.Get("/api/events.ndjson", handleEventsNDJSON(rooms, envInt("SSE_BUFFER", 4)))
+		r.Get("/api/poll", handlePoll(rooms, envDuration("POLL_TIMEOUT", 25*time.Second), envInt("SSE_BUFFER", 4)))
+		r.Get("/api/ws", handleWebSocket(rooms, acks, os.Getenv("API_TOKEN"), limiter, envDuration("WS_PING_INTERVAL", 30*time.Second), envInt("SSE_BUFFER", 4)))
+	})
+
+	// QR_DEFAULT_TARGET replaces the first LAN URL as the QR code's target,
+	// for machines where that guess is localhost or the wrong interface.
+	qrDefault := os.Getenv("QR_DEFAULT_TARGET")
+	if qrDefault != "" {
+		if qrDefault, err = sanitizeTarget(qrDefault); err != nil {
+			log.Fatalf("invalid QR_DEFAULT_TARGET: %v", err)
+		}
+	}
+	r.With(requireRoomCode(rooms)).Get("/api/info", handleInfo(scheme, port, qrDefault, rooms))
+	r.Get("/api/version", handleVersion())
+	var qrLogo image.Image
+	if path := os.Getenv("QR_LOGO"); path != "" {
+		if qrLogo, err = loadQRLogo(path); err != nil {
+			log.Printf("warning: ignoring QR_LOGO %s: %v", path, err)
+			qrLogo = nil
+		}
+	}
+	r.Get("/api/qr", handleQR(scheme, port, qrDefault, qrTargetPolicy{
+		restrict: envBool("QR_RESTRICT"),
+		allowed:  parseOrigins(os.Getenv("QR_ALLOWED_TARGETS")),
+	}, qrLogo))
+
+	cachePolicy, err := parseUploadCachePolicy(os.Getenv("UPLOAD_CACHE_MAX_AGES"), envInt("UPLOAD_CACHE_MAX_AGE", 300))
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploads := cacheControlFileServer(blobFileSystem{rooms.blobs, uploadDir}, cachePolicy)
+	if store, ok := rooms.blobs.(*s3BlobStore); ok {
+		uploads = store.presignRedirect(uploads)
+	}
+	r.Handle("/uploads/*", http.StripPrefix("/uploads/", requireUploadRoomCode(rooms, goneExpired(rooms, uploads))))
 
 	r.NotFound(spaHandler(publicDir))
 
-	log.Printf("Interview relay server listening on :%s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	// WriteTimeout stays 0 by default: it caps the whole response, and
+	// /api/stream is meant to stay open for hours. handleStream clears its
+	// own write deadline when one is configured.
+	addr := net.JoinHostPort(bindAddr.String(), port)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mountBasePath(r),
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 0),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 120*time.Second),
+	}
+	// Listen before serving so a bad address or a port in use fails at
+	// startup with a clear message rather than inside ListenAndServe.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("cannot listen on %s (BIND_ADDR/PORT): %v", addr, err)
+	}
+	// Every request context derives from baseCtx, which is cancelled as
+	// soon as shutdown starts: streams, polls and websockets notice and
+	// return, while ordinary requests just finish.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+	srv.RegisterOnShutdown(cancelRequests)
+
+	// On SIGINT/SIGTERM stop accepting requests and give in-flight ones a
+	// moment before cutting them off.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close()
+		}
+	}()
+
+	log.Printf("Interview relay server listening on %s://%s%s/", scheme, addr, basePath)
+	if tlsConf.enabled() {
+		srv.TLSConfig = tlsConf.config
+		err = srv.ServeTLS(ln, tlsConf.certFile, tlsConf.keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	// Serve returns as soon as Shutdown starts; wait for it to finish.
+	<-shutdownDone
+	cancelRequests()
+	workers.stop()
+	if stateFile != "" {
+		if err := saveState(stateFile, rooms); err != nil {
+			log.Printf("failed to save state to %s: %v", stateFile, err)
+		}
+	}
+	if rooms.db != nil {
+		if err := rooms.db.close(); err != nil {
+			log.Printf("failed to close database: %v", err)
+		}
+	}
+	log.Printf("Interview relay server stopped")
 }
 
-func handleFeedback(uploadDir string, s *state, b *broker) http.HandlerFunc {
+// handleFeedback accepts at most maxBytes of request body. Screenshots arrive
+// base64-encoded, so the largest image that fits is roughly 3/4 of maxBytes.
+//
+// With ?validate=1 the payload goes through every check, including auth and
+// disk space, but nothing is stored or broadcast and the room is not even
+// created: the reply is {"valid":true} or the error a real post would get.
+func handleFeedback(maxBytes int64, rooms *roomRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var body feedbackRequest
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		validate := r.URL.Query().Get("validate") == "1"
+		if !validate {
+			timer := prometheus.NewTimer(feedbackDuration)
+			defer timer.ObserveDuration()
+		}
+
+		var room *roomState
+		var err error
+		if validate {
+			err = checkRoomName(r.URL.Query().Get("room"))
+		} else {
+			room, err = rooms.fromRequest(r)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		if validate {
+			if !checkRoomCode(w, r, rooms, r.URL.Query().Get("room")) {
+				return
+			}
+		} else if !claimRoomCode(w, r, room) {
 			return
 		}
 
-		isAudio := false
-		if body.Meta != nil {
-			if mode, ok := body.Meta["mode"].(string); ok && mode == "audio" {
-				isAudio = true
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+		var body feedbackRequest
+		if err := decodeJSON(r.Body, &body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeTooLarge(w, tooLarge.Limit)
+				return
 			}
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", invalidJSONMessage(err))
+			return
 		}
 
-		if strings.TrimSpace(body.Feedback) == "" {
-			http.Error(w, "feedback is required", http.StatusBadRequest)
+		meta, err := rooms.meta.sanitize(body.Meta)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_meta", err.Error())
 			return
 		}
-		if body.Image == "" && !isAudio {
-			http.Error(w, "image is required", http.StatusBadRequest)
+		isAudio := isAudioMode(meta)
+		tags, err := normalizeTags(body.Tags)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_tags", err.Error())
 			return
 		}
 
-		filename := ""
+		if strings.TrimSpace(body.Feedback) == "" {
+			writeJSONError(w, http.StatusBadRequest, "feedback_required", "feedback is required")
+			return
+		}
+		if body.Feedback, err = rooms.text.clean(body.Feedback); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "feedback_too_long", err.Error())
+			return
+		}
+		images := body.Images
 		if body.Image != "" {
-			var err error
-			filename, err = persistScreenshot(uploadDir, body.Image)
+			images = append([]string{body.Image}, images...)
+		}
+		if len(images) > maxImagesPerFeedback {
+			writeJSONError(w, http.StatusBadRequest, "too_many_images", fmt.Sprintf("at most %d images are allowed", maxImagesPerFeedback))
+			return
+		}
+		if slices.Contains(images, "") {
+			writeJSONError(w, http.StatusBadRequest, "invalid_image", "images must not contain empty entries")
+			return
+		}
+		if len(images) == 0 && body.Audio == "" && !isAudio {
+			writeJSONError(w, http.StatusBadRequest, "image_required", "image or audio is required")
+			return
+		}
+		timestamp, err := normalizeTimestamp(body.Timestamp, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_timestamp", err.Error())
+			return
+		}
+
+		if validate {
+			// checkScreenshot decodes the whole image, so it takes a slot
+			// like a real upload would.
+			release, err := rooms.uploadSlots.acquire(r.Context())
 			if err != nil {
-				http.Error(w, fmt.Sprintf("invalid image: %v", err), http.StatusBadRequest)
+				writeUploadsBusy(w)
 				return
 			}
+			defer release()
+			opts := rooms.screenshots.forMeta(meta)
+			for _, image := range images {
+				if err := checkScreenshot(rooms.uploadDir, image, opts); err != nil {
+					writeUploadError(w, err, "invalid_image", "invalid image")
+					return
+				}
+			}
+			if body.Audio != "" {
+				if err := checkAudio(rooms.uploadDir, body.Audio); err != nil {
+					writeUploadError(w, err, "invalid_audio", "invalid audio")
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"valid":true}`+"\n")
+			return
 		}
 
-		if body.Timestamp == "" {
-			body.Timestamp = time.Now().UTC().Format(time.RFC3339)
+		// Every image shares the one request body limit, so maxBytes already
+		// bounds them combined.
+		var uploads []*storedUpload
+		for _, image := range images {
+			release, err := rooms.uploadSlots.acquire(r.Context())
+			if err != nil {
+				rooms.discardUploads(room, uploads)
+				writeUploadsBusy(w)
+				return
+			}
+			upload, err := persistScreenshot(rooms.blobs, room.uploadDir, image, rooms.uploads, rooms.screenshots.forMeta(meta))
+			release()
+			if err != nil {
+				rooms.discardUploads(room, uploads)
+				writeUploadError(w, err, "invalid_image", "invalid image")
+				return
+			}
+			uploads = append(uploads, upload)
 		}
-		if body.Meta == nil {
-			body.Meta = map[string]interface{}{}
+		var upload *storedUpload
+		if len(uploads) > 0 {
+			upload = uploads[0]
 		}
 
-		screenshotURL := ""
-		if filename != "" {
-			screenshotURL = "/uploads/" + filename
+		audioFile := ""
+		if body.Audio != "" {
+			var err error
+			audioFile, err = persistAudio(rooms.blobs, room.uploadDir, body.Audio)
+			if err != nil {
+				rooms.discardUploads(room, uploads)
+				writeUploadError(w, err, "invalid_audio", "invalid audio")
+				return
+			}
 		}
 
-		payload := &feedbackPayload{
-			ID:           uuid.NewString(),
-			Timestamp:    body.Timestamp,
-			Feedback:     body.Feedback,
-			ScreenshotID: filename,
-			Screenshot:   screenshotURL,
-			Meta:         body.Meta,
+		payload := newFeedbackPayload(room, rooms.blobs, body.Feedback, timestamp, meta, upload, audioFile)
+		if len(uploads) > 1 {
+			for _, extra := range uploads[1:] {
+				payload.addScreenshot(room, rooms.blobs, extra)
+			}
 		}
+		payload.Tags = tags
+		publishFeedback(w, r, room, payload, rooms.webhook)
+	}
+}
 
-		s.setLatest(payload)
-		bytes, _ := json.Marshal(payload)
-		b.broadcast(bytes)
+func isAudioMode(meta map[string]interface{}) bool {
+	mode, _ := meta["mode"].(string)
+	return mode == "audio"
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if _, err := w.Write(bytes); err != nil {
-			log.Printf("failed to write response: %v", err)
+// newFeedbackPayload assembles the payload for feedback whose files have
+// already been stored in room.
+func newFeedbackPayload(room *roomState, blobs BlobStore, feedback, timestamp string, meta map[string]interface{}, upload *storedUpload, audioFile string) *feedbackPayload {
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+
+	payload := &feedbackPayload{
+		ID:        uuid.NewString(),
+		Timestamp: timestamp,
+		Feedback:  feedback,
+		Meta:      meta,
+	}
+	if upload != nil {
+		payload.ScreenshotID = room.uploadID(upload.filename)
+		payload.Screenshot = blobURL(blobs, payload.ScreenshotID)
+		payload.Width = upload.width
+		payload.Height = upload.height
+		payload.SizeBytes = upload.sizeBytes
+		payload.SHA256 = upload.sha256
+		payload.ContentType = upload.contentType
+		payload.OriginalFormat = upload.originalFormat
+		payload.JPEGQuality = upload.jpegQuality
+		if upload.thumbnail != "" {
+			payload.ThumbnailID = room.uploadID(upload.thumbnail)
+			payload.ThumbnailURL = blobURL(blobs, payload.ThumbnailID)
 		}
+		payload.addScreenshot(room, blobs, upload)
+	}
+	if audioFile != "" {
+		payload.AudioID = room.uploadID(audioFile)
+		payload.AudioURL = blobURL(blobs, payload.AudioID)
+	}
+	return payload
+}
+
+// addScreenshot appends an image stored in room to the payload's
+// screenshots list.
+func (p *feedbackPayload) addScreenshot(room *roomState, blobs BlobStore, upload *storedUpload) {
+	ref := screenshotRef{
+		ID:     room.uploadID(upload.filename),
+		Width:  upload.width,
+		Height: upload.height,
+	}
+	ref.URL = blobURL(blobs, ref.ID)
+	if upload.thumbnail != "" {
+		ref.ThumbnailID = room.uploadID(upload.thumbnail)
+		ref.ThumbnailURL = blobURL(blobs, ref.ThumbnailID)
+	}
+	p.Screenshots = append(p.Screenshots, ref)
+}
+
+// hideRequestID keeps the ingesting request's id out of payloads
+// (HIDE_REQUEST_ID); it still reaches the log and the webhook headers.
+var hideRequestID bool
+
+// publishFeedback makes payload the room's latest, broadcasts it, queues it
+// for the webhook, and echoes it back as the 201 response. The request id
+// ties the payload, the log line and the webhook delivery together.
+func publishFeedback(w http.ResponseWriter, r *http.Request, room *roomState, payload *feedbackPayload, hook *webhook) {
+	reqID := middleware.GetReqID(r.Context())
+	if !hideRequestID {
+		payload.RequestID = reqID
+	}
+	msg := room.state.setLatest(payload)
+	if !msg.silent {
+		room.broker.broadcast(msg)
+	}
+	log.Printf("request %s stored feedback %s in room %q as seq %d", reqID, payload.ID, room.name, msg.id)
+	body := msg.data
+	if publicBaseURL != "" {
+		// The receiver is off-box, so relative /uploads/ links are useless.
+		body, _ = json.Marshal(payload.withPublicURLs())
+	}
+	hook.send(room.name, reqID, body)
+	feedbackReceived.Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(msg.data); err != nil {
+		log.Printf("failed to write response: %v", err)
 	}
 }
 
-func handleLatest(s *state) http.HandlerFunc {
+// normalizeTimestamp accepts an RFC 3339 (optionally with fractional seconds)
+// string or a unix-millisecond number and returns it as UTC RFC 3339. A
+// missing timestamp defaults to now.
+func normalizeTimestamp(raw json.RawMessage, now time.Time) (string, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" || trimmed == `""` {
+		return now.UTC().Format(time.RFC3339), nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		for _, layout := range []string{time.RFC3339, time.RFC3339Nano} {
+			if ts, err := time.Parse(layout, text); err == nil {
+				return ts.UTC().Format(time.RFC3339), nil
+			}
+		}
+		return "", fmt.Errorf("invalid timestamp %q: expected RFC 3339 or unix milliseconds", text)
+	}
+
+	millis, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || millis <= 0 {
+		return "", fmt.Errorf("invalid timestamp %s: expected RFC 3339 or unix milliseconds", trimmed)
+	}
+	return time.UnixMilli(millis).UTC().Format(time.RFC3339), nil
+}
+
+func writeTooLarge(w http.ResponseWriter, limit int64) {
+	message := fmt.Sprintf("request body exceeds %d bytes (about %d bytes of image data once base64-decoded)", limit, limit*3/4)
+	writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", message)
+}
+
+func handleLatest(rooms *roomRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		payload, _ := s.getLatest()
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		payload, _ := room.state.getLatest()
+		if r.URL.Query().Get("skipSilent") == "1" {
+			payload = room.state.latestVisible()
+		}
+		w.Header().Add("Vary", "Accept")
 		if payload == nil {
-			http.Error(w, "no feedback yet", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, "no_feedback", "no feedback yet")
 			return
 		}
+		if wantsLatestImage(r) {
+			serveLatestImage(w, r, rooms, payload)
+			return
+		}
+
+		// Every setLatest mints a new payload id, and edits bump its
+		// revision, so together they make a strong ETag and pollers can
+		// revalidate instead of re-downloading.
+		etag := `"` + payload.ID + `"`
+		if payload.Revision > 0 {
+			etag = fmt.Sprintf(`"%s.%d"`, payload.ID, payload.Revision)
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(payload); err != nil {
 			log.Printf("failed to encode latest payload: %v", err)
@@ -230,57 +1164,307 @@ func handleLatest(s *state) http.HandlerFunc {
 	}
 }
 
-func handleStream(s *state, b *broker) http.HandlerFunc {
+// etagMatches implements the weak comparison If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handleClearLatest blanks the current feedback for every viewer. Pass
+// ?purge=1 to also delete the screenshot it referenced.
+func handleClearLatest(rooms *roomRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		previous := room.state.clearLatest()
+		room.broker.broadcast(message{kind: "clear", data: []byte(`{"type":"clear"}`)})
+
+		if previous != nil && r.URL.Query().Get("purge") == "1" {
+			for _, id := range previous.uploadIDs() {
+				// Deduplicated screenshots may still back an older entry.
+				if room.state.referencesExcept(id, previous) {
+					continue
+				}
+				rooms.removeUpload(id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rejectFullRoom answers a stream or websocket request for a room already at
+// MAX_CLIENTS.
+func rejectFullRoom(w http.ResponseWriter, room *roomState) {
+	log.Printf("room %q is at MAX_CLIENTS (%d); rejecting viewer", room.name, room.broker.maxClients)
+	w.Header().Set("Retry-After", "30")
+	writeJSONError(w, http.StatusServiceUnavailable, "too_many_clients", "too many viewers connected")
+}
+
+func handleStream(rooms *roomRegistry, heartbeat time.Duration, sseBuffer, retryMS int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		s, b := room.state, room.broker
+
 		flusher, ok := w.(http.Flusher)
 		if !ok {
-			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, "streaming_unsupported", "streaming unsupported")
+			return
+		}
+
+		// Lift any server-wide WriteTimeout so long-lived streams survive it.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+		// ?reliable=1 trades the default drop-when-slow behaviour for a bigger
+		// buffer and a bounded wait, after which the connection is closed.
+		reliable := r.URL.Query().Get("reliable") == "1"
+		buffer := sseBuffer
+		if reliable {
+			buffer *= 4
+		}
+		filter := parseTypeFilter(r)
+		// ?inline=1 embeds screenshots in each event. Encoding happens here,
+		// after the broker hands the message over, so the drop policy still
+		// sees small URL-only messages.
+		inline := r.URL.Query().Get("inline") == "1"
+		send := func(msg message) error {
+			if inline {
+				msg = inlineScreenshots(rooms, msg)
+			}
+			return writeEvent(w, msg)
+		}
+		client := newClient(buffer, reliable)
+		client.id = middleware.GetReqID(r.Context())
+		client.observer = filter.presenceOnly()
+		if !b.addClient(client) {
+			rejectFullRoom(w, room)
 			return
 		}
+		connected := time.Now()
+		log.Printf("stream client %s connected to room %q from %s", client.id, room.name, r.RemoteAddr)
+		defer func() {
+			b.removeClient(client)
+			log.Printf("stream client %s disconnected after %s", client.id, time.Since(connected).Round(time.Second))
+		}()
 
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
-		client := make(chan []byte, 4)
-		b.addClient(client)
-		defer b.removeClient(client)
-
-		if _, latestBytes := s.getLatest(); len(latestBytes) > 0 {
-			if _, err := fmt.Fprintf(w, "data: %s\n\n", latestBytes); err == nil {
+		// The id matches the server log, so a lagging viewer can be matched
+		// to its connection from the browser's network tab.
+		// SSE_RETRY_MS goes out with it, before any event, so EventSource
+		// adopts the configured reconnect delay instead of its ~3s default.
+		preamble := fmt.Sprintf(": client %s\n", client.id)
+		if retryMS > 0 {
+			preamble += fmt.Sprintf("retry: %d\n", retryMS)
+		}
+		if _, err := io.WriteString(w, preamble+"\n"); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		// A reconnecting EventSource sends Last-Event-ID; replay whatever it
+		// missed from history, or tell it to start over if that was evicted.
+		var lastSent uint64
+		if lastID, ok := lastEventID(r); ok {
+			backlog, gapped := s.since(lastID)
+			if gapped {
+				if _, err := io.WriteString(w, "event: reset\ndata: {\"type\":\"reset\"}\n\n"); err != nil {
+					return
+				}
+			}
+			for _, msg := range backlog {
+				if !filter.allows(msg) {
+					continue
+				}
+				if err := send(msg); err != nil {
+					return
+				}
+				lastSent = msg.id
+			}
+			flusher.Flush()
+		} else if backfill := backfillCount(r); backfill > 1 {
+			// ?backfill=N gives a late joiner the last N events for context.
+			for _, msg := range s.recent(backfill) {
+				if r.Context().Err() != nil {
+					return
+				}
+				if !filter.allows(msg) {
+					continue
+				}
+				if err := send(msg); err != nil {
+					return
+				}
+				lastSent = msg.id
+			}
+			flusher.Flush()
+		} else if msg, ok := s.latestMessage(); ok && filter.allows(msg) {
+			if err := send(msg); err == nil {
+				lastSent = msg.id
 				flusher.Flush()
 			}
 		}
 
+		// Heartbeats keep proxies from reaping idle connections. The ticker is
+		// reset after every real event so pings only flow while idle.
+		var ticker *time.Ticker
+		var ping <-chan time.Time
+		if heartbeat > 0 {
+			ticker = time.NewTicker(heartbeat)
+			defer ticker.Stop()
+			ping = ticker.C
+		}
+
 		notify := r.Context().Done()
 		for {
 			select {
 			case <-notify:
 				return
-			case payload := <-client:
-				if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			case <-ping:
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case msg, ok := <-client.ch:
+				if !ok {
+					return // the broker gave up on this client
+				}
+				if msg.id != 0 && msg.id <= lastSent {
+					continue // already replayed above
+				}
+				if !filter.allows(msg) {
+					continue
+				}
+				if err := send(msg); err != nil {
 					return
 				}
+				if msg.id != 0 {
+					lastSent = msg.id
+				}
 				flusher.Flush()
+				if ticker != nil {
+					ticker.Reset(heartbeat)
+				}
 			}
 		}
 	}
 }
 
-func handleControl(b *broker) http.HandlerFunc {
+// backfillCount reads ?backfill=N, the number of recent events sent on
+// connect. It defaults to 1, just the latest payload; recent caps it at the
+// history size.
+func backfillCount(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("backfill"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+func writeEvent(w io.Writer, msg message) error {
+	if msg.id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", msg.id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", msg.data)
+	return err
+}
+
+// lastEventID reads the Last-Event-ID header, falling back to a lastEventId
+// query parameter for clients that reconnect with a fresh EventSource.
+func lastEventID(r *http.Request) (uint64, bool) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("lastEventId")
+	}
+	if raw == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(raw), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func handleControl(rooms *roomRegistry, acks *ackTracker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
 		var body controlRequest
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "invalid JSON payload", http.StatusBadRequest)
+		if err := decodeJSON(r.Body, &body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", invalidJSONMessage(err))
 			return
 		}
-		if body.Action != "scroll" {
-			http.Error(w, "unsupported action", http.StatusBadRequest)
+		bytes, err := sendControl(room, acks, body)
+		if err != nil {
+			code := "invalid_control"
+			if errors.Is(err, errUnsupportedAction) {
+				code = "unsupported_action"
+			}
+			writeJSONError(w, http.StatusBadRequest, code, err.Error())
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if _, err := w.Write(bytes); err != nil {
+			log.Printf("failed to write control response: %v", err)
+		}
+	}
+}
+
+var errUnsupportedAction = errors.New("unsupported action")
+
+// sendControl validates a control request and broadcasts it to the room,
+// returning the message sent.
+func sendControl(room *roomState, acks *ackTracker, body controlRequest) ([]byte, error) {
+	payload, err := controlPayload(body)
+	if err != nil {
+		return nil, err
+	}
+	// The id lets viewers acknowledge the control via /api/control/ack.
+	id := uuid.NewString()
+	payload["id"] = id
+	acks.track(id, body.Action, time.Now().UTC())
+
+	bytes, _ := json.Marshal(payload)
+	room.broker.broadcast(message{kind: "control", data: bytes})
+	controlMessages.Inc()
+	return bytes, nil
+}
+
+// controlPayload validates a control request and builds the message
+// broadcast to viewers.
+func controlPayload(body controlRequest) (map[string]interface{}, error) {
+	payload := map[string]interface{}{
+		"type":      "control",
+		"action":    body.Action,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	switch body.Action {
+	case "scroll":
 		if body.Delta == 0 {
-			http.Error(w, "delta is required", http.StatusBadRequest)
-			return
+			return nil, errors.New("delta is required")
 		}
 		if body.Delta > 2000 {
 			body.Delta = 2000
@@ -288,31 +1472,63 @@ func handleControl(b *broker) http.HandlerFunc {
 		if body.Delta < -2000 {
 			body.Delta = -2000
 		}
-
-		payload := map[string]interface{}{
-			"type":      "control",
-			"action":    body.Action,
-			"delta":     body.Delta,
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		payload["delta"] = body.Delta
+	case "highlight":
+		if err := addCoordinates(payload, map[string]*int{"x": body.X, "y": body.Y, "width": body.Width, "height": body.Height}); err != nil {
+			return nil, err
+		}
+	case "cursor":
+		if err := addCoordinates(payload, map[string]*int{"x": body.X, "y": body.Y}); err != nil {
+			return nil, err
 		}
-		bytes, _ := json.Marshal(payload)
-		b.broadcast(bytes)
+	default:
+		return nil, errUnsupportedAction
+	}
+	return payload, nil
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		if _, err := w.Write(bytes); err != nil {
-			log.Printf("failed to write control response: %v", err)
+func addCoordinates(payload map[string]interface{}, fields map[string]*int) error {
+	for _, name := range []string{"x", "y", "width", "height"} {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if value == nil {
+			return fmt.Errorf("%s is required", name)
+		}
+		if *value < 0 || *value > maxControlCoordinate {
+			return fmt.Errorf("%s must be between 0 and %d", name, maxControlCoordinate)
 		}
+		payload[name] = *value
 	}
+	return nil
 }
 
-func handleInfo(port string) http.HandlerFunc {
+func handleInfo(scheme, port, qrDefault string, rooms *roomRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		now := time.Now()
 		hostname, _ := os.Hostname()
 		payload := map[string]interface{}{
-			"hostname":    hostname,
-			"urls":        localBaseURLs(port),
-			"generatedAt": time.Now().UTC().Format(time.RFC3339),
+			"hostname":                 hostname,
+			"urls":                     viewerURLs(scheme, port),
+			"qrTarget":                 qrDefaultTarget(scheme, port, qrDefault),
+			"generatedAt":              now.UTC().Format(time.RFC3339),
+			"viewerCount":              room.broker.viewerCount(),
+			"version":                  buildInfo(),
+			"lastFeedbackAt":           nil,
+			"secondsSinceLastFeedback": nil,
+		}
+		if latest, _ := room.state.getLatest(); latest != nil {
+			payload["lastFeedbackAt"] = latest.Timestamp
+			if ts, err := time.Parse(time.RFC3339, latest.Timestamp); err == nil {
+				payload["secondsSinceLastFeedback"] = int64(now.Sub(ts).Seconds())
+			}
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -322,66 +1538,206 @@ func handleInfo(port string) http.HandlerFunc {
 	}
 }
 
-func handleQR(port string) http.HandlerFunc {
+// handlePresence lets the capture side poll whether anyone is watching, as
+// an alternative to /api/stream?types=presence.
+func handlePresence(rooms *roomRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		target := strings.TrimSpace(r.URL.Query().Get("target"))
-		var err error
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(map[string]int{"viewers": room.broker.viewerCount()}); err != nil {
+			log.Printf("failed to encode presence: %v", err)
+		}
+	}
+}
 
-		if target == "" {
-			urls := localBaseURLs(port)
-			if len(urls) == 0 {
-				http.Error(w, "no LAN URLs found", http.StatusNotFound)
-				return
-			}
-			target = urls[0]
-		} else {
-			target, err = sanitizeTarget(target)
-			if err != nil {
-				http.Error(w, "invalid target", http.StatusBadRequest)
-				return
-			}
+func handleHealthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write([]byte(`{"status":"ok"}` + "\n"))
+	}
+}
+
+// handleReadyz reports ready only while the uploads directory accepts writes.
+func handleReadyz(uploadDir string, startedAt time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		payload := map[string]interface{}{
+			"status":        "ok",
+			"startedAt":     startedAt.UTC().Format(time.RFC3339),
+			"uptimeSeconds": int64(time.Since(startedAt).Seconds()),
 		}
 
-		img, err := qrcode.Encode(target, qrcode.Medium, 256)
-		if err != nil {
-			http.Error(w, "failed to create QR code", http.StatusInternalServerError)
-			return
+		if err := checkWritable(uploadDir); err != nil {
+			status = http.StatusServiceUnavailable
+			payload["status"] = "unavailable"
+			payload["error"] = fmt.Sprintf("uploads directory not writable: %v", err)
 		}
 
-		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-store")
-		if _, err := w.Write(img); err != nil {
-			log.Printf("failed to write QR payload: %v", err)
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			log.Printf("failed to encode readyz payload: %v", err)
 		}
 	}
 }
 
-func persistScreenshot(dir, dataURL string) (string, error) {
-	matches := dataURLPattern.FindStringSubmatch(dataURL)
-	if len(matches) != 3 {
-		return "", errors.New("expected data:image/(png|jpeg);base64,... format")
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	closeErr := f.Close()
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// basePath is the URL prefix the relay is mounted under (BASE_PATH), with a
+// leading and no trailing slash; empty when served from the root.
+var basePath string
+
+func normalizeBasePath(raw string) string {
+	trimmed := strings.Trim(strings.TrimSpace(raw), "/")
+	if trimmed == "" {
+		return ""
 	}
-	ext := matches[1]
-	if ext == "jpeg" {
-		ext = "jpg"
+	return "/" + trimmed
+}
+
+// mountBasePath serves h below basePath. The bare prefix redirects to its
+// trailing-slash form so the page's relative URLs resolve correctly.
+func mountBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
 	}
+	stripped := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
 
-	decoded, err := base64.StdEncoding.DecodeString(matches[2])
+// uploadURL is the public path of an upload id.
+func uploadURL(id string) string {
+	return basePath + "/uploads/" + id
+}
+
+// publicBaseURL is the relay's external origin (PUBLIC_BASE_URL), such as
+// https://relay.example behind a TLS-terminating proxy. Payloads leaving the
+// browser's reach (webhooks, exports) get absolute URLs built from it; empty
+// leaves them relative.
+var publicBaseURL string
+
+// parsePublicBaseURL validates PUBLIC_BASE_URL: an absolute http(s) URL
+// without query or fragment. The trailing slash is dropped.
+func parsePublicBaseURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
 	if err != nil {
-		return "", fmt.Errorf("decode: %w", err)
+		return "", err
 	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%q must start with http:// or https://", raw)
+	}
+	if u.Host == "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("%q must be a bare origin and optional path", raw)
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+// absoluteURL prefixes a relay-relative URL with publicBaseURL. URLs that are
+// already absolute, such as S3 links, are returned unchanged.
+func absoluteURL(u string) string {
+	if publicBaseURL == "" || !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") {
+		return u
+	}
+	return publicBaseURL + u
+}
 
-	filename := fmt.Sprintf("%d-%s.%s", time.Now().UnixMilli(), uuid.NewString()[:8], ext)
-	path := filepath.Join(dir, filename)
+// withPublicURLs returns p, or a copy of it with absolute upload URLs when
+// PUBLIC_BASE_URL is set. p itself is shared and never modified.
+func (p *feedbackPayload) withPublicURLs() *feedbackPayload {
+	if publicBaseURL == "" {
+		return p
+	}
+	out := *p
+	out.Screenshot = absoluteURL(p.Screenshot)
+	out.ThumbnailURL = absoluteURL(p.ThumbnailURL)
+	out.AudioURL = absoluteURL(p.AudioURL)
+	if p.Screenshots != nil {
+		out.Screenshots = make([]screenshotRef, len(p.Screenshots))
+		for i, ref := range p.Screenshots {
+			ref.URL = absoluteURL(ref.URL)
+			ref.ThumbnailURL = absoluteURL(ref.ThumbnailURL)
+			out.Screenshots[i] = ref
+		}
+	}
+	return &out
+}
 
-	if err := os.WriteFile(path, decoded, 0o644); err != nil {
-		return "", fmt.Errorf("write: %w", err)
+// viewerURLs are localBaseURLs pointed at the viewer page, including any
+// BASE_PATH.
+func viewerURLs(scheme, port string) []string {
+	urls := localBaseURLs(scheme, port)
+	if basePath == "" {
+		return urls
+	}
+	for i, u := range urls {
+		urls[i] = u + basePath + "/"
 	}
+	return urls
+}
 
-	return filename, nil
+// includeIPv6 adds global-unicast IPv6 addresses to localBaseURLs
+// (INCLUDE_IPV6). Off by default: many home networks hand out v6 addresses
+// that a phone on the same WiFi still cannot reach.
+var includeIPv6 bool
+
+// lanURL formats ip as a viewer URL, reporting false for addresses a phone
+// could not use: loopback, link-local, and IPv6 unless includeIPv6 is set.
+func lanURL(scheme string, ip net.IP, port string) (string, bool) {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return "", false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if !includeIPv6 {
+		return "", false
+	}
+	if !ip.IsPrivate() && !ip.IsGlobalUnicast() {
+		return "", false
+	}
+	// JoinHostPort brackets IPv6 literals: http://[2001:db8::1]:4000.
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip.String(), port)), true
 }
 
-func localBaseURLs(port string) []string {
+// bindAddr is the interface the relay listens on (BIND_ADDR). The default
+// unspecified address listens everywhere.
+var bindAddr = net.IPv4zero
+
+// localBaseURLs lists the URLs a viewer could reach the relay on. A loopback
+// bind only advertises localhost, and a bind to one specific address only
+// advertises that address.
+func localBaseURLs(scheme, port string) []string {
 	var urls []string
 	seen := make(map[string]struct{})
 
@@ -396,17 +1752,58 @@ func localBaseURLs(port string) []string {
 		urls = append(urls, u)
 	}
 
-	add(fmt.Sprintf("http://localhost:%s", port))
+	if !bindAddr.IsUnspecified() && !bindAddr.IsLoopback() {
+		add(fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(bindAddr.String(), port)))
+		return urls
+	}
+	if bindAddr.IsLoopback() {
+		add(fmt.Sprintf("%s://localhost:%s", scheme, port))
+		return urls
+	}
+
+	// The first URL is the QR default, so lead with what a phone on the same
+	// network can actually reach: interface IPs, best first, then the mDNS
+	// and plain hostnames, and localhost last.
+	ips := slices.DeleteFunc(interfaceIPs(), func(ip net.IP) bool {
+		_, ok := lanURL(scheme, ip, port)
+		return !ok
+	})
+	slices.SortStableFunc(ips, func(a, b net.IP) int { return lanRank(a) - lanRank(b) })
+	for _, ip := range ips {
+		u, _ := lanURL(scheme, ip, port)
+		add(u)
+	}
 	if hostname, err := os.Hostname(); err == nil && hostname != "" {
-		add(fmt.Sprintf("http://%s:%s", hostname, port))
-		add(fmt.Sprintf("http://%s.local:%s", hostname, port))
+		add(fmt.Sprintf("%s://%s.local:%s", scheme, hostname, port))
+		add(fmt.Sprintf("%s://%s:%s", scheme, hostname, port))
+	}
+	add(fmt.Sprintf("%s://localhost:%s", scheme, port))
+
+	return urls
+}
+
+// lanRank orders interface addresses for localBaseURLs: private IPv4 (the
+// usual home or office LAN) first, then other IPv4, then IPv6.
+func lanRank(ip net.IP) int {
+	switch v4 := ip.To4(); {
+	case v4 != nil && v4.IsPrivate():
+		return 0
+	case v4 != nil:
+		return 1
 	}
+	return 2
+}
 
+// interfaceIPs lists the addresses of every up, non-loopback interface in
+// the order the system reports them. It is a variable so the ordering in
+// localBaseURLs can be exercised without real interfaces.
+var interfaceIPs = func() []net.IP {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return urls
+		return nil
 	}
 
+	var ips []net.IP
 	for _, iface := range ifaces {
 		if (iface.Flags&net.FlagUp) == 0 || (iface.Flags&net.FlagLoopback) != 0 {
 			continue
@@ -418,89 +1815,221 @@ func localBaseURLs(port string) []string {
 		}
 
 		for _, addr := range addrs {
-			var ip net.IP
 			switch v := addr.(type) {
 			case *net.IPNet:
-				ip = v.IP
+				ips = append(ips, v.IP)
 			case *net.IPAddr:
-				ip = v.IP
+				ips = append(ips, v.IP)
 			}
+		}
+	}
+	return ips
+}
 
-			if ip == nil || ip.IsLoopback() {
-				continue
-			}
-			ip = ip.To4()
-			if ip == nil {
-				continue
-			}
-			if !ip.IsPrivate() && !ip.IsGlobalUnicast() {
-				continue
-			}
+func spaHandler(publicDir string) http.HandlerFunc {
+	fileServer := http.FileServer(http.Dir(publicDir))
+	return func(w http.ResponseWriter, r *http.Request) {
+		fullPath, ok := publicPath(publicDir, r.URL.Path)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid_path", "invalid path")
+			return
+		}
+		if fullPath == filepath.Clean(publicDir) {
+			serveIndex(w, r, publicDir)
+			return
+		}
 
-			add(fmt.Sprintf("http://%s:%s", ip.String(), port))
+		if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		// Client-side routes have no extension; a missing /foo.js is a
+		// broken asset reference and must not come back as HTML.
+		if path.Ext(r.URL.Path) != "" {
+			http.NotFound(w, r)
+			return
 		}
+		serveIndex(w, r, publicDir)
 	}
+}
 
-	return urls
+// assetTypes are modern web asset extensions that OS MIME tables often lack
+// or get wrong.
+var assetTypes = map[string]string{
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".svg":         "image/svg+xml",
+}
+
+// registerAssetTypes pins the Content-Type of the SPA's static assets.
+func registerAssetTypes() {
+	for ext, contentType := range assetTypes {
+		if err := mime.AddExtensionType(ext, contentType); err != nil {
+			log.Printf("failed to register MIME type for %s: %v", ext, err)
+		}
+	}
 }
 
-func sanitizeTarget(target string) (string, error) {
-	target = strings.TrimSpace(target)
-	if target == "" {
-		return "", errors.New("empty target")
+// publicPath maps a request path to a file below publicDir. It refuses
+// ".." segments, backslashes and NUL bytes outright rather than trusting
+// Clean to neutralise them, and double-checks with filepath.Rel that the
+// result is still inside publicDir.
+func publicPath(publicDir, requestPath string) (string, bool) {
+	if strings.ContainsAny(requestPath, "\\\x00") {
+		return "", false
+	}
+	for _, segment := range strings.Split(requestPath, "/") {
+		if segment == ".." {
+			return "", false
+		}
 	}
+	root := filepath.Clean(publicDir)
+	full := filepath.Join(root, filepath.FromSlash(path.Clean("/"+requestPath)))
+	rel, err := filepath.Rel(root, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return full, true
+}
 
-	parsed, err := url.ParseRequestURI(target)
+// serveIndex serves index.html. Under a BASE_PATH its <base href="/"> is
+// rewritten so the page's relative asset and API URLs resolve below it.
+// The shell is always revalidated, so a deploy reaches browsers on their
+// next load; other static files keep their normal caching.
+func serveIndex(w http.ResponseWriter, r *http.Request, publicDir string) {
+	indexPath := filepath.Join(publicDir, "index.html")
+	w.Header().Set("Cache-Control", "no-cache")
+	if basePath == "" {
+		http.ServeFile(w, r, indexPath)
+		return
+	}
+	page, err := os.ReadFile(indexPath)
 	if err != nil {
-		return "", err
+		writeJSONError(w, http.StatusNotFound, "not_found", "index not found")
+		return
 	}
-
-	scheme := strings.ToLower(parsed.Scheme)
-	if scheme != "http" && scheme != "https" {
-		return "", errors.New("unsupported scheme")
+	page = bytes.Replace(page, []byte(`<base href="/" />`), []byte(`<base href="`+html.EscapeString(basePath)+`/" />`), 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(page); err != nil {
+		log.Printf("failed to write index: %v", err)
 	}
-
-	return parsed.String(), nil
 }
 
-func spaHandler(publicDir string) http.HandlerFunc {
-	fileServer := http.FileServer(http.Dir(publicDir))
-	return func(w http.ResponseWriter, r *http.Request) {
-		requestPath := filepath.Clean(r.URL.Path)
-		if requestPath == "/" {
-			http.ServeFile(w, r, filepath.Join(publicDir, "index.html"))
-			return
+// goneExpired answers 410 for screenshots deleted under SCREENSHOT_KEEP, so
+// viewers can tell "expired" apart from "never existed".
+func goneExpired(rooms *roomRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		if rooms.screenshotKeep > 0 && rooms.expiredUpload(id) {
+			if _, err := statBlob(rooms.blobs, filepath.Join(rooms.uploadDir, filepath.FromSlash(path.Clean("/"+id)))); errors.Is(err, os.ErrNotExist) {
+				writeJSONError(w, http.StatusGone, "screenshot_expired", "this screenshot is no longer retained")
+				return
+			}
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		fullPath := filepath.Join(publicDir, strings.TrimPrefix(requestPath, "/"))
-		if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
-			fileServer.ServeHTTP(w, r)
-			return
+// filesOnly hides directories from http.FileServer, so /uploads/ and room
+// subdirectories 404 instead of listing every upload's name.
+type filesOnly struct {
+	fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
+
+// bearerAuth requires an "Authorization: Bearer <token>" header matching
+// token. An empty token disables the check. When allowQuery is set, a
+// ?token= query parameter is accepted as well.
+func bearerAuth(token string, allowQuery bool) func(http.Handler) http.Handler {
+	expected := []byte(token)
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
 		}
-		http.ServeFile(w, r, filepath.Join(publicDir, "index.html"))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			provided := requestToken(r, allowQuery)
+			if subtle.ConstantTimeCompare([]byte(provided), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="interview-relay"`)
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized", "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
 }
 
-func cacheControlFileServer(dir string, maxAge int) http.Handler {
-	fs := http.FileServer(http.Dir(dir))
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
-		fs.ServeHTTP(w, r)
-	})
+// requestToken returns the bearer token from the Authorization header, or
+// from ?token= when allowQuery is set.
+func requestToken(r *http.Request, allowQuery bool) string {
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	if allowQuery {
+		return r.URL.Query().Get("token")
+	}
+	return ""
 }
 
-func corsMiddleware() func(http.Handler) http.Handler {
-	allowedOrigin := os.Getenv("CLIENT_ORIGIN")
-	if allowedOrigin == "" {
-		allowedOrigin = "*"
+// skipPaths applies mw to every request except those for the given paths.
+func skipPaths(mw func(http.Handler) http.Handler, paths ...string) func(http.Handler) http.Handler {
+	skip := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		skip[p] = struct{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := skip[r.URL.Path]; ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
 	}
+}
+
+// corsMiddleware reads CLIENT_ORIGIN as a comma-separated allowlist. An empty
+// value or "*" allows any origin without credentials; otherwise only listed
+// origins are echoed back, with credentials allowed. Preflights may be
+// cached for maxAge seconds (CORS_MAX_AGE; 0 leaves it to the browser) and
+// are granted whichever headers they ask for, so custom headers need no
+// change here.
+func corsMiddleware(maxAge int) func(http.Handler) http.Handler {
+	allowed := parseOrigins(os.Getenv("CLIENT_ORIGIN"))
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.Header().Set("Access-Control-Allow-Credentials", "false")
+			w.Header().Add("Vary", "Origin")
+			if origin, ok := matchOrigin(allowed, r.Header.Get("Origin")); ok {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET,PATCH,POST,DELETE,OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+				w.Header().Set("Access-Control-Allow-Credentials", strconv.FormatBool(origin != "*"))
+				if r.Method == http.MethodOptions {
+					w.Header().Add("Vary", "Access-Control-Request-Headers")
+					if requested := strings.TrimSpace(r.Header.Get("Access-Control-Request-Headers")); requested != "" {
+						w.Header().Set("Access-Control-Allow-Headers", requested)
+					}
+					if maxAge > 0 {
+						w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+					}
+				}
+			}
 
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
@@ -511,3 +2040,88 @@ func corsMiddleware() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+func parseOrigins(raw string) []string {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		return []string{"*"}
+	}
+	return origins
+}
+
+// matchOrigin returns the Access-Control-Allow-Origin value for origin, or
+// false when origin is not allowed.
+func matchOrigin(allowed []string, origin string) (string, bool) {
+	for _, candidate := range allowed {
+		if candidate == "*" {
+			return "*", true
+		}
+		if origin != "" && strings.EqualFold(candidate, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func envString(key, fallback string) string {
+	if raw := strings.TrimSpace(os.Getenv(key)); raw != "" {
+		return raw
+	}
+	return fallback
+}
+
+func envInt(key string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("ignoring invalid %s=%q: %v", key, raw, err)
+		return fallback
+	}
+	return f
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	if raw == "0" {
+		return 0
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		log.Printf("ignoring invalid %s=%q", key, raw)
+		return fallback
+	}
+	return d
+}
+
+func envBool(key string) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
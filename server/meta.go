@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// defaultAllowedModes are the meta.mode values the desktop agent sends: one
+// per capture hotkey, plus audio clips.
+const defaultAllowedModes = "primary,secondary,audio"
+
+// metaPolicy bounds the free-form meta object a sender attaches to feedback.
+// It is stored in history and rebroadcast verbatim, so it must stay small.
+type metaPolicy struct {
+	maxBytes    int
+	maxDepth    int
+	allowedKeys map[string]bool // nil allows every key
+	modes       map[string]bool // accepted meta.mode values; nil allows any
+}
+
+// parseAllowedModes reads ALLOWED_MODES: a comma-separated list, "*" for
+// any mode, or empty for defaultAllowedModes.
+func parseAllowedModes(raw string) map[string]bool {
+	switch strings.TrimSpace(raw) {
+	case "*":
+		return nil
+	case "":
+		raw = defaultAllowedModes
+	}
+	return parseAllowedKeys(raw)
+}
+
+func parseAllowedKeys(raw string) map[string]bool {
+	var keys map[string]bool
+	for _, key := range strings.Split(raw, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			if keys == nil {
+				keys = make(map[string]bool)
+			}
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// sanitize drops keys outside the allowlist, then rejects a mode outside
+// the allowed set and meta that nests deeper than maxDepth or serializes to
+// more than maxBytes.
+func (p metaPolicy) sanitize(meta map[string]interface{}) (map[string]interface{}, error) {
+	if meta == nil {
+		return nil, nil
+	}
+	if p.allowedKeys != nil {
+		for key := range meta {
+			if !p.allowedKeys[key] {
+				delete(meta, key)
+			}
+		}
+	}
+	if raw, ok := meta["mode"]; ok && p.modes != nil {
+		mode, isString := raw.(string)
+		if !isString || !p.modes[mode] {
+			allowed := make([]string, 0, len(p.modes))
+			for m := range p.modes {
+				allowed = append(allowed, m)
+			}
+			slices.Sort(allowed)
+			return nil, fmt.Errorf("meta.mode must be one of %s", strings.Join(allowed, ", "))
+		}
+	}
+	if p.maxDepth > 0 && metaDepth(meta) > p.maxDepth {
+		return nil, fmt.Errorf("meta nests deeper than %d levels", p.maxDepth)
+	}
+	if p.maxBytes > 0 {
+		encoded, err := json.Marshal(meta)
+		if err != nil {
+			return nil, fmt.Errorf("invalid meta: %w", err)
+		}
+		if len(encoded) > p.maxBytes {
+			return nil, fmt.Errorf("meta exceeds %d bytes", p.maxBytes)
+		}
+	}
+	return meta, nil
+}
+
+// metaDepth counts nested objects and arrays; a flat object has depth 1.
+func metaDepth(value interface{}) int {
+	deepest := 0
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			if d := metaDepth(child); d > deepest {
+				deepest = d
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if d := metaDepth(child); d > deepest {
+				deepest = d
+			}
+		}
+	default:
+		return 0
+	}
+	return deepest + 1
+}
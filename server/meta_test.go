@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// nested builds meta whose depth is depth: {"a":{"a":...{"a":1}}}.
+func nested(depth int) map[string]interface{} {
+	meta := map[string]interface{}{"a": 1}
+	for i := 1; i < depth; i++ {
+		meta = map[string]interface{}{"a": meta}
+	}
+	return meta
+}
+
+func TestMetaPolicySanitize(t *testing.T) {
+	policy := metaPolicy{maxBytes: 64, maxDepth: 3}
+	for _, tc := range []struct {
+		name    string
+		meta    map[string]interface{}
+		wantErr string
+	}{
+		{"nil", nil, ""},
+		{"flat", map[string]interface{}{"mode": "primary", "n": 1}, ""},
+		{"at max depth", nested(3), ""},
+		{"too deep", nested(4), "meta nests deeper than 3 levels"},
+		{"deep array", map[string]interface{}{"a": []interface{}{[]interface{}{[]interface{}{1}}}}, "meta nests deeper than 3 levels"},
+		{"oversized", map[string]interface{}{"junk": strings.Repeat("x", 64)}, "meta exceeds 64 bytes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := policy.sanitize(tc.meta)
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("sanitize: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+				t.Errorf("err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetaPolicyAllowlists(t *testing.T) {
+	policy := metaPolicy{allowedKeys: parseAllowedKeys("mode, source"), modes: parseAllowedModes("")}
+	meta, err := policy.sanitize(map[string]interface{}{"mode": "audio", "source": "hotkey", "secret": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meta["secret"]; ok || len(meta) != 2 {
+		t.Errorf("meta = %v, want only the allowed keys", meta)
+	}
+
+	if _, err := policy.sanitize(map[string]interface{}{"mode": "karaoke"}); err == nil || err.Error() != "meta.mode must be one of audio, primary, secondary" {
+		t.Errorf("unknown mode: err = %v", err)
+	}
+	if _, err := policy.sanitize(map[string]interface{}{"mode": 3}); err == nil {
+		t.Error("a non-string mode was accepted")
+	}
+	if _, err := (metaPolicy{modes: parseAllowedModes("*")}).sanitize(map[string]interface{}{"mode": "karaoke"}); err != nil {
+		t.Errorf("ALLOWED_MODES=* rejected a mode: %v", err)
+	}
+}
+
+func TestFeedbackRejectsOversizedMeta(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.meta = metaPolicy{maxBytes: 1024, maxDepth: 4}
+	img := pngDataURL(testPNG(t, 8, 8))
+
+	for _, meta := range []map[string]interface{}{
+		{"junk": strings.Repeat("x", 2048)},
+		nested(5),
+	} {
+		rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": img, "meta": meta})
+		if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "invalid_meta" {
+			t.Errorf("post = %d %s, want 400 invalid_meta", rec.Code, rec.Body)
+		}
+	}
+	if latest, _ := reg.lookup("").state.getLatest(); latest != nil {
+		t.Errorf("rejected feedback became latest: %+v", latest)
+	}
+}
+
+func TestFeedbackAllowedModes(t *testing.T) {
+	img := pngDataURL(testPNG(t, 8, 8))
+	for _, tc := range []struct {
+		allowed string
+		mode    string
+		image   bool
+		want    int
+		code    string
+	}{
+		{"", "primary", true, http.StatusCreated, ""},
+		{"", "secondary", true, http.StatusCreated, ""},
+		{"", "audio", false, http.StatusCreated, ""},
+		{"", "screen", true, http.StatusBadRequest, "invalid_meta"},
+		{"screen,whiteboard,audio", "screen", true, http.StatusCreated, ""},
+		{"screen,whiteboard,audio", "whiteboard", false, http.StatusBadRequest, "image_required"},
+		{"screen,whiteboard,audio", "audio", false, http.StatusCreated, ""},
+		{"screen,whiteboard,audio", "primary", true, http.StatusBadRequest, "invalid_meta"},
+		{"screen,whiteboard,audio", "Screen", true, http.StatusBadRequest, "invalid_meta"},
+		{"*", "anything", true, http.StatusCreated, ""},
+	} {
+		reg := newRoomRegistry(t.TempDir(), 10, false)
+		reg.meta = metaPolicy{modes: parseAllowedModes(tc.allowed)}
+		body := map[string]interface{}{"feedback": "hi", "meta": map[string]interface{}{"mode": tc.mode}}
+		if tc.image {
+			body["image"] = img
+		}
+		rec := postFeedback(t, reg, "/api/feedback", body)
+		if rec.Code != tc.want || (tc.code != "" && errorCode(t, rec) != tc.code) {
+			t.Errorf("ALLOWED_MODES=%q mode %q = %d %s, want %d %s", tc.allowed, tc.mode, rec.Code, rec.Body, tc.want, tc.code)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics exposed at /metrics. Keep the README list in sync when adding one.
+var (
+	feedbackReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_feedback_received_total",
+		Help: "Feedback payloads accepted by /api/feedback.",
+	})
+	controlMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_control_messages_total",
+		Help: "Control messages broadcast via /api/control.",
+	})
+	uploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_upload_bytes_total",
+		Help: "Bytes written to the uploads directory.",
+	})
+	sseClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_sse_clients",
+		Help: "Currently connected /api/stream clients across all rooms.",
+	})
+	rejectedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_sse_rejected_clients_total",
+		Help: "Stream connections refused because a room hit MAX_CLIENTS.",
+	})
+	droppedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_sse_dropped_messages_total",
+		Help: "Broadcasts not delivered because a stream client fell behind.",
+	})
+	evictedClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_sse_evicted_clients_total",
+		Help: "Stream clients disconnected after SSE_MAX_DROPS consecutive dropped messages.",
+	})
+	feedbackDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "relay_feedback_duration_seconds",
+		Help:    "Time spent handling /api/feedback requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// multipartImageTypes maps accepted image part content types to extensions.
+var multipartImageTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpg",
+}
+
+// maxMultipartField bounds the text fields of a multipart upload.
+const maxMultipartField = 1 << 20
+
+// handleFeedbackMultipart is the binary-friendly twin of handleFeedback. It
+// reads multipart/form-data with a "feedback" field, optional "meta" (JSON),
+// "timestamp" and repeated "tags" fields, and an "image" file part that is streamed straight
+// to disk rather than buffered. The image is stored, under an upload slot,
+// only once every field has been read and validated, so a rejected request
+// leaves nothing behind. Large images report their progress to the room's
+// viewers as they arrive (see uploadProgress); meta.silent must then come
+// before the image part to keep them quiet.
+func handleFeedbackMultipart(maxBytes int64, rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timer := prometheus.NewTimer(feedbackDuration)
+		defer timer.ObserveDuration()
+
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		if !claimRoomCode(w, r, room) {
+			return
+		}
+
+		progress := newUploadProgress(r.ContentLength, room)
+		defer progress.finish(false)
+		r.Body = progress.wrap(http.MaxBytesReader(w, r.Body, maxBytes))
+		reader, err := r.MultipartReader()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_multipart", "expected a multipart/form-data body")
+			return
+		}
+
+		var (
+			feedback  string
+			meta      map[string]interface{}
+			timestamp json.RawMessage
+			rawTags   []string
+			spool     *spooledScreenshot
+		)
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				writeMultipartError(w, err, "invalid multipart body")
+				return
+			}
+
+			switch part.FormName() {
+			case "feedback":
+				feedback, err = readPartValue(part)
+			case "timestamp":
+				var value string
+				if value, err = readPartValue(part); err == nil {
+					timestamp = timestampField(value)
+				}
+			case "tags":
+				var value string
+				if value, err = readPartValue(part); err == nil {
+					rawTags = append(rawTags, value)
+				}
+			case "meta":
+				var value string
+				if value, err = readPartValue(part); err == nil && value != "" {
+					if jsonErr := json.Unmarshal([]byte(value), &meta); jsonErr != nil {
+						writeJSONError(w, http.StatusBadRequest, "invalid_meta", "meta must be a JSON object")
+						return
+					}
+					if meta, err = rooms.meta.sanitize(meta); err != nil {
+						writeJSONError(w, http.StatusBadRequest, "invalid_meta", err.Error())
+						return
+					}
+				}
+			case "image":
+				if spool != nil {
+					writeJSONError(w, http.StatusBadRequest, "invalid_multipart", "only one image part is allowed")
+					return
+				}
+				contentType := strings.TrimSpace(strings.Split(part.Header.Get("Content-Type"), ";")[0])
+				ext, ok := multipartImageTypes[strings.ToLower(contentType)]
+				if !ok {
+					writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("unsupported image content type %q: use image/png or image/jpeg", contentType))
+					return
+				}
+				if silent, _ := meta["silent"].(bool); !silent {
+					progress.start()
+				}
+				// Only spool it for now: a slow client then holds a
+				// temporary file rather than an upload slot while it sends,
+				// and nothing is stored until the rest of the form checks out.
+				if spool, err = spoolScreenshot(rooms.blobs, room.uploadDir, ext, part); err == nil {
+					defer spool.remove()
+				}
+			default:
+				_, err = io.Copy(io.Discard, part)
+			}
+			part.Close()
+			if err != nil {
+				writeMultipartError(w, err, fmt.Sprintf("invalid %s field: %v", part.FormName(), err))
+				return
+			}
+		}
+
+		if strings.TrimSpace(feedback) == "" {
+			writeJSONError(w, http.StatusBadRequest, "feedback_required", "feedback is required")
+			return
+		}
+		if feedback, err = rooms.text.clean(feedback); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "feedback_too_long", err.Error())
+			return
+		}
+		if spool == nil && !isAudioMode(meta) {
+			writeJSONError(w, http.StatusBadRequest, "image_required", "image is required")
+			return
+		}
+		tags, err := normalizeTags(rawTags)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+			return
+		}
+		normalized, err := normalizeTimestamp(timestamp, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_timestamp", err.Error())
+			return
+		}
+
+		var upload *storedUpload
+		if spool != nil {
+			release, err := rooms.uploadSlots.acquire(r.Context())
+			if err != nil {
+				writeUploadsBusy(w)
+				return
+			}
+			upload, err = persistSpooled(rooms.blobs, room.uploadDir, spool, rooms.uploads, rooms.screenshots.forMeta(meta))
+			release()
+			if err != nil {
+				writeMultipartError(w, err, fmt.Sprintf("invalid image field: %v", err))
+				return
+			}
+		}
+
+		payload := newFeedbackPayload(room, rooms.blobs, feedback, normalized, meta, upload, "")
+		payload.Tags = tags
+		progress.finish(true)
+		publishFeedback(w, r, room, payload, rooms.webhook)
+	}
+}
+
+func readPartValue(part io.Reader) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxMultipartField+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxMultipartField {
+		return "", fmt.Errorf("field exceeds %d bytes", maxMultipartField)
+	}
+	return string(value), nil
+}
+
+// timestampField adapts a form value to what normalizeTimestamp expects:
+// digits are unix milliseconds, anything else a timestamp string.
+func timestampField(value string) json.RawMessage {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return json.RawMessage(value)
+	}
+	quoted, _ := json.Marshal(value)
+	return quoted
+}
+
+func writeMultipartError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTooLarge(w, tooLarge.Limit)
+		return
+	}
+	var storage *storageError
+	if errors.As(err, &storage) {
+		writeUploadError(w, err, "", "")
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "invalid_multipart", message)
+}
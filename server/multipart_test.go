@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storedFiles lists the regular files under dir, temporaries included.
+func storedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestMultipartRejectionStoresNothing(t *testing.T) {
+	img := testPNG(t, 8, 8)
+	for _, tc := range []struct {
+		name   string
+		fields []string
+		code   string
+	}{
+		{"no feedback", nil, "feedback_required"},
+		{"bad tag", []string{"feedback", "hi", "tags", "not a tag"}, "invalid_tags"},
+		{"bad timestamp", []string{"feedback", "hi", "timestamp", "yesterday"}, "invalid_timestamp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := newRoomRegistry(t.TempDir(), 10, false)
+			reg.screenshots.thumbnailSize = 4
+			var body bytes.Buffer
+			req := httptest.NewRequest(http.MethodPost, "/api/feedback/multipart", &body)
+			req.Header.Set("Content-Type", writeMultipartFeedback(t, &body, img, tc.fields...))
+			rec := httptest.NewRecorder()
+			handleFeedbackMultipart(10<<20, reg)(rec, req)
+
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.code) {
+				t.Errorf("response = %d %s, want 400 %s", rec.Code, rec.Body, tc.code)
+			}
+			if files := storedFiles(t, reg.uploadDir); len(files) != 0 {
+				t.Errorf("rejected upload left %v behind", files)
+			}
+		})
+	}
+}
+
+func TestFeedbackRejectionRemovesEarlierImages(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.screenshots.thumbnailSize = 4
+	body, _ := json.Marshal(map[string]interface{}{
+		"feedback": "two shots",
+		"images":   []string{pngDataURL(testPNG(t, 8, 8)), "data:image/png;base64,bm90IGEgcG5n"},
+		"audio":    "data:audio/webm;base64,!!!",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/feedback", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleFeedback(10<<20, reg)(rec, req)
+
+	if rec.Code < 400 {
+		t.Fatalf("response = %d %s, want an error", rec.Code, rec.Body)
+	}
+	if files := storedFiles(t, reg.uploadDir); len(files) != 0 {
+		t.Errorf("rejected feedback left %v behind", files)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// handleEventsNDJSON serves GET /api/events.ndjson: the room's retained
+// history, oldest first, followed by live events as they are broadcast, one
+// JSON object per line with no SSE framing, for `curl | jq` and log
+// shippers. ?follow=0 stops after the history; ?types= filters like
+// /api/stream.
+func handleEventsNDJSON(rooms *roomRegistry, buffer int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		follow := r.URL.Query().Get("follow") != "0"
+		filter := parseTypeFilter(r)
+
+		// Subscribe before reading history so nothing stored in between is
+		// lost; anything already written is skipped by sequence below.
+		var client *client
+		if follow {
+			client = newClient(buffer, false)
+			client.id = middleware.GetReqID(r.Context())
+			client.observer = true // a log consumer is not a viewer
+			if !room.broker.addClient(client) {
+				rejectFullRoom(w, room)
+				return
+			}
+			defer room.broker.removeClient(client)
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		flusher, _ := w.(http.Flusher)
+		writeLine := func(msg message) bool {
+			if _, err := w.Write(append(msg.data, '\n')); err != nil {
+				return false
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return true
+		}
+
+		var lastSent uint64
+		history, _ := room.state.since(0)
+		for _, msg := range history {
+			if !filter.allows(msg) {
+				continue
+			}
+			if !writeLine(msg) {
+				return
+			}
+			lastSent = msg.id
+		}
+		if !follow {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush() // send headers even when history is empty
+		}
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg, ok := <-client.ch:
+				if !ok {
+					return // the broker gave up on this client
+				}
+				if msg.id != 0 && msg.id <= lastSent {
+					continue
+				}
+				if !filter.allows(msg) {
+					continue
+				}
+				if !writeLine(msg) {
+					return
+				}
+				if msg.id != 0 {
+					lastSent = msg.id
+				}
+			}
+		}
+	}
+}
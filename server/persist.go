@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedState is the on-disk form of every room's history (STATE_FILE).
+// Screenshots already live in uploads/, so only payload metadata is kept.
+type savedState struct {
+	SavedAt string                  `json:"savedAt"`
+	Rooms   map[string]roomSnapshot `json:"rooms"`
+}
+
+type roomSnapshot struct {
+	Seq       uint64          `json:"seq"`
+	LatestSeq uint64          `json:"latestSeq"` // 0 when latest was cleared
+	History   []snapshotEntry `json:"history"`   // oldest first
+	Code      string          `json:"code,omitempty"`
+}
+
+type snapshotEntry struct {
+	Seq     uint64           `json:"seq"`
+	EditSeq uint64           `json:"editSeq,omitempty"`
+	Payload *feedbackPayload `json:"payload"`
+}
+
+// snapshot copies the state's history for persisting.
+func (s *state) snapshot() roomSnapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := roomSnapshot{Seq: s.seq, LatestSeq: s.latestSeq}
+	for i := s.size; i >= 1; i-- {
+		entry := s.entryAt(i)
+		snap.History = append(snap.History, snapshotEntry{Seq: entry.seq, EditSeq: entry.editSeq, Payload: entry.payload})
+	}
+	return snap
+}
+
+// restore replaces the state's history with snap, keeping the newest entries
+// if snap holds more than the history buffer does. Sequence numbers carry on
+// from the snapshot so reconnecting viewers' Last-Event-ID still lines up.
+func (s *state) restore(snap roomSnapshot) {
+	entries := snap.History
+	if len(entries) > len(s.history) {
+		entries = entries[len(entries)-len(s.history):]
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.history)
+	s.next, s.size = 0, 0
+	s.latest, s.latestBytes, s.latestSeq = nil, nil, 0
+	s.seq = snap.Seq
+	s.evictedSeq = 0
+	for _, e := range entries {
+		if e.Payload == nil {
+			continue
+		}
+		bytes, _ := json.Marshal(e.Payload)
+		s.history[s.next] = historyEntry{seq: e.Seq, editSeq: e.EditSeq, payload: e.Payload, bytes: bytes}
+		s.next = (s.next + 1) % len(s.history)
+		s.size++
+		s.seq = max(s.seq, e.Seq, e.EditSeq)
+		if e.Seq == snap.LatestSeq {
+			s.latest, s.latestBytes, s.latestSeq = e.Payload, bytes, e.Seq
+			s.latestAt = restoredAt(e.Payload.Timestamp, now)
+		}
+	}
+	// Anything before the oldest restored entry is gone for replay purposes.
+	if s.size > 0 {
+		s.evictedSeq = s.entryAt(s.size).seq - 1
+	} else {
+		s.evictedSeq = s.seq
+	}
+}
+
+// restoredAt stands in for when a restored latest payload was stored, so
+// AUTO_CLEAR_AFTER keeps counting across a restart: its timestamp, or now
+// if that is unreadable or in the future.
+func restoredAt(timestamp string, now time.Time) time.Time {
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil || ts.After(now) {
+		return now
+	}
+	return ts
+}
+
+// saveState writes every room's history to path atomically: a temp file in
+// the same directory is written, synced and renamed over the old one.
+func saveState(path string, reg *roomRegistry) error {
+	reg.mu.Lock()
+	rooms := make(map[string]*roomState, len(reg.rooms))
+	for name, rm := range reg.rooms {
+		rooms[name] = rm
+	}
+	reg.mu.Unlock()
+
+	file := savedState{SavedAt: time.Now().UTC().Format(time.RFC3339), Rooms: make(map[string]roomSnapshot, len(rooms))}
+	for name, rm := range rooms {
+		snap := rm.state.snapshot()
+		rm.codeMu.Lock()
+		snap.Code = rm.code
+		rm.codeMu.Unlock()
+		file.Rooms[name] = snap
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores rooms saved by saveState. A missing file is not an
+// error; a corrupt one is reported so the caller can start empty instead.
+func loadState(path string, reg *roomRegistry) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var file savedState
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("corrupt state file: %w", err)
+	}
+	restored := 0
+	for name, snap := range file.Rooms {
+		rm, err := reg.get(name)
+		if err != nil {
+			log.Printf("skipping saved room %q: %v", name, err)
+			continue
+		}
+		rm.state.restore(snap)
+		if err := rm.claimCode(snap.Code); err != nil {
+			log.Printf("ignoring saved code for room %q: %v", name, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// runStateSaver persists state every interval; main saves once more on
+// shutdown.
+func runStateSaver(ctx context.Context, path string, reg *roomRegistry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := saveState(path, reg); err != nil {
+			log.Printf("failed to save state to %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// pollResponse is what /api/poll returns once something newer than ?after=
+// happened. seq is the value to pass as ?after= on the next poll. type is
+// feedback or audio for a new payload, update for an edit (payload is the
+// edited entry) and clear when viewers should blank their screen (payload
+// is null).
+type pollResponse struct {
+	Seq     uint64          `json:"seq"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// handlePoll is a long-polling fallback for browsers that block SSE and
+// WebSockets. GET /api/poll?after=<seq> answers right away when the room
+// already has something newer than seq, otherwise waits up to hold for it
+// and replies 204 if nothing arrives. A poller that is caught up gets every
+// payload, edit and clear in order; one starting from zero, or so far
+// behind that history has moved on, just gets the current state.
+func handlePoll(rooms *roomRegistry, hold time.Duration, buffer int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		var after uint64
+		if raw := r.URL.Query().Get("after"); raw != "" {
+			if after, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_after", "after must be a non-negative integer")
+				return
+			}
+		}
+
+		// Subscribe before looking at history so a payload stored in between
+		// is not missed. Pollers come and go every request, so they are
+		// observers rather than viewers for presence purposes.
+		client := newClient(buffer, false)
+		client.id = middleware.GetReqID(r.Context())
+		client.observer = true
+		if !room.broker.addClient(client) {
+			rejectFullRoom(w, room)
+			return
+		}
+		defer room.broker.removeClient(client)
+
+		if msg, ok := pendingPoll(room.state, after); ok {
+			writePoll(w, msg)
+			return
+		}
+
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		timer := time.NewTimer(hold)
+		defer timer.Stop()
+		for {
+			select {
+			case msg, ok := <-client.ch:
+				if !ok {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				// Clears are broadcast without a sequence; the state has it.
+				if msg.kind == "clear" {
+					msg.id = room.state.lastClear()
+				}
+				// Controls and presence updates carry no sequence.
+				if msg.id > after && pollable(msg) {
+					writePoll(w, msg)
+					return
+				}
+			case <-timer.C:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// pendingPoll picks what a poll after seq answers with straight away: the
+// oldest newer message for a poller keeping up, or the newest payload or
+// clear, sequenced past everything skipped, for one that is not.
+func pendingPoll(s *state, after uint64) (message, bool) {
+	missed, gapped := s.since(after)
+	if clearSeq := s.lastClear(); clearSeq > after {
+		missed = append(missed, message{id: clearSeq, kind: "clear"})
+		slices.SortFunc(missed, func(a, b message) int { return cmp.Compare(a.id, b.id) })
+	}
+	missed = slices.DeleteFunc(missed, func(msg message) bool { return !pollable(msg) })
+	if len(missed) == 0 {
+		return message{}, false
+	}
+	if after > 0 && !gapped {
+		return missed[0], true
+	}
+	newest := missed[len(missed)-1].id
+	for i := len(missed) - 1; i >= 0; i-- {
+		if msg := missed[i]; msg.kind != "update" {
+			msg.id = newest
+			return msg, true
+		}
+	}
+	// Only edits to payloads the poller never saw; the next poll waits.
+	return message{}, false
+}
+
+// pollable reports whether msg is something a poller is handed: a payload,
+// an edit or a clear. Silent payloads, controls, presence and upload
+// progress are SSE/WebSocket only.
+func pollable(msg message) bool {
+	switch msg.kind {
+	case "feedback", "audio", "update", "clear":
+		return msg.id != 0 && !msg.silent
+	}
+	return false
+}
+
+func writePoll(w http.ResponseWriter, msg message) {
+	resp := pollResponse{Seq: msg.id, Type: msg.kind, Payload: msg.data}
+	switch msg.kind {
+	case "clear":
+		resp.Payload = json.RawMessage("null")
+	case "update":
+		var update struct {
+			Payload json.RawMessage `json:"payload"`
+		}
+		_ = json.Unmarshal(msg.data, &update)
+		resp.Payload = update.Payload
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("failed to encode poll response: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// poll requests /api/poll?after= and decodes any answer.
+func poll(t *testing.T, reg *roomRegistry, after string, hold time.Duration) (int, pollResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handlePoll(reg, hold, 4)(rec, httptest.NewRequest(http.MethodGet, "/api/poll?after="+after, nil))
+	var resp pollResponse
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("poll body %s: %v", rec.Body, err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func seqParam(seq uint64) string {
+	return strconv.FormatUint(seq, 10)
+}
+
+func payloadID(t *testing.T, raw json.RawMessage) string {
+	t.Helper()
+	var p feedbackPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		t.Fatalf("payload %s: %v", raw, err)
+	}
+	return p.ID
+}
+
+func TestPollClearDuringPoll(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	room.state.setLatest(&feedbackPayload{ID: "a", Feedback: "first"})
+
+	_, first := poll(t, reg, "0", time.Second)
+	if first.Type != "feedback" || payloadID(t, first.Payload) != "a" {
+		t.Fatalf("first poll = %+v, want payload a", first)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		handleClearLatest(reg)(rec, httptest.NewRequest(http.MethodDelete, "/api/latest", nil))
+	}()
+	code, cleared := poll(t, reg, seqParam(first.Seq), 5*time.Second)
+	if code != http.StatusOK || cleared.Type != "clear" || string(cleared.Payload) != "null" || cleared.Seq <= first.Seq {
+		t.Fatalf("poll during clear = %d %+v, want a sequenced clear", code, cleared)
+	}
+
+	// A poller that missed the clear, or starts afresh, sees it too.
+	if _, resp := poll(t, reg, seqParam(first.Seq), time.Second); resp.Type != "clear" || resp.Seq != cleared.Seq {
+		t.Errorf("poll after the clear = %+v, want the clear", resp)
+	}
+	if _, resp := poll(t, reg, "0", time.Second); resp.Type != "clear" {
+		t.Errorf("fresh poll after the clear = %+v, want the cleared state", resp)
+	}
+	if code, _ := poll(t, reg, seqParam(cleared.Seq), 50*time.Millisecond); code != http.StatusNoContent {
+		t.Errorf("poll past the clear = %d, want 204", code)
+	}
+}
+
+func TestPollDeliversEditsInOrder(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	first := room.state.setLatest(&feedbackPayload{ID: "a", Feedback: "first"})
+	if _, _, ok := room.state.amend("a", func(p *feedbackPayload) { p.Feedback = "edited" }); !ok {
+		t.Fatal("amend failed")
+	}
+	room.state.setLatest(&feedbackPayload{ID: "b", Feedback: "second"})
+
+	_, edit := poll(t, reg, seqParam(first.id), time.Second)
+	var edited feedbackPayload
+	_ = json.Unmarshal(edit.Payload, &edited)
+	if edit.Type != "update" || edited.ID != "a" || edited.Feedback != "edited" {
+		t.Fatalf("poll after a = %+v, want the edit to a first", edit)
+	}
+	_, next := poll(t, reg, seqParam(edit.Seq), time.Second)
+	if next.Type != "feedback" || payloadID(t, next.Payload) != "b" {
+		t.Errorf("poll after the edit = %+v, want payload b", next)
+	}
+}
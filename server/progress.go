@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// uploadProgressMinBytes is the smallest declared body that gets
+	// progress events; anything smaller arrives before a spinner would show.
+	uploadProgressMinBytes = 256 << 10
+	// uploadProgressInterval throttles progress broadcasts per upload.
+	uploadProgressInterval = 250 * time.Millisecond
+)
+
+// uploadProgress reports a large upload to its room's viewers as
+// {"type":"uploading","progress":F}, at most once per uploadProgressInterval,
+// and ends with {"type":"uploading","done":true} (plus "failed":true if the
+// upload was rejected). Reads only count bytes; the broadcasts come from a
+// goroutine of their own, so the request body is never read more slowly for
+// them. A nil *uploadProgress reports nothing.
+type uploadProgress struct {
+	room  *roomState
+	total int64
+	read  atomic.Int64
+
+	// Owned by the handler goroutine.
+	started  bool
+	finished bool
+
+	kick    chan struct{} // a read happened; buffered, never blocks
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newUploadProgress tracks a body of contentLength bytes, returning nil when
+// it is too small to be worth reporting on.
+func newUploadProgress(contentLength int64, room *roomState) *uploadProgress {
+	if contentLength < uploadProgressMinBytes {
+		return nil
+	}
+	return &uploadProgress{
+		room:    room,
+		total:   contentLength,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// wrap counts the bytes read from body.
+func (p *uploadProgress) wrap(body io.ReadCloser) io.ReadCloser {
+	if p == nil {
+		return body
+	}
+	return &progressBody{ReadCloser: body, progress: p}
+}
+
+// start begins broadcasting. The handler calls it once the image starts to
+// arrive, and not at all for silent feedback, which viewers must not hear
+// about.
+func (p *uploadProgress) start() {
+	if p == nil || p.started {
+		return
+	}
+	p.started = true
+	go p.run()
+}
+
+// finish stops the broadcasts and sends the closing event. Later calls do
+// nothing, so a handler can defer finish(false) and call finish(true) on
+// success.
+func (p *uploadProgress) finish(ok bool) {
+	if p == nil || !p.started || p.finished {
+		return
+	}
+	p.finished = true
+	close(p.stop)
+	<-p.stopped
+	data := `{"type":"uploading","done":true}`
+	if !ok {
+		data = `{"type":"uploading","done":true,"failed":true}`
+	}
+	p.room.broker.broadcast(message{kind: "uploading", data: []byte(data)})
+}
+
+func (p *uploadProgress) run() {
+	defer close(p.stopped)
+	var last time.Time
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.kick:
+		}
+		if wait := uploadProgressInterval - time.Since(last); wait > 0 {
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+		progress := min(float64(p.read.Load())/float64(p.total), 1)
+		p.room.broker.broadcast(message{kind: "uploading", data: []byte(fmt.Sprintf(`{"type":"uploading","progress":%.2f}`, progress))})
+	}
+}
+
+// progressBody counts the bytes read from a request body.
+type progressBody struct {
+	io.ReadCloser
+	progress *uploadProgress
+}
+
+func (b *progressBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if n > 0 {
+		b.progress.read.Add(int64(n))
+		select {
+		case b.progress.kick <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// noisyPNG is a PNG too random to compress below uploadProgressMinBytes.
+func noisyPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() < uploadProgressMinBytes {
+		t.Fatalf("noisy PNG is only %d bytes", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// slowReader pauses once halfway through its data, so an upload is in
+// flight long enough to report progress.
+type slowReader struct {
+	data   []byte
+	pause  time.Duration
+	read   int
+	paused bool
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	half := len(r.data) / 2
+	if r.read >= len(r.data) {
+		return 0, io.EOF
+	}
+	if r.read >= half && !r.paused {
+		r.paused = true
+		time.Sleep(r.pause)
+	}
+	end := len(r.data)
+	if r.read < half {
+		end = half
+	}
+	n := copy(p, r.data[r.read:end])
+	r.read += n
+	return n, nil
+}
+
+// uploadEvents posts a multipart body to a room with one viewer and returns
+// the "uploading" events and the type of the last message the viewer got.
+func uploadEvents(t *testing.T, img []byte, fields ...string) (events []map[string]interface{}, last string) {
+	t.Helper()
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	viewer := newClient(256, false)
+	room.broker.addClient(viewer)
+
+	var body bytes.Buffer
+	contentType := writeMultipartFeedback(t, &body, img, fields...)
+	req := httptest.NewRequest(http.MethodPost, "/api/feedback/multipart", &slowReader{data: body.Bytes(), pause: 2 * uploadProgressInterval})
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = int64(body.Len())
+	handleFeedbackMultipart(10<<20, reg)(httptest.NewRecorder(), req)
+	room.broker.removeClient(viewer)
+
+	for msg := range viewer.ch {
+		last = msg.kind
+		if msg.kind != "uploading" {
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal(msg.data, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events, last
+}
+
+func TestUploadProgressEndsWithDone(t *testing.T) {
+	events, last := uploadEvents(t, noisyPNG(t), "feedback", "big one")
+	if len(events) < 2 {
+		t.Fatalf("got %d uploading events, want progress and then done", len(events))
+	}
+	if _, ok := events[0]["progress"]; !ok {
+		t.Errorf("first event = %v, want a progress report", events[0])
+	}
+	if end := events[len(events)-1]; end["done"] != true || end["failed"] != nil {
+		t.Errorf("last uploading event = %v, want done without failed", end)
+	}
+	if last != "feedback" {
+		t.Errorf("last message was %q, want the feedback after the done event", last)
+	}
+}
+
+func TestUploadProgressReportsFailure(t *testing.T) {
+	events, _ := uploadEvents(t, noisyPNG(t), "tags", "not a tag")
+	if len(events) == 0 {
+		t.Fatal("rejected upload sent no uploading events")
+	}
+	if end := events[len(events)-1]; end["done"] != true || end["failed"] != true {
+		t.Errorf("last uploading event = %v, want done and failed", end)
+	}
+}
+
+func TestSilentUploadSendsNoProgress(t *testing.T) {
+	events, _ := uploadEvents(t, noisyPNG(t), "meta", `{"silent":true}`, "feedback", "quiet")
+	if len(events) != 0 {
+		t.Errorf("silent upload sent %v", events)
+	}
+}
@@ -1,227 +1,362 @@
-import { marked } from './vendor/marked.esm.js';
-
-marked.setOptions({
-  breaks: true,
-  gfm: true,
-  headerIds: false,
-  mangle: false,
-});
-
-const state = {
-  eventSource: null,
-  reconnectDelay: 2000,
-  reconnectTimer: null,
-  lastId: null,
-};
-
-const screenshotEl = document.getElementById('screenshot');
-const feedbackEl = document.getElementById('feedback');
-const connectionEl = document.getElementById('connection');
-const lastUpdateEl = document.getElementById('last-update');
-const pingAudio = document.getElementById('ping');
-
-const qrCard = document.getElementById('qr-card');
-const qrImage = document.getElementById('qr-image');
-const primaryUrlEl = document.getElementById('primary-url');
-const urlListEl = document.getElementById('url-list');
-let activeAccessUrl = null;
-
-const ALLOWED_TAGS = new Set([
-  'p',
-  'strong',
-  'em',
-  'ul',
-  'ol',
-  'li',
-  'code',
-  'pre',
-  'blockquote',
-  'a',
-  'br',
-  'hr',
-  'h1',
-  'h2',
-  'h3',
-  'h4',
-  'h5',
-  'h6',
-]);
-
-const ALLOWED_ATTRS = {
-  a: ['href', 'title', 'target', 'rel'],
-  code: [],
-  pre: [],
-};
-
-const SAFE_URL_PATTERN = /^(https?:|mailto:)/i;
-
-function sanitizeHtml(input) {
-  if (!input) return '';
-  const doc = new DOMParser().parseFromString(input, 'text/html');
-  const elements = Array.from(doc.body.querySelectorAll('*'));
-
-  elements.forEach((el) => {
-    const tag = el.tagName.toLowerCase();
-    if (!ALLOWED_TAGS.has(tag)) {
-      const parent = el.parentNode;
-      if (!parent) {
-        el.remove();
-        return;
-      }
-      while (el.firstChild) {
-        parent.insertBefore(el.firstChild, el);
-      }
-      parent.removeChild(el);
-      return;
-    }
-
-    Array.from(el.attributes).forEach((attr) => {
-      const name = attr.name.toLowerCase();
-      if (name.startsWith('on')) {
-        el.removeAttribute(attr.name);
-        return;
-      }
-
-      const allowed = ALLOWED_ATTRS[tag] || [];
-      if (!allowed.includes(name)) {
-        el.removeAttribute(attr.name);
-        return;
-      }
-
-      if ((name === 'href' || name === 'src') && !SAFE_URL_PATTERN.test(attr.value)) {
-        el.removeAttribute(attr.name);
-        return;
-      }
-
-      if (tag === 'a' && name === 'target' && attr.value === '_blank' && !el.hasAttribute('rel')) {
-        el.setAttribute('rel', 'noopener noreferrer');
-      }
-    });
-  });
-
-  return doc.body.innerHTML;
-}
-
-function renderMarkdownSafe(content) {
-  if (!content) return '';
-  const rawHtml = marked.parse(content);
-  return sanitizeHtml(rawHtml);
-}
-
-function setConnection(status, text) {
-  connectionEl.classList.remove('chip-success', 'chip-warning', 'chip-error');
-  connectionEl.classList.add(`chip-${status}`);
-  connectionEl.textContent = text;
-}
-
-function renderFeedback(payload, playTone = true) {
-  if (!payload) return;
-
-  if (payload.id && payload.id === state.lastId) {
-    return;
-  }
-
-  state.lastId = payload.id;
-
-  if (payload.screenshotUrl) {
-    const cacheBust = `?t=${payload.id || Date.now()}`;
-    screenshotEl.src = `${payload.screenshotUrl}${cacheBust}`;
-    screenshotEl.alt = `Screenshot @ ${payload.timestamp}`;
-    screenshotEl.classList.add('visible');
-  }
-
-  feedbackEl.innerHTML = '';
-  const content = String(payload.feedback || '').trim();
-  if (!content) {
-    feedbackEl.textContent = 'Feedback payload was empty.';
-  } else {
-    const rendered = renderMarkdownSafe(content);
-    if (rendered) {
-      feedbackEl.innerHTML = rendered;
-    } else {
-      const paragraph = document.createElement('p');
-      paragraph.textContent = content;
-      feedbackEl.appendChild(paragraph);
-    }
-  }
-
-  const timeline = document.createElement('small');
-  timeline.className = 'timestamp';
-  timeline.textContent = new Date(payload.timestamp || Date.now()).toLocaleString();
-  feedbackEl.appendChild(timeline);
-
-  if (payload.meta && Object.keys(payload.meta).length > 0) {
-    const details = document.createElement('div');
-    details.className = 'meta';
-
-    Object.entries(payload.meta).forEach(([key, value]) => {
-      const row = document.createElement('div');
-      row.innerHTML = `<span>${key}</span><strong>${value}</strong>`;
-      details.appendChild(row);
-    });
-
-    feedbackEl.appendChild(details);
-  }
-
-  lastUpdateEl.textContent = timeline.textContent;
-
-  if (playTone) {
-    pingAudio.currentTime = 0;
-    pingAudio.play().catch(() => {});
-  }
-}
-
-async function fetchLatestFallback() {
-  try {
-    const res = await fetch('/api/latest');
-    if (!res.ok) return;
-    const payload = await res.json();
-    renderFeedback(payload, false);
-  } catch {
-    // ignore; SSE will deliver when available
-  }
-}
-
-function scheduleReconnect() {
-  if (state.reconnectTimer) return;
-  state.reconnectTimer = setTimeout(() => {
-    state.reconnectTimer = null;
-    connectStream();
-  }, state.reconnectDelay);
-}
-
+import { marked } from './vendor/marked.esm.js';
+
+marked.setOptions({
+  breaks: true,
+  gfm: true,
+  headerIds: false,
+  mangle: false,
+});
+
+const state = {
+  eventSource: null,
+  reconnectDelay: 2000,
+  reconnectTimer: null,
+  lastId: null,
+  lastEventId: null,
+  uploadTimer: null,
+};
+
+const pageParams = new URLSearchParams(window.location.search);
+const viewerToken = pageParams.get('token');
+const roomName = pageParams.get('room');
+const roomCode = pageParams.get('code');
+
+// apiUrl carries the page's ?room=, ?code= and ?token= over to API requests.
+function apiUrl(path) {
+  const params = new URLSearchParams();
+  if (roomName) params.set('room', roomName);
+  if (roomCode) params.set('code', roomCode);
+  if (viewerToken) params.set('token', viewerToken);
+  const query = params.toString();
+  if (!query) return path;
+  const separator = path.includes('?') ? '&' : '?';
+  return `${path}${separator}${query}`;
+}
+
+// uploadSrc carries the page's ?code= over to same-origin upload URLs, which
+// a protected room's /uploads/ requires, along with any extra params. Other
+// origins (S3_PUBLIC_URL, presigned URLs) are left exactly as given.
+function uploadSrc(url, params = {}) {
+  const target = new URL(url, window.location.href);
+  if (target.origin !== window.location.origin) return url;
+  if (roomCode) target.searchParams.set('code', roomCode);
+  Object.entries(params).forEach(([key, value]) => target.searchParams.set(key, value));
+  return target.toString();
+}
+
+const screenshotEl = document.getElementById('screenshot');
+const feedbackEl = document.getElementById('feedback');
+const connectionEl = document.getElementById('connection');
+const lastUpdateEl = document.getElementById('last-update');
+const pingAudio = document.getElementById('ping');
+const uploadStatusEl = document.getElementById('upload-status');
+const uploadProgressEl = document.getElementById('upload-progress');
+
+const qrCard = document.getElementById('qr-card');
+const qrImage = document.getElementById('qr-image');
+const primaryUrlEl = document.getElementById('primary-url');
+const urlListEl = document.getElementById('url-list');
+let activeAccessUrl = null;
+
+const ALLOWED_TAGS = new Set([
+  'p',
+  'strong',
+  'em',
+  'ul',
+  'ol',
+  'li',
+  'code',
+  'pre',
+  'blockquote',
+  'a',
+  'br',
+  'hr',
+  'h1',
+  'h2',
+  'h3',
+  'h4',
+  'h5',
+  'h6',
+]);
+
+const ALLOWED_ATTRS = {
+  a: ['href', 'title', 'target', 'rel'],
+  code: [],
+  pre: [],
+};
+
+const SAFE_URL_PATTERN = /^(https?:|mailto:)/i;
+
+function sanitizeHtml(input) {
+  if (!input) return '';
+  const doc = new DOMParser().parseFromString(input, 'text/html');
+  const elements = Array.from(doc.body.querySelectorAll('*'));
+
+  elements.forEach((el) => {
+    const tag = el.tagName.toLowerCase();
+    if (!ALLOWED_TAGS.has(tag)) {
+      const parent = el.parentNode;
+      if (!parent) {
+        el.remove();
+        return;
+      }
+      while (el.firstChild) {
+        parent.insertBefore(el.firstChild, el);
+      }
+      parent.removeChild(el);
+      return;
+    }
+
+    Array.from(el.attributes).forEach((attr) => {
+      const name = attr.name.toLowerCase();
+      if (name.startsWith('on')) {
+        el.removeAttribute(attr.name);
+        return;
+      }
+
+      const allowed = ALLOWED_ATTRS[tag] || [];
+      if (!allowed.includes(name)) {
+        el.removeAttribute(attr.name);
+        return;
+      }
+
+      if ((name === 'href' || name === 'src') && !SAFE_URL_PATTERN.test(attr.value)) {
+        el.removeAttribute(attr.name);
+        return;
+      }
+
+      if (tag === 'a' && name === 'target' && attr.value === '_blank' && !el.hasAttribute('rel')) {
+        el.setAttribute('rel', 'noopener noreferrer');
+      }
+    });
+  });
+
+  return doc.body.innerHTML;
+}
+
+function renderMarkdownSafe(content) {
+  if (!content) return '';
+  const rawHtml = marked.parse(content);
+  return sanitizeHtml(rawHtml);
+}
+
+function setConnection(status, text) {
+  connectionEl.classList.remove('chip-success', 'chip-warning', 'chip-error');
+  connectionEl.classList.add(`chip-${status}`);
+  connectionEl.textContent = text;
+}
+
+// showUploadProgress reflects an {"type":"uploading"} event. The relay
+// ends every upload with a done event; should that be missed, e.g. across
+// a reconnect, the indicator hides itself once the upload goes quiet.
+function showUploadProgress(progress) {
+  uploadProgressEl.textContent = `${Math.round(progress * 100)}%`;
+  uploadStatusEl.hidden = false;
+  clearTimeout(state.uploadTimer);
+  state.uploadTimer = setTimeout(hideUploadProgress, 10000);
+}
+
+function hideUploadProgress() {
+  clearTimeout(state.uploadTimer);
+  state.uploadTimer = null;
+  uploadStatusEl.hidden = true;
+}
+
+function renderFeedback(payload, playTone = true) {
+  if (!payload) return;
+
+  if (payload.id && payload.id === state.lastId) {
+    return;
+  }
+
+  hideUploadProgress();
+
+  state.lastId = payload.id;
+
+  if (payload.screenshotUrl) {
+    // Identical screenshots share a file and hash, so keying on sha256 lets
+    // the browser reuse what it already downloaded.
+    screenshotEl.src = uploadSrc(payload.screenshotUrl, { t: payload.sha256 || payload.id || Date.now() });
+    screenshotEl.alt = `Screenshot @ ${payload.timestamp}`;
+    screenshotEl.classList.add('visible');
+  }
+
+  feedbackEl.innerHTML = '';
+  const content = String(payload.feedback || '').trim();
+  if (!content) {
+    feedbackEl.textContent = 'Feedback payload was empty.';
+  } else {
+    const rendered = renderMarkdownSafe(content);
+    if (rendered) {
+      feedbackEl.innerHTML = rendered;
+    } else {
+      const paragraph = document.createElement('p');
+      paragraph.textContent = content;
+      feedbackEl.appendChild(paragraph);
+    }
+  }
+
+  if (Array.isArray(payload.screenshots) && payload.screenshots.length > 1) {
+    // Several screens sent together: the first is shown above, the rest can
+    // be swapped in from this strip.
+    const gallery = document.createElement('div');
+    gallery.className = 'gallery';
+    payload.screenshots.forEach((shot, index) => {
+      const thumb = document.createElement('img');
+      thumb.src = uploadSrc(shot.thumbnailUrl || shot.url);
+      thumb.alt = `Screenshot ${index + 1}`;
+      thumb.addEventListener('click', () => {
+        screenshotEl.src = uploadSrc(shot.url);
+        screenshotEl.alt = `Screenshot ${index + 1} @ ${payload.timestamp}`;
+      });
+      gallery.appendChild(thumb);
+    });
+    feedbackEl.appendChild(gallery);
+  }
+
+  if (payload.audioUrl) {
+    const player = document.createElement('audio');
+    player.controls = true;
+    player.preload = 'none';
+    player.src = uploadSrc(payload.audioUrl);
+    feedbackEl.appendChild(player);
+  }
+
+  if (Array.isArray(payload.tags) && payload.tags.length > 0) {
+    const tags = document.createElement('div');
+    tags.className = 'tags';
+    payload.tags.forEach((tag) => {
+      const chip = document.createElement('span');
+      chip.className = 'tag';
+      chip.dataset.tag = tag;
+      chip.textContent = tag;
+      tags.appendChild(chip);
+    });
+    feedbackEl.appendChild(tags);
+  }
+
+  const timeline = document.createElement('small');
+  timeline.className = 'timestamp';
+  timeline.textContent = new Date(payload.timestamp || Date.now()).toLocaleString();
+  feedbackEl.appendChild(timeline);
+
+  if (payload.meta && Object.keys(payload.meta).length > 0) {
+    const details = document.createElement('div');
+    details.className = 'meta';
+
+    Object.entries(payload.meta).forEach(([key, value]) => {
+      const row = document.createElement('div');
+      row.innerHTML = `<span>${key}</span><strong>${value}</strong>`;
+      details.appendChild(row);
+    });
+
+    feedbackEl.appendChild(details);
+  }
+
+  lastUpdateEl.textContent = timeline.textContent;
+
+  if (playTone) {
+    pingAudio.currentTime = 0;
+    pingAudio.play().catch(() => {});
+  }
+}
+
+function clearFeedback() {
+  state.lastId = null;
+  hideUploadProgress();
+  screenshotEl.removeAttribute('src');
+  screenshotEl.classList.remove('visible');
+  feedbackEl.innerHTML = '<p>Feedback cleared. Waiting for the next screenshot.</p>';
+}
+
+async function fetchLatestFallback() {
+  try {
+    const res = await fetch(apiUrl('api/latest'));
+    if (!res.ok) return;
+    const payload = await res.json();
+    renderFeedback(payload, false);
+  } catch {
+    // ignore; SSE will deliver when available
+  }
+}
+
+function scheduleReconnect() {
+  if (state.reconnectTimer) return;
+  state.reconnectTimer = setTimeout(() => {
+    state.reconnectTimer = null;
+    connectStream();
+  }, state.reconnectDelay);
+}
+
 function connectStream() {
-  if (state.eventSource) {
-    state.eventSource.close();
-  }
-
-  setConnection('warning', 'Connecting…');
-  state.eventSource = new EventSource('/api/stream');
-
-  state.eventSource.onopen = () => {
-    setConnection('success', 'Live');
-    state.reconnectDelay = 2000;
-  };
-
+  if (state.eventSource) {
+    state.eventSource.close();
+  }
+
+  setConnection('warning', 'Connecting…');
+  // A fresh EventSource does not resend Last-Event-ID, so pass it along
+  // explicitly to replay anything missed while disconnected.
+  const streamPath = state.lastEventId
+    ? `api/stream?lastEventId=${encodeURIComponent(state.lastEventId)}`
+    : 'api/stream';
+  state.eventSource = new EventSource(apiUrl(streamPath));
+
+  state.eventSource.onopen = () => {
+    setConnection('success', 'Live');
+    state.reconnectDelay = 2000;
+  };
+
   state.eventSource.onmessage = (event) => {
+    if (event.lastEventId) {
+      state.lastEventId = event.lastEventId;
+    }
     try {
       const payload = JSON.parse(event.data);
       if (payload && payload.type === 'control') {
         handleControl(payload);
         return;
       }
+      if (payload && payload.type === 'clear') {
+        clearFeedback();
+        return;
+      }
+      if (payload && payload.type === 'presence') {
+        return;
+      }
+      if (payload && payload.type === 'uploading') {
+        if (payload.done) {
+          hideUploadProgress();
+        } else {
+          showUploadProgress(payload.progress);
+        }
+        return;
+      }
+      if (payload && payload.type === 'update') {
+        // Only the feedback on screen needs redrawing; older edits show up
+        // in history.
+        if (payload.payload && payload.payload.id === state.lastId) {
+          state.lastId = null;
+          renderFeedback(payload.payload, false);
+        }
+        return;
+      }
       renderFeedback(payload, true);
     } catch (error) {
       console.error('Failed to parse payload', error);
     }
   };
-
-  state.eventSource.onerror = () => {
-    setConnection('error', 'Reconnecting…');
-    state.eventSource.close();
-    state.reconnectDelay = Math.min(state.reconnectDelay * 1.5, 15000);
-    scheduleReconnect();
-  };
+
+  state.eventSource.addEventListener('reset', () => {
+    // The server no longer has everything we missed; resync from latest.
+    fetchLatestFallback();
+  });
+
+  state.eventSource.onerror = () => {
+    setConnection('error', 'Reconnecting…');
+    state.eventSource.close();
+    state.reconnectDelay = Math.min(state.reconnectDelay * 1.5, 15000);
+    scheduleReconnect();
+  };
 }
 
 function handleControl(payload) {
@@ -230,78 +365,88 @@ function handleControl(payload) {
   if (!Number.isFinite(delta) || delta === 0) return;
   const clamped = Math.max(-2000, Math.min(2000, delta));
   window.scrollBy({ top: clamped, behavior: 'smooth' });
+  acknowledgeControl(payload.id);
 }
-
-window.addEventListener('visibilitychange', () => {
-  if (document.visibilityState === 'visible' && !state.eventSource) {
-    connectStream();
-  }
-});
-
-fetchLatestFallback();
-connectStream();
-
-function setAccessUrl(url) {
-  if (!url) return;
-  activeAccessUrl = url;
-
-  if (qrImage) {
-    qrImage.src = `/api/qr?target=${encodeURIComponent(url)}`;
-    qrImage.alt = `QR code for ${url}`;
-  }
-
-  if (primaryUrlEl) {
-    primaryUrlEl.textContent = url;
-    primaryUrlEl.href = url;
-  }
-
-  if (urlListEl) {
-    urlListEl.querySelectorAll('button').forEach((button) => {
-      button.classList.toggle('active', button.dataset.url === url);
-    });
-  }
-
-  if (qrCard) {
-    qrCard.hidden = false;
-  }
-}
-
-async function hydrateAccessInfo() {
-  if (!qrCard || !urlListEl) return;
-
-  try {
-    const res = await fetch('/api/info');
-    if (!res.ok) throw new Error('info request failed');
-
-    const data = await res.json();
-    const urls = Array.isArray(data.urls) ? data.urls : [];
-
-    urlListEl.innerHTML = '';
-
-    if (urls.length === 0) {
-      urlListEl.textContent = 'Connect laptop & phone to the same Wi-Fi network.';
-      qrCard.hidden = false;
-      return;
-    }
-
-    urls.forEach((url) => {
-      const button = document.createElement('button');
-      button.type = 'button';
-      button.className = 'url-pill';
-      button.textContent = url;
-      button.dataset.url = url;
-      button.addEventListener('click', () => setAccessUrl(url));
-      urlListEl.appendChild(button);
-    });
-
-    const initial = activeAccessUrl && urls.includes(activeAccessUrl) ? activeAccessUrl : urls[0];
-    setAccessUrl(initial);
-  } catch (error) {
-    console.error('Failed to load LAN URLs', error);
-    urlListEl.textContent = 'Unable to detect LAN address automatically.';
-    qrCard.hidden = false;
-  }
-}
-
-hydrateAccessInfo();
-
+
+function acknowledgeControl(id) {
+  if (!id) return;
+  fetch(apiUrl('api/control/ack'), {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ id }),
+  }).catch((error) => console.warn('Failed to acknowledge control', error));
+}
+
+window.addEventListener('visibilitychange', () => {
+  if (document.visibilityState === 'visible' && !state.eventSource) {
+    connectStream();
+  }
+});
+
+fetchLatestFallback();
+connectStream();
+
+function setAccessUrl(url) {
+  if (!url) return;
+  activeAccessUrl = url;
+
+  if (qrImage) {
+    qrImage.src = `api/qr?target=${encodeURIComponent(url)}`;
+    qrImage.alt = `QR code for ${url}`;
+  }
+
+  if (primaryUrlEl) {
+    primaryUrlEl.textContent = url;
+    primaryUrlEl.href = url;
+  }
+
+  if (urlListEl) {
+    urlListEl.querySelectorAll('button').forEach((button) => {
+      button.classList.toggle('active', button.dataset.url === url);
+    });
+  }
+
+  if (qrCard) {
+    qrCard.hidden = false;
+  }
+}
+
+async function hydrateAccessInfo() {
+  if (!qrCard || !urlListEl) return;
+
+  try {
+    const res = await fetch('api/info');
+    if (!res.ok) throw new Error('info request failed');
+
+    const data = await res.json();
+    const urls = Array.isArray(data.urls) ? data.urls : [];
+
+    urlListEl.innerHTML = '';
+
+    if (urls.length === 0) {
+      urlListEl.textContent = 'Connect laptop & phone to the same Wi-Fi network.';
+      qrCard.hidden = false;
+      return;
+    }
+
+    urls.forEach((url) => {
+      const button = document.createElement('button');
+      button.type = 'button';
+      button.className = 'url-pill';
+      button.textContent = url;
+      button.dataset.url = url;
+      button.addEventListener('click', () => setAccessUrl(url));
+      urlListEl.appendChild(button);
+    });
+
+    const initial = activeAccessUrl && urls.includes(activeAccessUrl) ? activeAccessUrl : urls[0];
+    setAccessUrl(initial);
+  } catch (error) {
+    console.error('Failed to load LAN URLs', error);
+    urlListEl.textContent = 'Unable to detect LAN address automatically.';
+    qrCard.hidden = false;
+  }
+}
+
+hydrateAccessInfo();
+
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+
+	// qrLogoFraction is how much of the QR's width a QR_LOGO may cover.
+	// At high error correction about 30% of modules can be lost, so a 20%
+	// square leaves room for a slightly off-centre scan.
+	qrLogoFraction = 0.2
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"low":     qrcode.Low,
+	"medium":  qrcode.Medium,
+	"high":    qrcode.High,
+	"highest": qrcode.Highest,
+}
+
+// qrOptions are the ?format=, ?size= and ?level= knobs of /api/qr.
+type qrOptions struct {
+	format string
+	size   int
+	level  qrcode.RecoveryLevel
+}
+
+func parseQROptions(r *http.Request) (qrOptions, error) {
+	values := r.URL.Query()
+	opts := qrOptions{format: "png", size: defaultQRSize, level: qrcode.Medium}
+
+	switch format := strings.ToLower(values.Get("format")); format {
+	case "":
+	case "png", "svg":
+		opts.format = format
+	default:
+		return opts, fmt.Errorf("unsupported format %q: use png or svg", format)
+	}
+
+	if raw := values.Get("size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return opts, fmt.Errorf("size must be between %d and %d", minQRSize, maxQRSize)
+		}
+		opts.size = size
+	}
+
+	if raw := strings.ToLower(values.Get("level")); raw != "" {
+		level, ok := qrLevels[raw]
+		if !ok {
+			return opts, fmt.Errorf("unsupported level %q: use low, medium, high, or highest", raw)
+		}
+		opts.level = level
+	}
+	return opts, nil
+}
+
+// metadataHosts are cloud instance-metadata names never worth a QR code.
+var metadataHosts = map[string]bool{
+	"metadata":                 true,
+	"metadata.google.internal": true,
+	"instance-data":            true,
+}
+
+// qrTargetPolicy limits what ?target= may point at. By default any http(s)
+// URL is accepted, which suits a trusted LAN; with restrict set, only the
+// server's own URLs and the configured allowlist of origins are.
+type qrTargetPolicy struct {
+	restrict bool
+	allowed  []string
+}
+
+func (p qrTargetPolicy) check(target, scheme, port string) error {
+	if !p.restrict {
+		return nil
+	}
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	origin := parsed.Scheme + "://" + parsed.Host
+	for _, candidate := range append(localBaseURLs(scheme, port), p.allowed...) {
+		if strings.EqualFold(strings.TrimRight(candidate, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not one of this server's URLs", origin)
+}
+
+// loadQRLogo reads the QR_LOGO image. Any format registered with the image
+// package works; PNG with transparency looks best.
+func loadQRLogo(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	logo, _, err := image.Decode(f)
+	return logo, err
+}
+
+// qrWithLogo renders code as a size-pixel PNG with logo centred on a white
+// square covering qrLogoFraction of it.
+func qrWithLogo(code *qrcode.QRCode, size int, logo image.Image) ([]byte, error) {
+	base := code.Image(size)
+	dst := image.NewRGBA(base.Bounds())
+	draw.Draw(dst, dst.Bounds(), base, base.Bounds().Min, draw.Src)
+
+	bounds := dst.Bounds()
+	edge := int(float64(bounds.Dx()) * qrLogoFraction)
+	pad := max(edge/10, 1)
+	center := image.Pt(bounds.Dx()/2, bounds.Dy()/2)
+	backdrop := image.Rect(center.X-edge/2, center.Y-edge/2, center.X+edge/2, center.Y+edge/2)
+	draw.Draw(dst, backdrop, image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	// Fit the logo inside the backdrop, keeping its aspect ratio.
+	inner := backdrop.Inset(pad)
+	lb := logo.Bounds()
+	w, h := inner.Dx(), inner.Dy()
+	if lb.Dx()*h > lb.Dy()*w {
+		h = max(lb.Dy()*w/lb.Dx(), 1)
+	} else {
+		w = max(lb.Dx()*h/lb.Dy(), 1)
+	}
+	target := image.Rect(center.X-w/2, center.Y-h/2, center.X-w/2+w, center.Y-h/2+h)
+	draw.CatmullRom.Scale(dst, target, logo, lb, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleQR serves /api/qr. A non-nil logo is composited onto PNG codes,
+// which are then generated with at least high error correction so the
+// covered modules can be recovered; SVG output is unaffected.
+func handleQR(scheme, port, defaultTarget string, policy qrTargetPolicy, logo image.Image) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseQROptions(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_qr_options", err.Error())
+			return
+		}
+
+		target := strings.TrimSpace(r.URL.Query().Get("target"))
+		if target == "" {
+			if target = qrDefaultTarget(scheme, port, defaultTarget); target == "" {
+				writeJSONError(w, http.StatusNotFound, "no_urls", "no LAN URLs found")
+				return
+			}
+		} else {
+			target, err = sanitizeTarget(target)
+			if err == nil {
+				err = policy.check(target, scheme, port)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid_target", fmt.Sprintf("invalid target: %v", err))
+				return
+			}
+		}
+
+		useLogo := logo != nil && opts.format == "png"
+		if useLogo && opts.level < qrcode.High {
+			opts.level = qrcode.High
+		}
+		code, err := encodeQR(target, opts.level)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, "target_too_long",
+				fmt.Sprintf("target is too long for a QR code (%d bytes); shorten it, e.g. with a URL shortener", len(target)))
+			return
+		}
+		// A logo covers modules that only High recovery can make up for.
+		if code.Level < qrcode.High {
+			useLogo = false
+		}
+
+		var body []byte
+		contentType := "image/png"
+		if opts.format == "svg" {
+			contentType = "image/svg+xml"
+			body = qrSVG(code.Bitmap(), opts.size)
+		} else {
+			if useLogo {
+				body, err = qrWithLogo(code, opts.size, logo)
+			} else {
+				body, err = code.PNG(opts.size)
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "qr_failed", "failed to create QR code")
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(body); err != nil {
+			log.Printf("failed to write QR payload: %v", err)
+		}
+	}
+}
+
+// qrSVG renders a QR bitmap (quiet zone included) as a single SVG path, one
+// unit per module, scaled to size pixels.
+func qrSVG(bitmap [][]bool, size int) []byte {
+	n := len(bitmap)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return []byte(b.String())
+}
+
+// encodeQR builds a QR code for content at level, stepping the recovery
+// level down when content is too long for it, since lower levels hold more
+// data at the largest QR version. It fails only when content does not fit
+// even at Low.
+func encodeQR(content string, level qrcode.RecoveryLevel) (*qrcode.QRCode, error) {
+	for {
+		code, err := qrcode.New(content, level)
+		if err == nil || level == qrcode.Low {
+			return code, err
+		}
+		level--
+	}
+}
+
+// qrDefaultTarget is what /api/qr encodes without ?target=: QR_DEFAULT_TARGET
+// when set, otherwise the first viewer URL, or "" when there is none.
+func qrDefaultTarget(scheme, port, override string) string {
+	if override != "" {
+		return override
+	}
+	if urls := viewerURLs(scheme, port); len(urls) > 0 {
+		return urls[0]
+	}
+	return ""
+}
+
+func sanitizeTarget(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", errors.New("empty target")
+	}
+
+	parsed, err := url.ParseRequestURI(target)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", errors.New("unsupported scheme")
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		return "", errors.New("missing host")
+	}
+	if metadataHosts[host] {
+		return "", errors.New("metadata host")
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()) {
+		return "", errors.New("non-routable address")
+	}
+
+	return parsed.String(), nil
+}
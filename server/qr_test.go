@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// getQR requests /api/qr for target with extra query parameters.
+func getQR(target, extra string) *httptest.ResponseRecorder {
+	query := "target=" + url.QueryEscape(target)
+	if extra != "" {
+		query += "&" + extra
+	}
+	rec := httptest.NewRecorder()
+	handleQR("http", "4000", "", qrTargetPolicy{}, nil)(rec, httptest.NewRequest(http.MethodGet, "/api/qr?"+query, nil))
+	return rec
+}
+
+func TestQRTooLong(t *testing.T) {
+	target := "https://example.com/?q=" + strings.Repeat("a", 4000)
+	rec := getQR(target, "")
+	if rec.Code != http.StatusUnprocessableEntity || errorCode(t, rec) != "target_too_long" {
+		t.Fatalf("long target = %d %s, want 422 target_too_long", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "shorten") {
+		t.Errorf("message %s does not suggest shortening the target", rec.Body)
+	}
+}
+
+func TestQRStepsDownRecoveryLevel(t *testing.T) {
+	// Too long for High recovery, short enough for Low.
+	target := "https://example.com/?q=" + strings.Repeat("a", 2000)
+	if _, err := qrcode.New(target, qrcode.Highest); err == nil {
+		t.Fatal("target fits at Highest; make it longer")
+	}
+	code, err := encodeQR(target, qrcode.Highest)
+	if err != nil {
+		t.Fatalf("encodeQR: %v", err)
+	}
+	if code.Level >= qrcode.Highest {
+		t.Errorf("level = %v, want it stepped down", code.Level)
+	}
+
+	rec := getQR(target, "level=high")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("GET with level=high = %d %s, want a PNG", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
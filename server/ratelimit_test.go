@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterThrottlesAfterBurst(t *testing.T) {
+	const burst = 5
+	limited := newRateLimiter(1, burst).middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/feedback", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		limited.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 1; i <= burst; i++ {
+		if rec := send("192.0.2.1:1000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200 within the burst", i, rec.Code)
+		}
+	}
+	rec := send("192.0.2.1:2000")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request %d = %d, want 429", burst+1, rec.Code)
+	}
+	if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+	}
+	if rec := send("192.0.2.2:1000"); rec.Code != http.StatusOK {
+		t.Errorf("another client = %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimiterRefillsAndEvicts(t *testing.T) {
+	l := newRateLimiter(2, 1)
+	now := time.Now()
+	if ok, _ := l.allow("a", now); !ok {
+		t.Fatal("first request refused")
+	}
+	if ok, wait := l.allow("a", now); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("second request = %v after %s, want refused for up to 500ms", ok, wait)
+	}
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("request after refill refused")
+	}
+
+	l.allow("b", now.Add(10*time.Minute))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle bucket was not evicted")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies(" 10.0.0.0/8, 127.0.0.1 ,::1,192.168.1.77/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128", "192.168.1.0/24"}
+	if len(trusted) != len(want) {
+		t.Fatalf("prefixes = %v, want %v", trusted, want)
+	}
+	for i, prefix := range trusted {
+		if prefix.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+	for _, raw := range []string{"", " , ", "10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies(raw); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestTrustedRealIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.0/8")
+	var seen string
+	handler := trustedRealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+
+	for _, tc := range []struct {
+		name   string
+		peer   string
+		header map[string]string
+		want   string
+	}{
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.9:5000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.9:5000"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.9:5000", map[string]string{"X-Real-IP": "1.2.3.4"}, "203.0.113.9:5000"},
+		{"trusted proxy, X-Real-IP", "10.0.0.2:5000", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy, X-Forwarded-For", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"trusted proxy, client-supplied hop", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.0.0.3"}, "198.51.100.7"},
+		{"trusted proxy, no headers", "10.0.0.2:5000", nil, "10.0.0.2:5000"},
+		{"trusted proxy, garbage header", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "not-an-ip"}, "10.0.0.2:5000"},
+		{"mapped IPv4 peer", "[::ffff:10.0.0.2]:5000", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/feedback", nil)
+		req.RemoteAddr = tc.peer
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if seen != tc.want {
+			t.Errorf("%s: RemoteAddr = %q, want %q", tc.name, seen, tc.want)
+		}
+	}
+}
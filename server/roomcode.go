@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var roomCodePattern = regexp.MustCompile(`^[A-Za-z0-9]{4,32}$`)
+
+var (
+	errInvalidRoomCode = errors.New("invalid room code: use 4-32 letters or digits")
+	errWrongRoomCode   = errors.New("wrong room code")
+)
+
+// claimCode sets the room's join code the first time a sender supplies one;
+// after that the sender must keep presenting the same code. An empty code
+// leaves an open room open and is refused by a protected one.
+func (rm *roomState) claimCode(code string) error {
+	if code != "" && !roomCodePattern.MatchString(code) {
+		return errInvalidRoomCode
+	}
+	rm.codeMu.Lock()
+	if rm.code == "" {
+		rm.code = code
+		onClaim := rm.onClaim
+		rm.codeMu.Unlock()
+		if code != "" && onClaim != nil {
+			onClaim(code)
+		}
+		return nil
+	}
+	defer rm.codeMu.Unlock()
+	return compareCode(code, rm.code)
+}
+
+// compareCode returns the error claimCode would for a sender presenting
+// code to a room whose code is want, without claiming anything.
+func compareCode(code, want string) error {
+	if code != "" && !roomCodePattern.MatchString(code) {
+		return errInvalidRoomCode
+	}
+	if want != "" && subtle.ConstantTimeCompare([]byte(code), []byte(want)) != 1 {
+		return errWrongRoomCode
+	}
+	return nil
+}
+
+// peekCode returns the named room's join code without creating the room:
+// from memory if it is loaded, else from DB_PATH.
+func (reg *roomRegistry) peekCode(name string) (string, error) {
+	if rm := reg.lookup(name); rm != nil {
+		rm.codeMu.Lock()
+		defer rm.codeMu.Unlock()
+		return rm.code, nil
+	}
+	if reg.db == nil {
+		return "", nil
+	}
+	return reg.db.roomCode(name)
+}
+
+// admits reports whether code opens the room. Rooms without a code admit
+// everyone.
+func (rm *roomState) admits(code string) bool {
+	rm.codeMu.Lock()
+	defer rm.codeMu.Unlock()
+	return rm.code == "" || subtle.ConstantTimeCompare([]byte(code), []byte(rm.code)) == 1
+}
+
+// hasCode reports whether the room is protected by a join code.
+func (rm *roomState) hasCode() bool {
+	rm.codeMu.Lock()
+	defer rm.codeMu.Unlock()
+	return rm.code != ""
+}
+
+// claimRoomCode applies ?code= from a feedback post to room, writing the
+// error response and reporting false when it is refused.
+func claimRoomCode(w http.ResponseWriter, r *http.Request, room *roomState) bool {
+	return writeCodeError(w, room.claimCode(r.URL.Query().Get("code")))
+}
+
+// checkRoomCode is claimRoomCode for ?validate=1: ?code= is checked against
+// the named room as a real post would check it, but nothing is claimed and
+// the room is not created.
+func checkRoomCode(w http.ResponseWriter, r *http.Request, rooms *roomRegistry, name string) bool {
+	want, err := rooms.peekCode(name)
+	if err != nil {
+		log.Printf("failed to read the join code of room %q: %v", name, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage_failed", "could not check the room code")
+		return false
+	}
+	return writeCodeError(w, compareCode(r.URL.Query().Get("code"), want))
+}
+
+// writeCodeError writes the response for a refused room code, reporting
+// whether err was nil.
+func writeCodeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errInvalidRoomCode):
+		writeJSONError(w, http.StatusBadRequest, "invalid_room_code", err.Error())
+		return false
+	case err != nil:
+		writeJSONError(w, http.StatusForbidden, "wrong_room_code", err.Error())
+		return false
+	}
+	return true
+}
+
+// requireRoomCode guards room-scoped endpoints: a room protected by a join
+// code only answers requests carrying it as ?code=. The room is loaded as
+// the handler would load it, so a code saved in DB_PATH applies before the
+// room's first request; invalid names are left to the handler to reject.
+func requireRoomCode(rooms *roomRegistry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !admitRoom(w, r, rooms, r.URL.Query().Get("room")) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireUploadRoomCode is requireRoomCode for /uploads/, where the room is
+// the first segment of the upload id rather than ?room=. It expects the
+// /uploads/ prefix already stripped. Nothing here creates or touches a room:
+// the code comes from peekCode, and a room segment must name a loaded room
+// or an upload directory exactly, so on a case-insensitive filesystem
+// /uploads/TEAM/ cannot reach team's files without team's code.
+func requireUploadRoomCode(rooms *roomRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := defaultRoom
+		if dir := path.Dir(path.Clean("/" + r.URL.Path)); dir != "/" {
+			name = strings.TrimPrefix(dir, "/")
+		}
+		if name != defaultRoom && !uploadRoomExists(rooms, name) {
+			writeJSONError(w, http.StatusNotFound, "upload_not_found", "no such upload")
+			return
+		}
+		want, err := rooms.peekCode(name)
+		if err != nil {
+			log.Printf("failed to read the join code of room %q: %v", name, err)
+			writeJSONError(w, http.StatusInternalServerError, "storage_failed", "could not check the room code")
+			return
+		}
+		if want != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("code")), []byte(want)) != 1 {
+			writeRoomCodeRequired(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// uploadRoomExists reports whether name is spelled exactly as a loaded room
+// or a directory in the upload store.
+func uploadRoomExists(rooms *roomRegistry, name string) bool {
+	if checkRoomName(name) != nil {
+		return false
+	}
+	if rooms.lookup(name) != nil {
+		return true
+	}
+	entries, err := rooms.blobs.List(rooms.uploadDir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// admitRoom checks ?code= against the named room, writing the 403 and
+// reporting false when it does not match.
+func admitRoom(w http.ResponseWriter, r *http.Request, rooms *roomRegistry, name string) bool {
+	rm, err := rooms.get(name)
+	if err != nil || rm.admits(r.URL.Query().Get("code")) {
+		return true
+	}
+	writeRoomCodeRequired(w)
+	return false
+}
+
+func writeRoomCodeRequired(w http.ResponseWriter) {
+	writeJSONError(w, http.StatusForbidden, "wrong_room_code", "this room needs its join code: add ?code=")
+}
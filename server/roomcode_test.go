@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRequireRoomCode(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	rm, _ := reg.get("team")
+	if err := rm.claimCode("s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	guarded := requireRoomCode(reg)(ok)
+	uploads := http.StripPrefix("/uploads/", requireUploadRoomCode(reg, ok))
+
+	for _, tc := range []struct {
+		handler http.Handler
+		target  string
+		want    int
+	}{
+		{guarded, "/api/info?room=team", http.StatusForbidden},
+		{guarded, "/api/info?room=team&code=wrong", http.StatusForbidden},
+		{guarded, "/api/info?room=team&code=s3cret", http.StatusOK},
+		{guarded, "/api/info?room=open", http.StatusOK},
+		{guarded, "/api/info", http.StatusOK},
+		{uploads, "/uploads/team/a.png", http.StatusForbidden},
+		{uploads, "/uploads/team/a.png?code=s3cret", http.StatusOK},
+		{uploads, "/uploads/a.png", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestRequireUploadRoomCodeLeavesRoomsAlone(t *testing.T) {
+	dir := t.TempDir()
+	reg := newRoomRegistry(dir, 10, false)
+	rm, _ := reg.get("team")
+	if err := rm.claimCode("s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	// "archived" is only a directory on disk, as after the room was reaped.
+	if err := os.MkdirAll(filepath.Join(dir, "archived"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	uploads := http.StripPrefix("/uploads/", requireUploadRoomCode(reg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/uploads/TEAM/a.png", http.StatusNotFound},
+		{"/uploads/Team/a.png?code=s3cret", http.StatusNotFound},
+		{"/uploads/ghost/a.png", http.StatusNotFound},
+		{"/uploads/archived/a.png", http.StatusOK},
+		{"/uploads/ARCHIVED/a.png", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		uploads.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+	for _, name := range []string{"TEAM", "Team", "ghost", "archived", "ARCHIVED"} {
+		if reg.lookup(name) != nil {
+			t.Errorf("upload request created room %q", name)
+		}
+	}
+}
+
+func TestReapIdleKeepsCodedRooms(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	coded, _ := reg.get("coded")
+	if err := coded.claimCode("s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	reg.get("open")
+
+	if removed := reg.reapIdle(time.Minute, time.Now().Add(time.Hour)); removed != 1 {
+		t.Errorf("reaped %d rooms, want 1", removed)
+	}
+	if reg.lookup("coded") == nil {
+		t.Error("room with a join code was reaped")
+	}
+	if reg.lookup("open") != nil {
+		t.Error("idle open room was kept")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRoom is used when a request names no room. It keeps the original
+// single-room layout, storing uploads directly in the uploads directory.
+const defaultRoom = ""
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var errInvalidRoom = errors.New("invalid room: use 1-64 letters, digits, '-' or '_'")
+
+type roomState struct {
+	name      string
+	uploadDir string
+	state     *state
+	broker    *broker
+
+	lastActive atomic.Int64 // unix nanoseconds
+
+	codeMu  sync.Mutex
+	code    string       // viewer join code; empty leaves the room open
+	onClaim func(string) // called outside codeMu when a code is first set
+}
+
+func (rm *roomState) touch() {
+	rm.lastActive.Store(time.Now().UnixNano())
+}
+
+// uploadID turns a filename inside the room's upload directory into the id
+// used in payloads, which doubles as the path below /uploads/.
+func (rm *roomState) uploadID(filename string) string {
+	if rm.name == defaultRoom {
+		return filename
+	}
+	return path.Join(rm.name, filename)
+}
+
+type roomRegistry struct {
+	mu    sync.Mutex
+	rooms map[string]*roomState
+
+	uploadDir    string
+	blobs        BlobStore // holds the bytes of everything under uploadDir
+	uploads      *uploadIndex
+	uploadSlots  *uploadLimiter // MAX_CONCURRENT_UPLOADS; nil is unlimited
+	screenshots  screenshotOptions
+	meta         metaPolicy
+	text         textPolicy
+	historySize  int
+	pruneEvicted bool
+	presence     time.Duration // debounce for presence broadcasts; 0 disables
+	webhook      *webhook      // nil unless WEBHOOK_URL is set
+	db           *feedbackDB   // nil unless DB_PATH is set
+	maxClients   int           // stream subscribers per room; 0 is unlimited
+	maxDrops     int           // consecutive drops before a client is evicted; 0 never
+
+	screenshotKeep int // per-room screenshots kept on disk; 0 keeps all
+}
+
+func newRoomRegistry(uploadDir string, historySize int, pruneEvicted bool) *roomRegistry {
+	return &roomRegistry{
+		rooms:        make(map[string]*roomState),
+		uploadDir:    uploadDir,
+		blobs:        newFSBlobStore(uploadDir),
+		uploads:      newUploadIndex(),
+		historySize:  historySize,
+		pruneEvicted: pruneEvicted,
+	}
+}
+
+// fromRequest resolves the ?room= query parameter, creating the room on
+// first use.
+func (reg *roomRegistry) fromRequest(r *http.Request) (*roomState, error) {
+	return reg.get(r.URL.Query().Get("room"))
+}
+
+func (reg *roomRegistry) get(name string) (*roomState, error) {
+	if err := checkRoomName(name); err != nil {
+		return nil, err
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	rm, ok := reg.rooms[name]
+	if !ok {
+		rm = reg.newRoom(name)
+		reg.rooms[name] = rm
+	}
+	rm.touch()
+	return rm, nil
+}
+
+func checkRoomName(name string) error {
+	if name != defaultRoom && !roomNamePattern.MatchString(name) {
+		return errInvalidRoom
+	}
+	return nil
+}
+
+// lookup returns an existing room without creating or touching it.
+func (reg *roomRegistry) lookup(name string) *roomState {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.rooms[name]
+}
+
+func (reg *roomRegistry) newRoom(name string) *roomState {
+	rm := &roomState{
+		name:      name,
+		uploadDir: filepath.Join(reg.uploadDir, name),
+		state:     newState(reg.historySize),
+		broker:    newBroker(),
+	}
+	rm.broker.presenceDelay = reg.presence
+	rm.broker.maxClients = reg.maxClients
+	rm.broker.maxDrops = reg.maxDrops
+	if reg.db != nil {
+		if snap, err := reg.db.snapshot(name, reg.historySize); err != nil {
+			log.Printf("failed to load room %q from database: %v", name, err)
+		} else {
+			if len(snap.History) > 0 {
+				rm.state.restore(snap)
+			}
+			if err := rm.claimCode(snap.Code); err != nil {
+				log.Printf("ignoring saved code for room %q: %v", name, err)
+			}
+		}
+		rm.state.onStore = func(entries []historyEntry) {
+			if err := reg.db.store(name, entries); err != nil {
+				log.Printf("failed to store feedback for room %q in database: %v", name, err)
+			}
+		}
+		rm.state.onLatest = func(seq uint64) {
+			if err := reg.db.saveLatest(name, seq); err != nil {
+				log.Printf("failed to store latest for room %q in database: %v", name, err)
+			}
+		}
+		rm.onClaim = func(code string) {
+			if err := reg.db.saveCode(name, code); err != nil {
+				log.Printf("failed to store code for room %q in database: %v", name, err)
+			}
+		}
+	}
+	rm.state.screenshotKeep = reg.screenshotKeep
+	rm.state.onExpire = func(ids []string) {
+		for _, id := range ids {
+			go reg.removeUpload(id)
+		}
+	}
+	if reg.pruneEvicted {
+		rm.state.onEvict = func(p *feedbackPayload) {
+			for _, id := range p.uploadIDs() {
+				// Deduplicated screenshots may still back a newer entry.
+				if rm.state.references(id) {
+					continue
+				}
+				go reg.removeUpload(id)
+			}
+		}
+	}
+	return rm
+}
+
+// removeUpload deletes the file behind an upload id, logging failures.
+func (reg *roomRegistry) removeUpload(id string) {
+	path := filepath.Join(reg.uploadDir, filepath.FromSlash(id))
+	if err := reg.blobs.Delete(path); err != nil {
+		log.Printf("failed to remove upload %s: %v", id, err)
+		return
+	}
+	reg.uploads.forget(path)
+}
+
+// discardUploads removes screenshots, and their thumbnails, stored for a
+// request that then failed. A file deduplication handed out again is kept
+// while the room's history still shows it.
+func (reg *roomRegistry) discardUploads(room *roomState, uploads []*storedUpload) {
+	for _, upload := range uploads {
+		id := room.uploadID(upload.filename)
+		if room.state.references(id) {
+			continue
+		}
+		reg.removeUpload(id)
+		if upload.thumbnail != "" {
+			reg.removeUpload(room.uploadID(upload.thumbnail))
+		}
+	}
+}
+
+// expiredUpload reports whether the upload id belonged to a screenshot that
+// SCREENSHOT_KEEP has since deleted.
+func (reg *roomRegistry) expiredUpload(id string) bool {
+	name := defaultRoom
+	if dir := path.Dir(id); dir != "." {
+		name = dir
+	}
+	rm := reg.lookup(name)
+	return rm != nil && rm.state.expiredUpload(id)
+}
+
+// reapIdle drops rooms that have had no viewers and no requests for ttl.
+// The default room is never removed, and neither is a room with a join code:
+// dropping it would reopen it to the next viewer.
+func (reg *roomRegistry) reapIdle(ttl time.Duration, now time.Time) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	removed := 0
+	for name, rm := range reg.rooms {
+		if name == defaultRoom || rm.broker.clientCount() > 0 || rm.hasCode() {
+			continue
+		}
+		if now.Sub(time.Unix(0, rm.lastActive.Load())) < ttl {
+			continue
+		}
+		delete(reg.rooms, name)
+		removed++
+	}
+	return removed
+}
+
+func runRoomReaper(ctx context.Context, reg *roomRegistry, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if removed := reg.reapIdle(ttl, time.Now()); removed > 0 {
+			log.Printf("closed %d idle room(s)", removed)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Timeout bounds each request to the bucket, so a stalled endpoint fails
+// the upload instead of hanging the handler.
+const s3Timeout = 30 * time.Second
+
+// s3Config is the S3_* environment. Only bucket is required; endpoint points
+// the client at MinIO or another S3-compatible service.
+type s3Config struct {
+	bucket       string
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	prefix       string
+	publicURL    string        // base URL the bucket is readable at; "" presigns
+	presignTTL   time.Duration // lifetime of presigned URLs
+}
+
+// s3BlobStore keeps uploads as objects in a bucket. Names under root map to
+// keys under prefix, so /uploads/r1/x.png is stored as <prefix>r1/x.png.
+// Payloads carry URLs pointing at the bucket when it is readable at
+// publicURL. Otherwise they keep the relay's /uploads/ path, which redirects
+// to a GET URL presigned for presignTTL, so nothing stored ever expires.
+type s3BlobStore struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	root    string
+	cfg     s3Config
+}
+
+func newS3BlobStore(root string, cfg s3Config) *s3BlobStore {
+	opts := s3.Options{
+		Region:      cfg.region,
+		Credentials: credentials.NewStaticCredentialsProvider(cfg.accessKey, cfg.secretKey, cfg.sessionToken),
+	}
+	if cfg.endpoint != "" {
+		opts.BaseEndpoint = aws.String(cfg.endpoint)
+		// MinIO and most self-hosted services don't do virtual-host buckets,
+		// and not all of them accept the SDK's default trailing checksums.
+		opts.UsePathStyle = true
+		opts.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		opts.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	}
+	client := s3.New(opts)
+	return &s3BlobStore{
+		client:  client,
+		presign: s3.NewPresignClient(client, s3.WithPresignExpires(cfg.presignTTL)),
+		root:    root,
+		cfg:     cfg,
+	}
+}
+
+func (s *s3BlobStore) key(name string) (string, error) {
+	id, err := blobID(s.root, name)
+	if err != nil {
+		return "", err
+	}
+	return s.cfg.prefix + id, nil
+}
+
+// check fails when the bucket is unreachable or the credentials are wrong,
+// so a misconfigured relay stops at startup rather than on the first upload.
+func (s *s3BlobStore) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.cfg.bucket)})
+	return err
+}
+
+func (s *s3BlobStore) Put(name string, data []byte) (string, error) {
+	id, err := blobID(s.root, name)
+	if err != nil {
+		return "", err
+	}
+	key := s.cfg.prefix + id
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.cfg.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		input.ContentType = aws.String(ct)
+	}
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return "", &storageError{op: "put", err: err}
+	}
+	return s.URL(id), nil
+}
+
+// URL returns where viewers fetch the upload id from: the bucket when it is
+// public, else the relay, whose /uploads/ redirects via presignRedirect.
+func (s *s3BlobStore) URL(id string) string {
+	if s.cfg.publicURL != "" {
+		return strings.TrimSuffix(s.cfg.publicURL, "/") + "/" + (&url.URL{Path: s.cfg.prefix + id}).EscapedPath()
+	}
+	return uploadURL(id)
+}
+
+// presignRedirect answers GETs under /uploads/ (prefix already stripped)
+// with a redirect to a freshly presigned URL for the object. Presigning is a
+// local computation, so it is cheap enough to do per request. HEAD, which a
+// GET signature doesn't cover, and public buckets fall through to next,
+// which proxies the object.
+func (s *s3BlobStore) presignRedirect(next http.Handler) http.Handler {
+	if s.cfg.publicURL != "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := s.key(filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+r.URL.Path))))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req, err := s.presign.PresignGetObject(r.Context(), &s3.GetObjectInput{
+			Bucket: aws.String(s.cfg.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The target expires, so neither browsers nor proxies may keep it.
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, req.URL, http.StatusFound)
+	})
+}
+
+// Move uploads a spooled file, streaming it from disk rather than reading
+// it into memory, and removes it once stored.
+func (s *s3BlobStore) Move(name, tmpPath string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return &storageError{op: "read", err: err}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return &storageError{op: "read", err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(s.cfg.bucket),
+		Key:           aws.String(key),
+		Body:          f,
+		ContentLength: aws.Int64(info.Size()),
+	}
+	if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+		input.ContentType = aws.String(ct)
+	}
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		return &storageError{op: "put", err: err}
+	}
+	_ = os.Remove(tmpPath)
+	return nil
+}
+
+// Stat reports an object's size and modification time with a HEAD request,
+// so statBlob never downloads the object.
+func (s *s3BlobStore) Stat(name string) (fs.FileInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s3NotExist("stat", name, err)
+	}
+	return blobInfo{
+		name:    filepath.Base(name),
+		size:    aws.ToInt64(out.ContentLength),
+		modTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+// Open checks the object exists and returns a file that fetches its bytes
+// only as they are read, seeking with Range requests, so serving an upload
+// or a Range of one streams it instead of buffering the whole object.
+func (s *s3BlobStore) Open(name string) (http.File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := s.key(name)
+	return &s3File{store: s, key: key, info: info.(blobInfo)}, nil
+}
+
+// s3NotExist maps a missing key to fs.ErrNotExist. HEAD responses have no
+// body, so the SDK reports them as NotFound rather than NoSuchKey.
+func s3NotExist(op, name string, err error) error {
+	var noKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noKey) || errors.As(err, &notFound) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (s *s3BlobStore) Delete(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.cfg.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3BlobStore) List(dir string) ([]fs.DirEntry, error) {
+	prefix := s.cfg.prefix
+	if filepath.Clean(dir) != filepath.Clean(s.root) {
+		id, err := blobID(s.root, dir)
+		if err != nil {
+			return nil, err
+		}
+		prefix += id + "/"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	var entries []fs.DirEntry
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.cfg.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, p := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(blobInfo{name: name, dir: true}))
+		}
+		for _, obj := range page.Contents {
+			entries = append(entries, fs.FileInfoToDirEntry(blobInfo{
+				name:    strings.TrimPrefix(aws.ToString(obj.Key), prefix),
+				size:    aws.ToInt64(obj.Size),
+				modTime: aws.ToTime(obj.LastModified),
+			}))
+		}
+	}
+	return entries, nil
+}
+
+// s3File is an object opened for reading. The GET is issued on the first
+// Read after each Seek, starting at the current offset.
+type s3File struct {
+	store  *s3BlobStore
+	key    string
+	info   blobInfo
+	offset int64
+	body   io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+		out, err := f.store.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(f.store.cfg.bucket),
+			Key:    aws.String(f.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", f.offset)),
+		})
+		if err != nil {
+			cancel()
+			return 0, s3NotExist("read", f.info.name, err)
+		}
+		f.body, f.cancel = out.Body, cancel
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	if offset != f.offset {
+		f.closeBody()
+		f.offset = offset
+	}
+	return offset, nil
+}
+
+func (f *s3File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.cancel()
+		f.body, f.cancel = nil, nil
+	}
+}
+
+func (f *s3File) Close() error {
+	f.closeBody()
+	return nil
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error)         { return f.info, nil }
+func (f *s3File) Readdir(int) ([]fs.FileInfo, error) { return nil, errors.New("not a directory") }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves just enough of the S3 API for s3BlobStore, recording the
+// requests it sees.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    []string // Range header of each GET
+	puts    []int64  // Content-Length of each PUT
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	data, ok := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		f.puts = append(f.puts, r.ContentLength)
+		return
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				io.WriteString(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+			return
+		}
+	}
+	w.Header().Set("Last-Modified", time.Unix(1700000000, 0).UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		return
+	}
+	rangeHeader := r.Header.Get("Range")
+	f.gets = append(f.gets, rangeHeader)
+	if from, ok := strings.CutPrefix(rangeHeader, "bytes="); ok {
+		start, _ := strconv.Atoi(strings.TrimSuffix(from, "-"))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:])
+		return
+	}
+	w.Write(data)
+}
+
+func newFakeS3Store(t *testing.T) (*s3BlobStore, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	store := newS3BlobStore(t.TempDir(), s3Config{
+		bucket:     "shots",
+		endpoint:   srv.URL,
+		region:     "us-east-1",
+		accessKey:  "key",
+		secretKey:  "secret",
+		presignTTL: time.Minute,
+	})
+	return store, fake
+}
+
+func TestS3StatUsesHead(t *testing.T) {
+	store, fake := newFakeS3Store(t)
+	fake.objects["/shots/r1/a.png"] = []byte("0123456789")
+
+	info, err := statBlob(store, filepath.Join(store.root, "r1", "a.png"))
+	if err != nil {
+		t.Fatalf("statBlob: %v", err)
+	}
+	if info.Size() != 10 {
+		t.Errorf("size = %d, want 10", info.Size())
+	}
+	if _, err := statBlob(store, filepath.Join(store.root, "r1", "missing.png")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing object = %v, want fs.ErrNotExist", err)
+	}
+	if len(fake.gets) != 0 {
+		t.Errorf("stat downloaded the object %d times", len(fake.gets))
+	}
+}
+
+func TestS3OpenReadsRanges(t *testing.T) {
+	store, fake := newFakeS3Store(t)
+	fake.objects["/shots/a.png"] = []byte("0123456789")
+
+	f, err := store.Open(filepath.Join(store.root, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	req := httptest.NewRequest(http.MethodGet, "/uploads/a.png", nil)
+	req.Header.Set("Range", "bytes=6-")
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "a.png", time.Time{}, f)
+
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "6789" {
+		t.Errorf("ranged GET = %d %q, want 206 \"6789\"", rec.Code, rec.Body)
+	}
+	if len(fake.gets) != 1 || fake.gets[0] != "bytes=6-" {
+		t.Errorf("bucket saw GETs with ranges %q, want one from byte 6", fake.gets)
+	}
+}
+
+func TestS3StreamsSpooledUpload(t *testing.T) {
+	store, fake := newFakeS3Store(t)
+	dir := filepath.Join(store.root, "r1")
+	img := testPNG(t, 20, 10)
+
+	spool, err := spoolScreenshot(store, dir, "png", bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.remove()
+	upload, err := persistSpooled(store, dir, spool, newUploadIndex(), screenshotOptions{})
+	if err != nil {
+		t.Fatalf("persistSpooled: %v", err)
+	}
+
+	if got := fake.objects["/shots/r1/"+upload.filename]; !bytes.Equal(got, img) {
+		t.Errorf("bucket holds %d bytes, want the %d-byte image", len(got), len(img))
+	}
+	if len(fake.puts) != 1 || fake.puts[0] != int64(len(img)) {
+		t.Errorf("PUT content lengths = %v, want one of %d", fake.puts, len(img))
+	}
+	if upload.width != 20 || upload.height != 10 {
+		t.Errorf("dimensions = %dx%d, want 20x10", upload.width, upload.height)
+	}
+	if len(fake.gets) != 0 {
+		t.Errorf("storing read the object back %d times", len(fake.gets))
+	}
+}
+
+func TestS3PresignedURLsAreSignedPerRequest(t *testing.T) {
+	store, _ := newFakeS3Store(t)
+	if got := blobURL(store, "r1/a.png"); got != uploadURL("r1/a.png") {
+		t.Fatalf("payload URL = %q, want the relay's own %q so nothing stored expires", got, uploadURL("r1/a.png"))
+	}
+
+	proxied := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	h := http.StripPrefix("/uploads/", store.presignRedirect(proxied))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/uploads/r1/a.png", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET = %d, want 302", rec.Code)
+	}
+	target, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || target.Path != "/shots/r1/a.png" || target.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("Location = %q, want a presigned URL for /shots/r1/a.png", rec.Header().Get("Location"))
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/uploads/r1/a.png", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("HEAD = %d, want it proxied", rec.Code)
+	}
+}
+
+func TestS3PublicURLsPointAtTheBucket(t *testing.T) {
+	store, _ := newFakeS3Store(t)
+	store.cfg.publicURL = "https://cdn.example/"
+	if got, want := blobURL(store, "r1/a b.png"), "https://cdn.example/r1/a%20b.png"; got != want {
+		t.Errorf("payload URL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// handleSnapshot answers GET /api/snapshot: the room's latest payload, its
+// viewer count, the relay's uptime and the first viewer URL in one object,
+// for status pages that would otherwise poll /api/latest, /api/info and
+// /api/readyz. latest is the newest payload viewers see, skipping silent
+// ones; it and url are null when there is nothing to report.
+func handleSnapshot(scheme, port string, startedAt time.Time, rooms *roomRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+
+		now := time.Now()
+		payload := map[string]interface{}{
+			"generatedAt":   now.UTC().Format(time.RFC3339),
+			"latest":        nil,
+			"viewerCount":   room.broker.viewerCount(),
+			"uptimeSeconds": int64(now.Sub(startedAt).Seconds()),
+			"url":           nil,
+		}
+		// Status pages sit on the viewer side, so silent notes stay hidden.
+		if latest := room.state.latestVisible(); latest != nil {
+			payload["latest"] = latest
+		}
+		if urls := viewerURLs(scheme, port); len(urls) > 0 {
+			payload["url"] = urls[0]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(payload); err != nil {
+			log.Printf("failed to encode snapshot: %v", err)
+		}
+	}
+}
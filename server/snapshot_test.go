@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSkipsSilentPayloads(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	room, _ := reg.get("")
+	snapshot := func() *feedbackPayload {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleSnapshot("http", "3000", time.Now(), reg)(rec, httptest.NewRequest(http.MethodGet, "/api/snapshot", nil))
+		var body struct {
+			Latest *feedbackPayload `json:"latest"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("snapshot body %s: %v", rec.Body, err)
+		}
+		return body.Latest
+	}
+
+	room.state.setLatest(&feedbackPayload{ID: "shown", Feedback: "visible"})
+	room.state.setLatest(&feedbackPayload{ID: "note", Feedback: "private", Meta: map[string]interface{}{"silent": true}})
+	if latest := snapshot(); latest == nil || latest.ID != "shown" {
+		t.Errorf("latest = %+v, want the last visible payload", latest)
+	}
+
+	room.state.clearLatest()
+	room.state.setLatest(&feedbackPayload{ID: "only-note", Meta: map[string]interface{}{"silent": true}})
+	if latest := snapshot(); latest != nil && latest.ID == "only-note" {
+		t.Errorf("latest = %+v, want the silent payload hidden", latest)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newPublicDir lays out a public directory with an index, an asset and a
+// secret file beside it that must never be served.
+func newPublicDir(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	public := filepath.Join(root, "public")
+	for name, body := range map[string]string{
+		"secret.txt":                      "top secret",
+		"public/index.html":               `<html><base href="/" /></html>`,
+		"public/app.js":                   "console.log(1)",
+		"public/assets/module.mjs":        "export {}",
+		"public/assets/engine.wasm":       "\x00asm",
+		"public/manifest.webmanifest":     "{}",
+		"public/public-secret/notes.html": "<p>fine</p>",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return public
+}
+
+func serveSPA(publicDir, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	spaHandler(publicDir)(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestSPARejectsTraversal(t *testing.T) {
+	public := newPublicDir(t)
+	for _, target := range []string{
+		"/../secret.txt",
+		"/assets/../../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/%2E%2E%2Fsecret.txt",
+		"/..%2fsecret.txt",
+		"/..%5csecret.txt",
+		"/app.js%00.html",
+	} {
+		rec := serveSPA(public, target)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", target, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "top secret") {
+			t.Errorf("GET %s leaked the file outside publicDir", target)
+		}
+	}
+
+	// Paths that stay inside publicDir still serve.
+	if rec := serveSPA(public, "/public-secret/notes.html"); rec.Code != http.StatusOK {
+		t.Errorf("GET /public-secret/notes.html = %d, want 200", rec.Code)
+	}
+}
+
+func TestSPAContentTypes(t *testing.T) {
+	registerAssetTypes()
+	public := newPublicDir(t)
+	for _, tc := range []struct {
+		target      string
+		status      int
+		contentType string // prefix; empty skips the check
+	}{
+		{"/", http.StatusOK, "text/html"},
+		{"/app.js", http.StatusOK, "text/javascript"},
+		{"/assets/module.mjs", http.StatusOK, "text/javascript"},
+		{"/assets/engine.wasm", http.StatusOK, "application/wasm"},
+		{"/manifest.webmanifest", http.StatusOK, "application/manifest+json"},
+		// Client-side routes fall back to the app shell...
+		{"/interview/42", http.StatusOK, "text/html"},
+		// ...but missing assets do not.
+		{"/missing.js", http.StatusNotFound, ""},
+		{"/assets/gone.wasm", http.StatusNotFound, ""},
+		{"/old/style.css", http.StatusNotFound, ""},
+	} {
+		rec := serveSPA(public, tc.target)
+		if rec.Code != tc.status {
+			t.Errorf("GET %s = %d, want %d", tc.target, rec.Code, tc.status)
+			continue
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.contentType) {
+			t.Errorf("GET %s Content-Type = %q, want %s", tc.target, got, tc.contentType)
+		}
+		if tc.status == http.StatusNotFound && strings.Contains(rec.Body.String(), "<html>") {
+			t.Errorf("GET %s returned index.html for a missing asset", tc.target)
+		}
+	}
+}
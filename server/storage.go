@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"syscall"
+)
+
+// storageError marks a failure to write an upload to disk, as opposed to a
+// malformed upload. Handlers answer it with 507/500 rather than 400.
+type storageError struct {
+	op  string
+	err error
+}
+
+func (e *storageError) Error() string { return e.op + ": " + e.err.Error() }
+func (e *storageError) Unwrap() error { return e.err }
+
+var errInsufficientSpace = errors.New("not enough free disk space")
+
+// minFreeDiskBytes is the headroom an upload must leave on the uploads
+// filesystem (MIN_FREE_DISK_BYTES); uploads that would eat into it are
+// refused before anything is written.
+var minFreeDiskBytes int64
+
+// ensureSpace rejects an upload of size bytes when the filesystem holding
+// dir cannot take it. Where free space is unknown the write just proceeds.
+func ensureSpace(dir string, size int64) error {
+	free, ok := availableBytes(dir)
+	if !ok || free >= uint64(size+minFreeDiskBytes) {
+		return nil
+	}
+	return &storageError{op: "check space", err: fmt.Errorf("%w: %d bytes free", errInsufficientSpace, free)}
+}
+
+// storageWriter tags write errors so a failed io.Copy can be told apart
+// from a failing client body.
+type storageWriter struct {
+	w io.Writer
+}
+
+func (s storageWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		err = &storageError{op: "write", err: err}
+	}
+	return n, err
+}
+
+// writeUploadError answers a failed persistScreenshot/persistAudio call:
+// images that cannot be converted to CANONICAL_IMAGE get 422, storage
+// failures are logged as errors and reported as 507 (disk full) or 500, and
+// everything else is the client's fault and gets 400 with code.
+func writeUploadError(w http.ResponseWriter, err error, code, label string) {
+	var conversion *conversionError
+	if errors.As(err, &conversion) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "conversion_failed", err.Error())
+		return
+	}
+	var storage *storageError
+	if !errors.As(err, &storage) {
+		writeJSONError(w, http.StatusBadRequest, code, fmt.Sprintf("%s: %v", label, err))
+		return
+	}
+	slog.Error("failed to store upload", "err", err)
+	if errors.Is(err, errInsufficientSpace) || errors.Is(err, syscall.ENOSPC) {
+		writeJSONError(w, http.StatusInsufficientStorage, "insufficient_storage", "the server is out of disk space for uploads")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, "storage_failed", "the server could not store the upload")
+}
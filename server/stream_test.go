@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read off /api/stream.
+type sseEvent struct {
+	id   string
+	data string
+}
+
+// readEvents reads n events from an SSE response, skipping comments.
+func readEvents(t *testing.T, resp *http.Response, n int) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var cur sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			cur.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			cur.data = strings.TrimPrefix(line, "data: ")
+		case line == "" && cur.data != "":
+			events = append(events, cur)
+			cur = sseEvent{}
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("read %d events, want %d (%v)", len(events), n, scanner.Err())
+	}
+	return events
+}
+
+// openStream connects to handleStream for reg with the given query.
+func openStream(t *testing.T, reg *roomRegistry, query string, header http.Header) *http.Response {
+	t.Helper()
+	srv := httptest.NewServer(handleStream(reg, time.Minute, 16, 0))
+	t.Cleanup(srv.Close)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/stream?"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestStreamBackfill(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 3, false)
+	room, _ := reg.get("")
+	for i := 1; i <= 5; i++ {
+		room.state.setLatest(&feedbackPayload{ID: fmt.Sprint("p", i)})
+	}
+
+	// More than the history holds is capped at the history size, oldest
+	// first.
+	events := readEvents(t, openStream(t, reg, "backfill=10", nil), 3)
+	for i, want := range []string{"3", "4", "5"} {
+		if events[i].id != want {
+			t.Errorf("backfill event %d has id %s, want %s", i, events[i].id, want)
+		}
+	}
+
+	// Without backfill only the latest payload is sent, then live events.
+	resp := openStream(t, reg, "", nil)
+	if first := readEvents(t, resp, 1)[0]; first.id != "5" {
+		t.Errorf("first event id = %s, want the latest, 5", first.id)
+	}
+	room.state.setLatest(&feedbackPayload{ID: "p6"})
+	room.broker.broadcast(message{id: 6, kind: "feedback", data: []byte(`{"id":"p6"}`)})
+	if next := readEvents(t, resp, 1)[0]; next.id != "6" {
+		t.Errorf("live event id = %s, want 6", next.id)
+	}
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	const heartbeat = 50 * time.Millisecond
+	srv := httptest.NewServer(handleStream(reg, heartbeat, 16, 0))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	pinged := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == ": ping" {
+				close(pinged)
+				return
+			}
+		}
+	}()
+	select {
+	case <-pinged:
+	case <-time.After(10 * heartbeat):
+		t.Fatalf("no heartbeat within %v on an idle stream", 10*heartbeat)
+	}
+}
+
+func TestSilentFeedbackNotStreamed(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	img := pngDataURL(testPNG(t, 8, 8))
+	resp := openStream(t, reg, "", nil)
+
+	post := func(text string, silent bool) string {
+		body := map[string]interface{}{"feedback": text, "image": img}
+		if silent {
+			body["meta"] = map[string]interface{}{"silent": true}
+		}
+		rec := postFeedback(t, reg, "/api/feedback", body)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("post = %d %s", rec.Code, rec.Body)
+		}
+		var payload feedbackPayload
+		json.Unmarshal(rec.Body.Bytes(), &payload)
+		return payload.ID
+	}
+	post("private note", true)
+	visible := post("for everyone", false)
+
+	event := readEvents(t, resp, 1)[0]
+	var got feedbackPayload
+	if err := json.Unmarshal([]byte(event.data), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != visible {
+		t.Errorf("first streamed payload is %q (%s), want the visible one", got.Feedback, event.data)
+	}
+
+	room := reg.lookup("")
+	if history := room.state.getHistory(10); len(history) != 2 {
+		t.Errorf("history has %d entries, want the silent one recorded too", len(history))
+	}
+	post("another note", true)
+	req := httptest.NewRequest(http.MethodGet, "/api/latest?skipSilent=1", nil)
+	rec := httptest.NewRecorder()
+	handleLatest(reg)(rec, req)
+	var latest feedbackPayload
+	json.Unmarshal(rec.Body.Bytes(), &latest)
+	if latest.ID != visible {
+		t.Errorf("latest?skipSilent=1 = %q, want the last visible payload", latest.Feedback)
+	}
+}
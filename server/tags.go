@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	maxTags      = 10
+	maxTagLength = 32
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// normalizeTags lowercases and trims the tags a sender attached to feedback
+// ("positive", "concern", "followup", ...), dropping blanks and duplicates
+// while keeping the sender's order. Tags must be at most maxTagLength bytes
+// of letters, digits, '-' or '_', and there may be at most maxTags of them.
+func normalizeTags(raw []string) ([]string, error) {
+	var tags []string
+	for _, tag := range raw {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q exceeds %d bytes", tag, maxTagLength)
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q must use letters, digits, '-' or '_'", tag)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return tags, nil
+}
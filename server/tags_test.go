@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	for _, tc := range []struct {
+		raw     []string
+		want    []string
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{" Concern ", "FOLLOWUP", "concern", "", "follow_up-2"}, []string{"concern", "followup", "follow_up-2"}, false},
+		{[]string{strings.Repeat("a", maxTagLength)}, []string{strings.Repeat("a", maxTagLength)}, false},
+		{[]string{strings.Repeat("a", maxTagLength+1)}, nil, true},
+		{[]string{"two words"}, nil, true},
+		{[]string{"-leading"}, nil, true},
+		{[]string{"<b>"}, nil, true},
+		{[]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}, nil, true},
+		{[]string{"a", "A", "b", "c", "d", "e", "f", "g", "h", "i", "j"}, []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}, false},
+	} {
+		got, err := normalizeTags(tc.raw)
+		if (err != nil) != tc.wantErr || !slices.Equal(got, tc.want) {
+			t.Errorf("normalizeTags(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestHistoryTagFilter(t *testing.T) {
+	for _, withDB := range []bool{false, true} {
+		t.Run(fmt.Sprintf("db=%v", withDB), func(t *testing.T) {
+			reg := newRoomRegistry(t.TempDir(), 10, false)
+			if withDB {
+				reg = newDBRegistry(t, filepath.Join(t.TempDir(), "feedback.db"))
+			}
+			img := pngDataURL(testPNG(t, 8, 8))
+			for i, tags := range [][]string{{"Positive"}, {"concern", "followup"}, nil, {"CONCERN"}} {
+				rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": fmt.Sprint("note ", i), "image": img, "tags": tags})
+				if rec.Code != http.StatusCreated {
+					t.Fatalf("post = %d %s", rec.Code, rec.Body)
+				}
+				var payload feedbackPayload
+				json.Unmarshal(rec.Body.Bytes(), &payload)
+				want, _ := normalizeTags(tags)
+				if !slices.Equal(payload.Tags, want) {
+					t.Errorf("stored tags = %q, want %q", payload.Tags, want)
+				}
+			}
+
+			rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "bad", "image": img, "tags": []string{"no spaces"}})
+			if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "invalid_tags" {
+				t.Errorf("invalid tag = %d %s, want 400 invalid_tags", rec.Code, rec.Body)
+			}
+
+			for _, tc := range []struct {
+				tag  string
+				want []string
+			}{
+				{"concern", []string{"note 3", "note 1"}},
+				{"Concern", []string{"note 3", "note 1"}},
+				{"positive", []string{"note 0"}},
+				{"missing", nil},
+				{"", []string{"note 3", "note 2", "note 1", "note 0"}},
+			} {
+				rec := httptest.NewRecorder()
+				handleHistory(reg)(rec, httptest.NewRequest(http.MethodGet, "/api/history?tag="+tc.tag, nil))
+				var page historyPage
+				if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+					t.Fatalf("history: %v (%s)", err, rec.Body)
+				}
+				var got []string
+				for _, item := range page.Items {
+					got = append(got, item.Feedback)
+				}
+				if !slices.Equal(got, tc.want) || page.Total != len(tc.want) {
+					t.Errorf("?tag=%s = %q (total %d), want %q", tc.tag, got, page.Total, tc.want)
+				}
+			}
+		})
+	}
+}
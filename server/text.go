@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"html"
+)
+
+// textPolicy bounds the feedback text viewers render. It is checked after
+// the feedback_required test, so the text is known to be non-blank.
+type textPolicy struct {
+	maxBytes int  // 0 disables the length check
+	escape   bool // HTML-escape the text so naive viewers can render it as-is
+}
+
+// clean rejects text over maxBytes and, when escape is set, returns it with
+// <, >, &, ' and " escaped. Newlines and other whitespace are left alone.
+func (p textPolicy) clean(text string) (string, error) {
+	if p.maxBytes > 0 && len(text) > p.maxBytes {
+		return "", fmt.Errorf("feedback exceeds %d bytes", p.maxBytes)
+	}
+	if p.escape {
+		text = html.EscapeString(text)
+	}
+	return text, nil
+}
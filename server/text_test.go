@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTextPolicyLength(t *testing.T) {
+	policy := textPolicy{maxBytes: 8 << 10}
+	if _, err := policy.clean(strings.Repeat("a", 8<<10)); err != nil {
+		t.Errorf("text at the cap: %v", err)
+	}
+	if _, err := policy.clean(strings.Repeat("a", 8<<10+1)); err == nil || err.Error() != "feedback exceeds 8192 bytes" {
+		t.Errorf("text over the cap: err = %v", err)
+	}
+	if _, err := (textPolicy{}).clean(strings.Repeat("a", 1<<20)); err != nil {
+		t.Errorf("a zero cap rejected text: %v", err)
+	}
+}
+
+func TestTextPolicyEscape(t *testing.T) {
+	const sample = "Look at line 3:\n<script>alert('x')</script>\n\tand \"this\" & that"
+	got, err := textPolicy{escape: true}.clean(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "Look at line 3:\n&lt;script&gt;alert(&#39;x&#39;)&lt;/script&gt;\n\tand &#34;this&#34; &amp; that"
+	if got != want {
+		t.Errorf("escaped = %q, want %q", got, want)
+	}
+	if got, _ := (textPolicy{}).clean(sample); got != sample {
+		t.Errorf("SANITIZE_FEEDBACK off changed the text to %q", got)
+	}
+}
+
+func TestFeedbackTextLimits(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.text = textPolicy{maxBytes: 64, escape: true}
+	img := pngDataURL(testPNG(t, 8, 8))
+
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": strings.Repeat("x", 65), "image": img})
+	if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "feedback_too_long" {
+		t.Errorf("long feedback = %d %s, want 400 feedback_too_long", rec.Code, rec.Body)
+	}
+
+	rec = postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi<script>x()</script>\nbye", "image": img})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+	var payload feedbackPayload
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Feedback != "hi&lt;script&gt;x()&lt;/script&gt;\nbye" {
+		t.Errorf("stored feedback = %q, want it escaped with the newline kept", payload.Feedback)
+	}
+}
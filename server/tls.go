@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsSetup describes how the server should terminate TLS, if at all.
+type tlsSetup struct {
+	certFile, keyFile string
+	config            *tls.Config
+}
+
+func (t *tlsSetup) enabled() bool {
+	return t != nil
+}
+
+func (t *tlsSetup) scheme() string {
+	if t.enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// tlsFromEnv prefers TLS_CERT/TLS_KEY files and falls back to an in-memory
+// self-signed certificate when TLS_AUTOGEN is set. It returns nil when TLS is
+// not configured.
+func tlsFromEnv(port string) (*tlsSetup, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+		}
+		return &tlsSetup{certFile: certFile, keyFile: keyFile}, nil
+	}
+	if !envBool("TLS_AUTOGEN") {
+		return nil, nil
+	}
+
+	cert, err := selfSignedCert(localBaseURLs("https", port))
+	if err != nil {
+		return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+	}
+	return &tlsSetup{config: &tls.Config{Certificates: []tls.Certificate{cert}}}, nil
+}
+
+// selfSignedCert issues a certificate valid for every host in urls and logs
+// its fingerprint and PEM so it can be trusted on a phone.
+func selfSignedCert(urls []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "interview-relay"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		host := u.Hostname()
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fingerprint := sha256.Sum256(der)
+	hexParts := make([]string, len(fingerprint))
+	for i, b := range fingerprint {
+		hexParts[i] = fmt.Sprintf("%02X", b)
+	}
+	log.Printf("generated self-signed certificate for %s", strings.Join(append(template.DNSNames, ipStrings(template.IPAddresses)...), ", "))
+	log.Printf("certificate SHA-256 fingerprint: %s", strings.Join(hexParts, ":"))
+	log.Printf("certificate PEM:\n%s", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
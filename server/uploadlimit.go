@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var errUploadsBusy = errors.New("too many uploads in progress; try again shortly")
+
+// uploadLimiter bounds how many screenshots are decoded and stored at once,
+// so a burst of large uploads queues instead of spiking memory and CPU.
+type uploadLimiter struct {
+	sem  *semaphore.Weighted
+	wait time.Duration // longest a request queues for a slot
+}
+
+func newUploadLimiter(slots int, wait time.Duration) *uploadLimiter {
+	if slots < 1 {
+		slots = 1
+	}
+	return &uploadLimiter{sem: semaphore.NewWeighted(int64(slots)), wait: wait}
+}
+
+// acquire waits for a slot until the request is cancelled or wait elapses,
+// returning errUploadsBusy in the latter case. A nil limiter never blocks.
+func (l *uploadLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+	if err := l.sem.Acquire(ctx, 1); err != nil {
+		return nil, errUploadsBusy
+	}
+	return func() { l.sem.Release(1) }, nil
+}
+
+// writeUploadsBusy answers a request that could not get an upload slot.
+func writeUploadsBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeJSONError(w, http.StatusServiceUnavailable, "uploads_busy", errUploadsBusy.Error())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPNG encodes a blank w×h PNG.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeMultipartFeedback writes a multipart feedback body with the given
+// name, value field pairs followed, if img is not nil, by a PNG image part.
+// It returns the body's Content-Type.
+func writeMultipartFeedback(t *testing.T, w io.Writer, img []byte, fields ...string) string {
+	t.Helper()
+	mw := multipart.NewWriter(w)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := mw.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if img != nil {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="image"; filename="shot.png"`},
+			"Content-Type":        {"image/png"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return mw.FormDataContentType()
+}
+
+func TestUploadLimiterBoundsBurst(t *testing.T) {
+	const slots, burst = 3, 40
+	limiter := newUploadLimiter(slots, 10*time.Second)
+
+	var active, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n := active.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			active.Add(-1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > slots {
+		t.Errorf("%d uploads ran at once, want at most %d", p, slots)
+	}
+}
+
+func TestUploadLimiterGivesUp(t *testing.T) {
+	limiter := newUploadLimiter(1, 20*time.Millisecond)
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := limiter.acquire(context.Background()); !errors.Is(err, errUploadsBusy) {
+		t.Errorf("acquire with no free slot = %v, want errUploadsBusy", err)
+	}
+}
+
+// A client still sending its image must not hold the only slot: the upload
+// is spooled first and the slot is taken only to process it.
+func TestMultipartSlowBodyHoldsNoSlot(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.uploadSlots = newUploadLimiter(1, 100*time.Millisecond)
+	handler := handleFeedbackMultipart(10<<20, reg)
+	img := testPNG(t, 8, 8)
+
+	var slowBody bytes.Buffer
+	contentType := writeMultipartFeedback(t, &slowBody, img, "feedback", "slow")
+	body := slowBody.Bytes()
+	half := bytes.Index(body, img) + len(img)/2
+
+	pr, pw := io.Pipe()
+	slow := make(chan int)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/api/feedback/multipart", pr)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		slow <- rec.Code
+	}()
+	if _, err := pw.Write(body[:half]); err != nil {
+		t.Fatal(err)
+	}
+
+	var fast bytes.Buffer
+	req := httptest.NewRequest(http.MethodPost, "/api/feedback/multipart", &fast)
+	req.Header.Set("Content-Type", writeMultipartFeedback(t, &fast, img, "feedback", "fast"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("upload during a slow one = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	if _, err := pw.Write(body[half:]); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	if code := <-slow; code != http.StatusCreated {
+		t.Errorf("slow upload = %d, want 201", code)
+	}
+}
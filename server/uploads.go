@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Data URL failures, told apart so the 400 says which part to fix: the
+// data:TYPE;base64, prefix, the media type, or the encoded bytes.
+var (
+	errBadDataURLPrefix     = errors.New("expected a base64 data URL (data:TYPE;base64,DATA)")
+	errUnsupportedImageType = errors.New("unsupported image type")
+	errUnsupportedAudioType = errors.New("unsupported audio type")
+	errBadBase64            = errors.New("malformed base64")
+)
+
+// imageExtensions maps accepted image subtypes to file extensions.
+var imageExtensions = map[string]string{
+	"png":  "png",
+	"jpeg": "jpg",
+}
+
+// audioExtensions maps accepted audio subtypes to file extensions.
+var audioExtensions = map[string]string{
+	"webm": "webm",
+	"mpeg": "mp3",
+	"wav":  "wav",
+}
+
+// registerUploadTypes makes sure the uploads file server labels audio
+// correctly even where the OS MIME table lacks these extensions.
+func registerUploadTypes() {
+	for subtype, ext := range audioExtensions {
+		_ = mime.AddExtensionType("."+ext, "audio/"+subtype)
+	}
+}
+
+// storedUpload describes a screenshot written to the uploads directory.
+// width and height are zero when the image header could not be decoded.
+type storedUpload struct {
+	filename  string
+	width     int
+	height    int
+	sizeBytes int
+	sha256    string
+	thumbnail string // empty when disabled or the image is already small
+
+	contentType    string // of the stored file
+	originalFormat string // as uploaded: "png" or "jpeg"
+	jpegQuality    int    // set when MAX_SCREENSHOT_BYTES re-encoded it
+}
+
+// imageFormats maps stored screenshot extensions to their format name and
+// MIME type.
+var imageFormats = map[string]struct{ name, contentType string }{
+	"png": {"png", "image/png"},
+	"jpg": {"jpeg", "image/jpeg"},
+}
+
+// describe fills in the content type of the stored file and the format the
+// client sent, which differ when CANONICAL_IMAGE converted it.
+func (u *storedUpload) describe(uploadedExt, storedExt string) {
+	u.originalFormat = imageFormats[uploadedExt].name
+	u.contentType = imageFormats[storedExt].contentType
+}
+
+// uploadIndex remembers the content hash of every screenshot written so a
+// byte-identical capture can reuse the existing file. It also records when
+// each file was last handed out, so cleanup can age shared files by their
+// most recent use rather than their first.
+type uploadIndex struct {
+	mu       sync.Mutex
+	byHash   map[string]string    // dir + "\x00" + hash -> filename
+	lastUsed map[string]time.Time // path -> last write or reuse
+	quality  map[string]int       // path -> JPEG quality chosen by MAX_SCREENSHOT_BYTES
+}
+
+func newUploadIndex() *uploadIndex {
+	return &uploadIndex{
+		byHash:   make(map[string]string),
+		lastUsed: make(map[string]time.Time),
+		quality:  make(map[string]int),
+	}
+}
+
+// reuse returns the filename and size of an existing upload in dir with the
+// given hash, if store still holds it.
+func (idx *uploadIndex) reuse(store BlobStore, dir, hash string) (string, int, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	key := dir + "\x00" + hash
+	filename, ok := idx.byHash[key]
+	if !ok {
+		return "", 0, false
+	}
+	path := filepath.Join(dir, filename)
+	info, err := statBlob(store, path)
+	if err != nil {
+		delete(idx.byHash, key)
+		delete(idx.lastUsed, path)
+		delete(idx.quality, path)
+		return "", 0, false
+	}
+	idx.lastUsed[path] = time.Now()
+	return filename, int(info.Size()), true
+}
+
+func (idx *uploadIndex) record(dir, hash, filename string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.byHash[dir+"\x00"+hash] = filename
+	idx.lastUsed[filepath.Join(dir, filename)] = time.Now()
+}
+
+// recordQuality remembers the quality a size-capped upload was re-encoded
+// at, so later duplicates can report it too.
+func (idx *uploadIndex) recordQuality(dir, filename string, quality int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.quality[filepath.Join(dir, filename)] = quality
+}
+
+func (idx *uploadIndex) qualityOf(dir, filename string) int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.quality[filepath.Join(dir, filename)]
+}
+
+// usedSince reports whether the file at path was written or reused after t.
+func (idx *uploadIndex) usedSince(path string, t time.Time) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	used, ok := idx.lastUsed[path]
+	return ok && used.After(t)
+}
+
+// lastUse returns when the file at path was last written or reused.
+func (idx *uploadIndex) lastUse(path string) (time.Time, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	used, ok := idx.lastUsed[path]
+	return used, ok
+}
+
+// forget drops a deleted file from the index.
+func (idx *uploadIndex) forget(path string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.lastUsed[path]; !ok {
+		return
+	}
+	delete(idx.lastUsed, path)
+	delete(idx.quality, path)
+	dir, filename := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	for key, name := range idx.byHash {
+		if name == filename && strings.HasPrefix(key, dir+"\x00") {
+			delete(idx.byHash, key)
+		}
+	}
+}
+
+// screenshotOptions controls how persistScreenshot transforms images before
+// writing them.
+type screenshotOptions struct {
+	stripMetadata bool
+	jpegQuality   int
+	thumbnailSize int    // long edge in pixels; 0 disables thumbnails
+	canonical     string // "png" or "jpg" to re-encode every upload; "" keeps formats
+	maxBytes      int    // re-encode larger screenshots as JPEG to fit; 0 disables
+	optimizePNG   bool   // losslessly re-compress PNGs, keeping the smaller file
+	minDimension  int    // smallest width or height accepted; 0 disables
+	maxDimension  int    // largest width or height accepted; 0 disables
+}
+
+// storedExt is the extension an upload of type ext is stored as.
+func (o screenshotOptions) storedExt(ext string) string {
+	if o.canonical == "" {
+		return ext
+	}
+	return o.canonical
+}
+
+// forMeta applies per-request overrides: meta.keepOriginal=true skips the
+// canonical conversion, the size cap and PNG optimization for users who need
+// the original bytes.
+func (o screenshotOptions) forMeta(meta map[string]interface{}) screenshotOptions {
+	if keep, _ := meta["keepOriginal"].(bool); keep {
+		o.canonical = ""
+		o.maxBytes = 0
+		o.optimizePNG = false
+	}
+	return o
+}
+
+// exceedsMax reports whether a screenshot of size bytes must be re-encoded
+// to fit maxBytes.
+func (o screenshotOptions) exceedsMax(size int64) bool {
+	return o.maxBytes > 0 && size > int64(o.maxBytes)
+}
+
+// checkDimensions rejects an image whose width or height falls outside
+// MIN_DIMENSION..MAX_DIMENSION. Only the header is read. Images whose header
+// does not decode are let through, as they were before the bounds existed.
+func (o screenshotOptions) checkDimensions(r io.Reader) error {
+	if o.minDimension <= 0 && o.maxDimension <= 0 {
+		return nil
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case o.minDimension > 0 && (cfg.Width < o.minDimension || cfg.Height < o.minDimension):
+		return fmt.Errorf("screenshot is %dx%d pixels: width and height must be at least %d", cfg.Width, cfg.Height, o.minDimension)
+	case o.maxDimension > 0 && (cfg.Width > o.maxDimension || cfg.Height > o.maxDimension):
+		return fmt.Errorf("screenshot is %dx%d pixels: width and height must be at most %d", cfg.Width, cfg.Height, o.maxDimension)
+	}
+	return nil
+}
+
+// parseCanonicalImage reads CANONICAL_IMAGE: png, jpeg/jpg, or empty.
+func parseCanonicalImage(raw string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "":
+		return "", nil
+	case "png":
+		return "png", nil
+	case "jpg", "jpeg":
+		return "jpg", nil
+	}
+	return "", fmt.Errorf("unsupported CANONICAL_IMAGE %q: use png or jpeg", raw)
+}
+
+// persistScreenshot stores an image data URL in dir. The sha256 it reports
+// is of the image as uploaded, which is also what deduplication keys on, so
+// repeated captures skip any re-encoding.
+func persistScreenshot(store BlobStore, dir, dataURL string, index *uploadIndex, opts screenshotOptions) (*storedUpload, error) {
+	ext, decoded, err := decodeScreenshotURL(dataURL)
+	if err != nil {
+		return nil, err
+	}
+	return storeScreenshot(store, dir, ext, decoded, index, opts)
+}
+
+// checkScreenshot runs the checks persistScreenshot would without storing
+// anything: the data URL must decode, the image must be within the dimension
+// bounds, a canonical conversion or size-capping re-encode must be possible,
+// and dir must have room for the image.
+func checkScreenshot(dir, dataURL string, opts screenshotOptions) error {
+	ext, decoded, err := decodeScreenshotURL(dataURL)
+	if err != nil {
+		return err
+	}
+	if err := opts.checkDimensions(bytes.NewReader(decoded)); err != nil {
+		return err
+	}
+	if opts.storedExt(ext) != ext || opts.exceedsMax(int64(len(decoded))) {
+		if _, _, err := image.Decode(bytes.NewReader(decoded)); err != nil {
+			return &conversionError{err: err}
+		}
+	}
+	return ensureSpace(dir, int64(len(decoded)))
+}
+
+// decodeScreenshotURL splits an image data URL into its file extension and
+// decoded bytes.
+func decodeScreenshotURL(dataURL string) (string, []byte, error) {
+	mediaType, decoded, err := decodeDataURL(dataURL)
+	if err != nil {
+		return "", nil, err
+	}
+	subtype, isImage := strings.CutPrefix(mediaType, "image/")
+	ext, ok := imageExtensions[subtype]
+	if !isImage || !ok {
+		return "", nil, fmt.Errorf("%w %q: use image/png or image/jpeg", errUnsupportedImageType, mediaType)
+	}
+	return ext, decoded, nil
+}
+
+// decodeDataURL splits a base64 data URL into its media type and bytes.
+func decodeDataURL(dataURL string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return "", nil, errBadDataURLPrefix
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !ok || !isBase64 {
+		return "", nil, errBadDataURLPrefix
+	}
+	if payload == "" {
+		return "", nil, fmt.Errorf("%w: no data after the comma", errBadBase64)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errBadBase64, err)
+	}
+	return mediaType, decoded, nil
+}
+
+func storeScreenshot(store BlobStore, dir, ext string, data []byte, index *uploadIndex, opts screenshotOptions) (*storedUpload, error) {
+	if err := opts.checkDimensions(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	target := opts.storedExt(ext)
+
+	// Key on the stored format and size cap too, so an original kept via
+	// keepOriginal is never handed out in place of a converted copy or vice
+	// versa.
+	key := hash + "." + target
+	if opts.maxBytes > 0 {
+		key += fmt.Sprintf(".max%d", opts.maxBytes)
+	}
+	if opts.optimizePNG && target == "png" {
+		key += ".opt"
+	}
+	filename, size, ok := index.reuse(store, dir, key)
+	if !ok {
+		stored := data
+		var err error
+		switch {
+		case target != ext:
+			// Re-encoding drops metadata as well, so no separate strip.
+			if stored, err = convertImage(data, target, opts.jpegQuality); err != nil {
+				return nil, &conversionError{err: err}
+			}
+		case opts.stripMetadata:
+			if stored, err = stripMetadata(ext, data, opts.jpegQuality); err != nil {
+				return nil, fmt.Errorf("strip metadata: %w", err)
+			}
+		}
+		optimizedFrom := 0
+		if opts.optimizePNG && target == "png" {
+			if smaller, err := optimizePNG(stored); err != nil {
+				log.Printf("optimize PNG: %v", err)
+			} else if len(smaller) < len(stored) {
+				optimizedFrom = len(stored)
+				stored = smaller
+			}
+		}
+		quality := 0
+		if opts.exceedsMax(int64(len(stored))) {
+			if stored, quality, err = fitJPEG(data, opts.maxBytes, opts.jpegQuality); err != nil {
+				return nil, &conversionError{err: err}
+			}
+			target = "jpg"
+		}
+		if filename, err = writeUpload(store, dir, target, stored); err != nil {
+			return nil, err
+		}
+		if optimizedFrom > 0 && target == "png" {
+			log.Printf("optimized PNG %s: %d -> %d bytes (saved %.1f%%)", filename, optimizedFrom, len(stored), 100*float64(optimizedFrom-len(stored))/float64(optimizedFrom))
+		}
+		size = len(stored)
+		index.record(dir, key, filename)
+		if quality > 0 {
+			index.recordQuality(dir, filename, quality)
+		}
+	}
+	// A size-capped upload may be stored as JPEG whatever was asked for.
+	target = strings.TrimPrefix(filepath.Ext(filename), ".")
+
+	upload := &storedUpload{filename: filename, sizeBytes: size, sha256: hash}
+	upload.describe(ext, target)
+	upload.jpegQuality = index.qualityOf(dir, filename)
+	// Only the header is parsed, so this stays cheap even for large images.
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		upload.width = cfg.Width
+		upload.height = cfg.Height
+	}
+	upload.thumbnail = thumbnailFor(store, dir, filename, target, opts)
+	return upload, nil
+}
+
+// spooledScreenshot is a raw image body copied to a temporary file and
+// hashed on the way, so the network read is done before any of the work
+// MAX_CONCURRENT_UPLOADS bounds.
+type spooledScreenshot struct {
+	path string
+	ext  string
+	hash string
+	size int64
+}
+
+// spoolScreenshot copies src to a temporary file without holding it in
+// memory. On the filesystem store the file sits next to its final place, so
+// moving it there is a rename; other stores get it from the system temp
+// directory. The caller must call remove once it is done with the spool.
+func spoolScreenshot(store BlobStore, dir, ext string, src io.Reader) (*spooledScreenshot, error) {
+	tmpDir := ""
+	if _, local := store.(*fsBlobStore); local {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, &storageError{op: "mkdir", err: err}
+		}
+		// The final size is unknown up front, so only the headroom is checked.
+		if err := ensureSpace(dir, 0); err != nil {
+			return nil, err
+		}
+		tmpDir = dir
+	}
+	tmp, err := os.CreateTemp(tmpDir, ".upload-*")
+	if err != nil {
+		return nil, &storageError{op: "create", err: err}
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(storageWriter{tmp}, hasher), src)
+	if closeErr := tmp.Close(); err == nil && closeErr != nil {
+		err = &storageError{op: "write", err: closeErr}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	return &spooledScreenshot{path: tmp.Name(), ext: ext, hash: hex.EncodeToString(hasher.Sum(nil)), size: size}, nil
+}
+
+// remove deletes the temporary file unless it was moved into place.
+func (s *spooledScreenshot) remove() {
+	os.Remove(s.path)
+}
+
+// persistSpooled stores a spooled image. A duplicate is discarded and a new
+// image moved into place; metadata stripping and PNG optimization need the
+// whole image, so with either enabled, or when the image is over
+// MAX_SCREENSHOT_BYTES, the file is read back and re-stored. Stores that
+// cannot take a local file (see blobMover) get it read back too.
+func persistSpooled(store BlobStore, dir string, spool *spooledScreenshot, index *uploadIndex, opts screenshotOptions) (*storedUpload, error) {
+	ext, hash, size := spool.ext, spool.hash, spool.size
+	mover, canMove := store.(blobMover)
+	if !canMove || opts.stripMetadata || opts.storedExt(ext) != ext || opts.exceedsMax(size) || (opts.optimizePNG && ext == "png") {
+		data, err := os.ReadFile(spool.path)
+		if err != nil {
+			return nil, &storageError{op: "read", err: err}
+		}
+		return storeScreenshot(store, dir, ext, data, index, opts)
+	}
+	if err := checkFileDimensions(spool.path, opts); err != nil {
+		return nil, err
+	}
+
+	// Read the header from the spool, which is local whatever the store.
+	var cfg image.Config
+	if f, err := os.Open(spool.path); err == nil {
+		cfg, _, _ = image.DecodeConfig(f)
+		f.Close()
+	}
+
+	key := hash + "." + ext
+	filename, reusedSize, ok := index.reuse(store, dir, key)
+	if ok {
+		size = int64(reusedSize)
+	} else {
+		filename = newUploadName(ext)
+		if err := mover.Move(filepath.Join(dir, filename), spool.path); err != nil {
+			return nil, err
+		}
+		uploadBytes.Add(float64(size))
+		index.record(dir, key, filename)
+	}
+
+	upload := &storedUpload{filename: filename, sizeBytes: int(size), sha256: hash}
+	upload.describe(ext, ext)
+	upload.width, upload.height = cfg.Width, cfg.Height
+	upload.thumbnail = thumbnailFor(store, dir, filename, ext, opts)
+	return upload, nil
+}
+
+// checkFileDimensions applies the dimension bounds to a spooled upload.
+func checkFileDimensions(path string, opts screenshotOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return &storageError{op: "read", err: err}
+	}
+	defer f.Close()
+	return opts.checkDimensions(f)
+}
+
+// thumbnailFor creates the upload's thumbnail when enabled. Failures only
+// cost the viewer a smaller download, so they are logged, not returned.
+func thumbnailFor(store BlobStore, dir, filename, ext string, opts screenshotOptions) string {
+	if opts.thumbnailSize <= 0 {
+		return ""
+	}
+	name, err := writeThumbnail(store, dir, filename, ext, opts.thumbnailSize, opts.jpegQuality)
+	if err != nil {
+		log.Printf("thumbnail for %s: %v", filename, err)
+		return ""
+	}
+	return name
+}
+
+// persistAudio stores an audio data URL and returns its filename.
+func persistAudio(store BlobStore, dir, dataURL string) (string, error) {
+	ext, decoded, err := decodeAudioURL(dataURL)
+	if err != nil {
+		return "", err
+	}
+	return writeUpload(store, dir, ext, decoded)
+}
+
+// checkAudio is persistAudio without the write.
+func checkAudio(dir, dataURL string) error {
+	_, decoded, err := decodeAudioURL(dataURL)
+	if err != nil {
+		return err
+	}
+	return ensureSpace(dir, int64(len(decoded)))
+}
+
+func decodeAudioURL(dataURL string) (string, []byte, error) {
+	mediaType, decoded, err := decodeDataURL(dataURL)
+	if err != nil {
+		return "", nil, err
+	}
+	subtype, isAudio := strings.CutPrefix(mediaType, "audio/")
+	ext, ok := audioExtensions[subtype]
+	if !isAudio || !ok {
+		return "", nil, fmt.Errorf("%w %q: use audio/webm, audio/mpeg or audio/wav", errUnsupportedAudioType, mediaType)
+	}
+	return ext, decoded, nil
+}
+
+// writeUpload stores data in dir under a fresh <unixmilli>-<id>.<ext> name.
+func writeUpload(store BlobStore, dir, ext string, data []byte) (string, error) {
+	filename := newUploadName(ext)
+	if _, err := store.Put(filepath.Join(dir, filename), data); err != nil {
+		return "", err
+	}
+	uploadBytes.Add(float64(len(data)))
+	return filename, nil
+}
+
+// randomUploadNames switches newUploadName from the default
+// <unixmilli>-<id>.<ext> scheme to opaque names (UPLOAD_NAMING=random).
+var randomUploadNames bool
+
+// setUploadNaming selects the filename scheme: "timestamp" (default) or
+// "random".
+func setUploadNaming(scheme string) error {
+	switch scheme {
+	case "", "timestamp":
+		randomUploadNames = false
+	case "random":
+		randomUploadNames = true
+	default:
+		return fmt.Errorf("unknown upload naming %q: use timestamp or random", scheme)
+	}
+	return nil
+}
+
+// newUploadName returns a fresh filename. Random names carry 128 bits from
+// crypto/rand and reveal nothing about when they were written; cleanup then
+// ages them by modification time instead of the name prefix.
+func newUploadName(ext string) string {
+	if randomUploadNames {
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err == nil {
+			return hex.EncodeToString(buf[:]) + "." + ext
+		}
+	}
+	return fmt.Sprintf("%d-%s.%s", time.Now().UnixMilli(), uuid.NewString()[:8], ext)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testJPEG encodes a blank w×h JPEG.
+func testJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPersistScreenshotDimensions(t *testing.T) {
+	png := testPNG(t, 64, 48)
+	jpg := testJPEG(t, 33, 21)
+	garbage := []byte("not really a png")
+
+	for _, tc := range []struct {
+		name          string
+		dataURL       string
+		width, height int
+		size          int
+	}{
+		{"png", pngDataURL(png), 64, 48, len(png)},
+		{"jpeg", "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(jpg), 33, 21, len(jpg)},
+		{"undecodable", pngDataURL(garbage), 0, 0, len(garbage)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			upload, err := persistScreenshot(newFSBlobStore(dir), dir, tc.dataURL, newUploadIndex(), screenshotOptions{})
+			if err != nil {
+				t.Fatalf("persistScreenshot: %v", err)
+			}
+			if upload.width != tc.width || upload.height != tc.height {
+				t.Errorf("dimensions = %dx%d, want %dx%d", upload.width, upload.height, tc.width, tc.height)
+			}
+			if upload.sizeBytes != tc.size {
+				t.Errorf("sizeBytes = %d, want %d", upload.sizeBytes, tc.size)
+			}
+			if files := storedFiles(t, dir); len(files) != 1 {
+				t.Errorf("stored %v, want the one upload", files)
+			}
+		})
+	}
+}
+
+func TestFeedbackPayloadDimensions(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	img := testPNG(t, 20, 10)
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL(img)})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["width"] != 20.0 || payload["height"] != 10.0 || payload["sizeBytes"] != float64(len(img)) {
+		t.Errorf("payload width, height, sizeBytes = %v, %v, %v; want 20, 10, %d", payload["width"], payload["height"], payload["sizeBytes"], len(img))
+	}
+
+	rec = postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL([]byte("junk"))})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post of undecodable bytes = %d %s", rec.Code, rec.Body)
+	}
+	payload = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := payload["width"]; ok {
+		t.Errorf("undecodable image payload has width %v, want it omitted", payload["width"])
+	}
+}
+
+func TestPersistScreenshotFormats(t *testing.T) {
+	pngURL := pngDataURL(testPNG(t, 8, 8))
+	jpegURL := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(testJPEG(t, 8, 8))
+
+	for _, tc := range []struct {
+		name        string
+		dataURL     string
+		canonical   string
+		contentType string
+		original    string
+	}{
+		{"png", pngURL, "", "image/png", "png"},
+		{"jpeg", jpegURL, "", "image/jpeg", "jpeg"},
+		{"png to jpeg", pngURL, "jpg", "image/jpeg", "png"},
+		{"jpeg to png", jpegURL, "png", "image/png", "jpeg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			upload, err := persistScreenshot(newFSBlobStore(dir), dir, tc.dataURL, newUploadIndex(), screenshotOptions{canonical: tc.canonical, jpegQuality: 90})
+			if err != nil {
+				t.Fatalf("persistScreenshot: %v", err)
+			}
+			if upload.contentType != tc.contentType || upload.originalFormat != tc.original {
+				t.Errorf("contentType, originalFormat = %q, %q; want %q, %q", upload.contentType, upload.originalFormat, tc.contentType, tc.original)
+			}
+		})
+	}
+
+	// WebP is not accepted, so it never gets as far as a payload.
+	dir := t.TempDir()
+	webp := "data:image/webp;base64," + base64.StdEncoding.EncodeToString([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "))
+	if _, err := persistScreenshot(newFSBlobStore(dir), dir, webp, newUploadIndex(), screenshotOptions{}); !errors.Is(err, errUnsupportedImageType) {
+		t.Errorf("webp: err = %v, want errUnsupportedImageType", err)
+	}
+}
+
+func TestFeedbackPayloadFormat(t *testing.T) {
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	reg.screenshots = screenshotOptions{canonical: "jpg", jpegQuality: 90}
+	rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL(testPNG(t, 8, 8))})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post = %d %s", rec.Code, rec.Body)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["contentType"] != "image/jpeg" || payload["originalFormat"] != "png" {
+		t.Errorf("payload contentType, originalFormat = %v, %v; want image/jpeg, png", payload["contentType"], payload["originalFormat"])
+	}
+}
+
+func TestDataURLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dataURL string
+		want    error
+		message string // what the 400 body must say
+	}{
+		{"no prefix", "iVBORw0KGgo=", errBadDataURLPrefix, "invalid image: expected a base64 data URL"},
+		{"not base64", "data:image/png,iVBORw0KGgo=", errBadDataURLPrefix, "invalid image: expected a base64 data URL"},
+		{"no comma", "data:image/png;base64", errBadDataURLPrefix, "invalid image: expected a base64 data URL"},
+		{"gif", "data:image/gif;base64,R0lGODlh", errUnsupportedImageType, `invalid image: unsupported image type \"image/gif\": use image/png or image/jpeg`},
+		{"text", "data:text/plain;base64,aGk=", errUnsupportedImageType, `invalid image: unsupported image type \"text/plain\"`},
+		{"empty data", "data:image/png;base64,", errBadBase64, "invalid image: malformed base64: no data after the comma"},
+		{"bad base64", "data:image/png;base64,@@@@", errBadBase64, "invalid image: malformed base64: illegal base64 data"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := persistScreenshot(newFSBlobStore(dir), dir, tc.dataURL, newUploadIndex(), screenshotOptions{})
+			if !errors.Is(err, tc.want) {
+				t.Errorf("persistScreenshot: err = %v, want %v", err, tc.want)
+			}
+			for _, other := range []error{errBadDataURLPrefix, errUnsupportedImageType, errBadBase64} {
+				if other != tc.want && errors.Is(err, other) {
+					t.Errorf("err %v also matches %v", err, other)
+				}
+			}
+
+			reg := newRoomRegistry(dir, 10, false)
+			rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": tc.dataURL})
+			if rec.Code != http.StatusBadRequest || errorCode(t, rec) != "invalid_image" || !strings.Contains(rec.Body.String(), tc.message) {
+				t.Errorf("post = %d %s, want 400 invalid_image saying %s", rec.Code, rec.Body, tc.message)
+			}
+		})
+	}
+}
+
+func TestScreenshotDimensionBounds(t *testing.T) {
+	opts := screenshotOptions{minDimension: 8, maxDimension: 64}
+	for _, tc := range []struct {
+		w, h    int
+		message string // empty means accepted
+	}{
+		{1, 1, "screenshot is 1x1 pixels: width and height must be at least 8"},
+		{100, 7, "screenshot is 100x7 pixels: width and height must be at least 8"},
+		{65, 20, "screenshot is 65x20 pixels: width and height must be at most 64"},
+		{20, 300, "screenshot is 20x300 pixels: width and height must be at most 64"},
+		{8, 8, ""},
+		{64, 64, ""},
+	} {
+		t.Run(fmt.Sprintf("%dx%d", tc.w, tc.h), func(t *testing.T) {
+			img := testPNG(t, tc.w, tc.h)
+			reg := newRoomRegistry(t.TempDir(), 10, false)
+			reg.screenshots = opts
+
+			rec := postFeedback(t, reg, "/api/feedback", map[string]interface{}{"feedback": "hi", "image": pngDataURL(img)})
+			checkDimensionResponse(t, "JSON", rec, tc.message)
+
+			var body bytes.Buffer
+			req := httptest.NewRequest(http.MethodPost, "/api/feedback/multipart", &body)
+			req.Header.Set("Content-Type", writeMultipartFeedback(t, &body, img, "feedback", "hi"))
+			rec = httptest.NewRecorder()
+			handleFeedbackMultipart(10<<20, reg)(rec, req)
+			checkDimensionResponse(t, "multipart", rec, tc.message)
+
+			if tc.message != "" {
+				if files := storedFiles(t, reg.uploadDir); len(files) != 0 {
+					t.Errorf("rejected image left %v behind", files)
+				}
+			}
+		})
+	}
+}
+
+func checkDimensionResponse(t *testing.T, path string, rec *httptest.ResponseRecorder, message string) {
+	t.Helper()
+	if message == "" {
+		if rec.Code != http.StatusCreated {
+			t.Errorf("%s: post = %d %s, want 201", path, rec.Code, rec.Body)
+		}
+		return
+	}
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), message) {
+		t.Errorf("%s: post = %d %s, want 400 saying %q", path, rec.Code, rec.Body, message)
+	}
+}
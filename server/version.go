@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Anything left unset reads "dev".
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "dev"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// buildInfo reports the build metadata. Without -ldflags the commit falls
+// back to the VCS revision Go stamps into binaries built from a checkout.
+func buildInfo() versionInfo {
+	info := versionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if commit == "dev" {
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range bi.Settings {
+				if setting.Key == "vcs.revision" && setting.Value != "" {
+					info.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+func handleVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(buildInfo()); err != nil {
+			log.Printf("failed to encode version: %v", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhook mirrors every feedback payload to an external URL. Deliveries are
+// queued for a fixed pool of workers so a slow receiver never holds up
+// /api/feedback; when the queue is full new payloads are dropped.
+type webhook struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	queue   chan webhookDelivery
+	retries int
+}
+
+type webhookDelivery struct {
+	room      string
+	requestID string // of the request that stored the payload
+	body      []byte
+}
+
+// newWebhook starts its delivery workers in group; they stop, abandoning
+// anything still queued, when the group does.
+func newWebhook(url, secret string, workers, queueSize int, group *workerGroup) *webhook {
+	hook := &webhook{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan webhookDelivery, queueSize),
+		retries: 3,
+	}
+	for i := 0; i < workers; i++ {
+		group.start(hook.run)
+	}
+	return hook
+}
+
+// send queues body for delivery. A nil webhook does nothing.
+func (h *webhook) send(room, requestID string, body []byte) {
+	if h == nil {
+		return
+	}
+	select {
+	case h.queue <- webhookDelivery{room: room, requestID: requestID, body: body}:
+	default:
+		log.Printf("webhook queue full; dropping payload from request %s", requestID)
+	}
+}
+
+func (h *webhook) run(ctx context.Context) {
+	for {
+		var d webhookDelivery
+		select {
+		case <-ctx.Done():
+			return
+		case d = <-h.queue:
+		}
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := h.post(ctx, d)
+			if err == nil {
+				break
+			}
+			if attempt > h.retries {
+				log.Printf("webhook delivery for request %s failed after %d attempts: %v", d.requestID, attempt, err)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// post delivers one payload. With a secret set, X-Relay-Signature carries
+// "sha256=" + hex(HMAC-SHA256(secret, body)) for the receiver to verify.
+func (h *webhook) post(ctx context.Context, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "interview-relay")
+	if d.requestID != "" {
+		req.Header.Set("X-Request-Id", d.requestID)
+	}
+	if d.room != defaultRoom {
+		req.Header.Set("X-Relay-Room", d.room)
+	}
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(d.body)
+		req.Header.Set("X-Relay-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", h.url, res.Status)
+	}
+	return nil
+}
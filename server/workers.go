@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// workerGroup owns the relay's background goroutines: cleanup sweeps, the
+// room reaper, the state saver and webhook deliveries. They all run until
+// the group's context is cancelled, and stop waits for every one to return,
+// so starting and stopping a server leaves no goroutines behind.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newWorkerGroup(parent context.Context) *workerGroup {
+	ctx, cancel := context.WithCancel(parent)
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// start runs fn in its own goroutine with the group's context. Once stop has
+// been called it does nothing, as nobody would wait for fn to return.
+func (g *workerGroup) start(fn func(ctx context.Context)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+	}()
+}
+
+// stop cancels every worker and waits for them to return.
+func (g *workerGroup) stop() {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+	g.cancel()
+	g.wg.Wait()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerGroupStopCancelsAndWaits(t *testing.T) {
+	g := newWorkerGroup(context.Background())
+	var running, finished atomic.Int32
+	for range 3 {
+		g.start(func(ctx context.Context) {
+			running.Add(1)
+			<-ctx.Done()
+			// Outlast the cancel so stop returning early would show.
+			time.Sleep(20 * time.Millisecond)
+			finished.Add(1)
+		})
+	}
+	for running.Load() < 3 {
+		runtime.Gosched()
+	}
+
+	g.stop()
+	if got := finished.Load(); got != 3 {
+		t.Errorf("stop returned with %d of 3 workers finished", got)
+	}
+	if g.ctx.Err() == nil {
+		t.Error("stop left the context live")
+	}
+}
+
+func TestWorkerGroupStartAfterStop(t *testing.T) {
+	g := newWorkerGroup(context.Background())
+	g.stop()
+
+	before := runtime.NumGoroutine()
+	var ran atomic.Bool
+	g.start(func(ctx context.Context) {
+		ran.Store(true)
+		<-ctx.Done()
+	})
+	g.stop()
+	time.Sleep(10 * time.Millisecond)
+	if ran.Load() {
+		t.Error("worker started after stop ran")
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after start, want at most %d", after, before)
+	}
+}
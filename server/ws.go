@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsMaxMessageSize = 64 << 10
+)
+
+// wsInbound is a message sent by a viewer over the socket.
+type wsInbound struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	controlRequest
+}
+
+// handleWebSocket is an alternative to /api/stream for networks whose
+// proxies mangle text/event-stream. It registers with the same broker, so
+// both transports see every broadcast. Viewers may also send
+// {"type":"ack","id":...} and, when authorised to send controls (apiToken
+// unset or presented), {"type":"control","action":...}. Controls share
+// limiter, when set, with POST /api/control.
+func handleWebSocket(rooms *roomRegistry, acks *ackTracker, apiToken string, limiter *rateLimiter, pingInterval time.Duration, buffer int) http.HandlerFunc {
+	allowed := parseOrigins(os.Getenv("CLIENT_ORIGIN"))
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || strings.EqualFold(strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://"), r.Host) {
+				return true
+			}
+			_, ok := matchOrigin(allowed, origin)
+			return ok
+		},
+	}
+	if pingInterval <= 0 {
+		pingInterval = 30 * time.Second
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := rooms.fromRequest(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_room", err.Error())
+			return
+		}
+		canControl := wsCanControl(r, apiToken)
+		ip := clientIP(r)
+
+		// Register before upgrading so a full room still gets a plain 503.
+		filter := parseTypeFilter(r)
+		client := newClient(buffer, false)
+		client.id = middleware.GetReqID(r.Context())
+		client.observer = filter.presenceOnly()
+		if !room.broker.addClient(client) {
+			rejectFullRoom(w, room)
+			return
+		}
+		defer room.broker.removeClient(client)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already replied with an error.
+			return
+		}
+		defer conn.Close()
+
+		replies := make(chan []byte, 4)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			readWebSocket(conn, room, acks, canControl, func() (bool, time.Duration) {
+				if limiter == nil {
+					return true, 0
+				}
+				return limiter.allow(ip, time.Now())
+			}, pingInterval, replies)
+		}()
+
+		write := func(data []byte) bool {
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			return conn.WriteMessage(websocket.TextMessage, data) == nil
+		}
+
+		var lastSent uint64
+		if msg, ok := room.state.latestMessage(); ok && filter.allows(msg) {
+			if !write(msg.data) {
+				return
+			}
+			lastSent = msg.id
+		}
+
+		ping := time.NewTicker(pingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-r.Context().Done():
+				return
+			case data := <-replies:
+				if !write(data) {
+					return
+				}
+			case msg, ok := <-client.ch:
+				if !ok {
+					return
+				}
+				if (msg.id != 0 && msg.id <= lastSent) || !filter.allows(msg) {
+					continue
+				}
+				if !write(msg.data) {
+					return
+				}
+				if msg.id != 0 {
+					lastSent = msg.id
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// wsCanControl reports whether a socket may send controls. The socket sits
+// behind the VIEWER_TOKEN gate, which already takes ?token= and the bearer
+// header, so the API token comes as ?apiToken= when the two differ. A
+// bearer or ?token= equal to apiToken still works for a shared token.
+func wsCanControl(r *http.Request, apiToken string) bool {
+	if apiToken == "" {
+		return true
+	}
+	for _, candidate := range []string{r.URL.Query().Get("apiToken"), requestToken(r, true)} {
+		if candidate != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(apiToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// readWebSocket handles inbound viewer messages until the connection fails.
+// A peer that misses two pings in a row is considered gone. allow takes a
+// RATE_LIMIT_RPS token for each control frame.
+func readWebSocket(conn *websocket.Conn, room *roomState, acks *ackTracker, canControl bool, allow func() (bool, time.Duration), pingInterval time.Duration, replies chan<- []byte) {
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	reply := func(errText string) {
+		data, _ := json.Marshal(map[string]string{"type": "error", "error": errText})
+		select {
+		case replies <- data:
+		default:
+		}
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket read failed: %v", err)
+			}
+			return
+		}
+
+		var in wsInbound
+		if err := json.Unmarshal(data, &in); err != nil {
+			reply("invalid JSON message")
+			continue
+		}
+		switch in.Type {
+		case "ack":
+			if !acks.ack(in.ID, "", time.Now().UTC()) {
+				reply("unknown or expired control id")
+			}
+		case "control":
+			if !canControl {
+				reply("controls require the API token")
+				continue
+			}
+			if ok, wait := allow(); !ok {
+				reply(fmt.Sprintf("rate limit exceeded; retry in %ds", int(math.Ceil(wait.Seconds()))))
+				continue
+			}
+			if _, err := sendControl(room, acks, in.controlRequest); err != nil {
+				reply(err.Error())
+			}
+		default:
+			reply("unsupported message type")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// dialWS serves /api/ws behind the VIEWER_TOKEN gate, as main does, and
+// dials it with query.
+func dialWS(t *testing.T, apiToken string, limiter *rateLimiter, query string) *websocket.Conn {
+	t.Helper()
+	reg := newRoomRegistry(t.TempDir(), 10, false)
+	r := chi.NewRouter()
+	r.With(bearerAuth("viewer", true)).Get("/api/ws", handleWebSocket(reg, newAckTracker(time.Minute), apiToken, limiter, time.Minute, 4))
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/ws?"+query, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial: %v (status %d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendScroll sends a scroll control and returns the type of the frame that
+// answers it, plus its error text for "error" frames.
+func sendScroll(t *testing.T, conn *websocket.Conn) (string, string) {
+	t.Helper()
+	if err := conn.WriteJSON(map[string]interface{}{"type": "control", "action": "scroll", "delta": 100}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("frame %s: %v", data, err)
+	}
+	return frame.Type, frame.Error
+}
+
+func TestWebSocketControlsWithSeparateTokens(t *testing.T) {
+	conn := dialWS(t, "api", nil, "types=control&token=viewer&apiToken=api")
+	if kind, text := sendScroll(t, conn); kind != "control" {
+		t.Fatalf("reply = %s %q, want the control broadcast", kind, text)
+	}
+
+	conn = dialWS(t, "api", nil, "types=control&token=viewer")
+	if kind, text := sendScroll(t, conn); kind != "error" || !strings.Contains(text, "API token") {
+		t.Errorf("reply without apiToken = %s %q, want an API token error", kind, text)
+	}
+
+	conn = dialWS(t, "api", nil, "types=control&token=viewer&apiToken=wrong")
+	if kind, _ := sendScroll(t, conn); kind != "error" {
+		t.Errorf("reply with a wrong apiToken = %s, want error", kind)
+	}
+}
+
+func TestWebSocketControlsAreRateLimited(t *testing.T) {
+	const burst = 2
+	conn := dialWS(t, "api", newRateLimiter(0.001, burst), "types=control&token=viewer&apiToken=api")
+	for i := 1; i <= burst; i++ {
+		if kind, text := sendScroll(t, conn); kind != "control" {
+			t.Fatalf("control %d = %s %q, want it sent within the burst", i, kind, text)
+		}
+	}
+	if kind, text := sendScroll(t, conn); kind != "error" || !strings.Contains(text, "rate limit") {
+		t.Errorf("control %d = %s %q, want a rate limit error", burst+1, kind, text)
+	}
+}